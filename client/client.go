@@ -5,7 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
 	"github.com/jeffersonsong/crypto-exchange/server"
 )
 
@@ -14,8 +19,24 @@ const Endpoint = "http://localhost:3000"
 type PlaceOrderParams struct {
 	UserID int64
 	Bid    bool
-	Price  float64 // only needed for placing LIMIT orders.
-	Size   float64
+	Price  decimal.Decimal // only needed for placing LIMIT orders.
+	Size   decimal.Decimal
+	// TimeInForce and ExpiresAt are optional, see server.PlaceOrderRequest.
+	TimeInForce orderbook.TimeInForce
+	ExpiresAt   int64
+	// PostOnly only applies to LIMIT orders.
+	PostOnly   orderbook.PostOnly
+	ReduceOnly bool
+	// StopPrice and Trigger are only needed for placing stop orders.
+	StopPrice decimal.Decimal
+	Trigger   orderbook.TriggerType
+	// DisplaySize makes a LIMIT order an iceberg order.
+	DisplaySize decimal.Decimal
+	// SelfTradePrevention defaults to the mode of the user.
+	SelfTradePrevention orderbook.SelfTradePrevention
+	// ClientOrderID is optional. Placing an order again with the same
+	// ClientOrderID returns the first response and places nothing.
+	ClientOrderID string
 }
 
 type Client struct {
@@ -28,8 +49,29 @@ func NewClient() *Client {
 	}
 }
 
-func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, userID)
+// decode decodes the body of the reply into v. A reply that is not OK is
+// returned as a *server.Error, which callers can errors.As, or errors.Is
+// against the errors of the server package.
+func decode(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &server.Error{}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+			apiErr = &server.Error{Code: server.CodeInternal, Message: resp.Status}
+		}
+		apiErr.Status = resp.StatusCode
+		return apiErr
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) GetOrders(market server.Market, userID int64) (*server.GetOrdersResponse, error) {
+	e := fmt.Sprintf("%s/book/%s/orders/%d", Endpoint, market, userID)
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -42,85 +84,208 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 	}
 
 	orders := server.GetOrdersResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+	if err := decode(resp, &orders); err != nil {
 		return nil, err
 	}
 	return &orders, nil
 }
 
-func (c *Client) GetBestBid() (float64, error) {
-	e := fmt.Sprintf("%s/book/ETH/bid", Endpoint)
+// GetOrderHistory returns a page of the orders the user placed, the newest
+// first. Pass the NextCursor of a page as the Cursor of q for the next one.
+func (c *Client) GetOrderHistory(userID int64, q *server.OrderHistoryQuery) (*server.OrderHistoryResponse, error) {
+	values := url.Values{}
+	if q.Market != "" {
+		values.Set("market", string(q.Market))
+	}
+	if len(q.Status) > 0 {
+		status := make([]string, len(q.Status))
+		for i, s := range q.Status {
+			status[i] = string(s)
+		}
+		values.Set("status", strings.Join(status, ","))
+	}
+	for name, v := range map[string]int64{"from": q.From, "to": q.To, "cursor": q.Cursor, "limit": int64(q.Limit)} {
+		if v != 0 {
+			values.Set(name, strconv.FormatInt(v, 10))
+		}
+	}
+	e := fmt.Sprintf("%s/orders/%d/history?%s", Endpoint, userID, values.Encode())
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &server.OrderHistoryResponse{}
+	if err := decode(resp, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// GetTrades returns up to limit of the latest trades of the market, the
+// newest first. A zero limit returns the default number of trades.
+func (c *Client) GetTrades(market server.Market, limit int) ([]*server.Trade, error) {
+	e := fmt.Sprintf("%s/trades/%s", Endpoint, market)
+	if limit != 0 {
+		e += fmt.Sprintf("?limit=%d", limit)
+	}
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
-		return 0.0, err
+		return nil, err
 	}
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0.0, err
+		return nil, err
+	}
+
+	trades := []*server.Trade{}
+	if err := decode(resp, &trades); err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
+
+// GetFills returns a page of the fills of the user, the newest first. Pass
+// the NextCursor of a page as the Cursor of q for the next one.
+func (c *Client) GetFills(userID int64, q *server.FillQuery) (*server.FillsResponse, error) {
+	values := url.Values{}
+	if q.Market != "" {
+		values.Set("market", string(q.Market))
+	}
+	for name, v := range map[string]int64{"from": q.From, "to": q.To, "cursor": q.Cursor, "limit": int64(q.Limit)} {
+		if v != 0 {
+			values.Set(name, strconv.FormatInt(v, 10))
+		}
+	}
+	e := fmt.Sprintf("%s/fills/%d?%s", Endpoint, userID, values.Encode())
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	fills := &server.FillsResponse{}
+	if err := decode(resp, &fills); err != nil {
+		return nil, err
+	}
+	return fills, nil
+}
+
+func (c *Client) GetBestBid(market server.Market) (decimal.Decimal, error) {
+	e := fmt.Sprintf("%s/book/%s/bid", Endpoint, market)
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return decimal.Zero, err
 	}
 
 	priceResp := &server.PriceResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&priceResp); err != nil {
-		return 0.0, err
+	if err := decode(resp, &priceResp); err != nil {
+		return decimal.Zero, err
 	}
 
 	return priceResp.Price, nil
 }
 
-func (c *Client) GetBestAsk() (float64, error) {
-	e := fmt.Sprintf("%s/book/ETH/ask", Endpoint)
+func (c *Client) GetBestAsk(market server.Market) (decimal.Decimal, error) {
+	e := fmt.Sprintf("%s/book/%s/ask", Endpoint, market)
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
-		return 0.0, err
+		return decimal.Zero, err
 	}
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return 0.0, err
+		return decimal.Zero, err
 	}
 
 	priceResp := &server.PriceResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&priceResp); err != nil {
-		return 0.0, err
+	if err := decode(resp, &priceResp); err != nil {
+		return decimal.Zero, err
 	}
 
 	return priceResp.Price, nil
 }
 
-func (c *Client) CancelOrder(orderID int64) error {
-	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
+func (c *Client) CancelOrder(market server.Market, orderID int64) error {
+	e := fmt.Sprintf("%s/book/%s/order/%d", Endpoint, market, orderID)
 	req, err := http.NewRequest(http.MethodDelete, e, nil)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.Do(req)
+	resp, err := c.Do(req)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return decode(resp, nil)
 }
 
-func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
-	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.MarketOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Market: server.MarketETH,
+func (c *Client) GetOrderByClientID(market server.Market, userID int64, clientOrderID string) (*server.ClientOrderResponse, error) {
+	e := fmt.Sprintf("%s/book/%s/orders/%d/client/%s", Endpoint, market, userID, url.PathEscape(clientOrderID))
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	body, err := json.Marshal(params)
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	e := Endpoint + "/order"
-	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	clientOrder := &server.ClientOrderResponse{}
+	if err := decode(resp, &clientOrder); err != nil {
+		return nil, err
+	}
+	return clientOrder, nil
+}
+
+func (c *Client) CancelOrderByClientID(market server.Market, userID int64, clientOrderID string) error {
+	e := fmt.Sprintf("%s/book/%s/orders/%d/client/%s", Endpoint, market, userID, url.PathEscape(clientOrderID))
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return decode(resp, nil)
+}
+
+// AmendOrder changes the price and size of a resting LIMIT order. Reducing the
+// size at the same price keeps its time priority.
+func (c *Client) AmendOrder(market server.Market, orderID int64, p *server.AmendOrderRequest) (*server.PlaceOrderResponse, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	e := fmt.Sprintf("%s/book/%s/order/%d", Endpoint, market, orderID)
+	req, err := http.NewRequest(http.MethodPut, e, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -130,24 +295,82 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 		return nil, err
 	}
 
-	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&placeOrderResponse); err != nil {
+	amendOrderResponse := &server.PlaceOrderResponse{}
+	if err := decode(resp, &amendOrderResponse); err != nil {
 		return nil, err
 	}
 
-	return placeOrderResponse, nil
+	return amendOrderResponse, nil
 }
 
-func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+func (c *Client) PlaceMarketOrder(market server.Market, p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	params := &server.PlaceOrderRequest{
+		UserID: p.UserID,
+		Type:   server.MarketOrder,
+		Bid:    p.Bid,
+		Size:   p.Size,
+		Market: market,
+
+		TimeInForce: p.TimeInForce,
+		ExpiresAt:   p.ExpiresAt,
+		ReduceOnly:  p.ReduceOnly,
+
+		SelfTradePrevention: p.SelfTradePrevention,
+		ClientOrderID:       p.ClientOrderID,
+	}
+
+	return c.placeOrder(params)
+}
+
+func (c *Client) PlaceLimitOrder(market server.Market, p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 	params := &server.PlaceOrderRequest{
 		UserID: p.UserID,
 		Type:   server.LimitOrder,
 		Bid:    p.Bid,
 		Size:   p.Size,
 		Price:  p.Price,
-		Market: server.MarketETH,
+		Market: market,
+
+		TimeInForce: p.TimeInForce,
+		ExpiresAt:   p.ExpiresAt,
+		PostOnly:    p.PostOnly,
+		ReduceOnly:  p.ReduceOnly,
+		DisplaySize: p.DisplaySize,
+
+		SelfTradePrevention: p.SelfTradePrevention,
+		ClientOrderID:       p.ClientOrderID,
+	}
+
+	return c.placeOrder(params)
+}
+
+// PlaceStopOrder places a STOP_LIMIT order when p.Price is set and a
+// STOP_MARKET order otherwise.
+func (c *Client) PlaceStopOrder(market server.Market, p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	params := &server.PlaceOrderRequest{
+		UserID:    p.UserID,
+		Type:      server.StopMarketOrder,
+		Bid:       p.Bid,
+		Size:      p.Size,
+		Market:    market,
+		StopPrice: p.StopPrice,
+		Trigger:   p.Trigger,
+
+		TimeInForce: p.TimeInForce,
+		ExpiresAt:   p.ExpiresAt,
+
+		SelfTradePrevention: p.SelfTradePrevention,
+		ClientOrderID:       p.ClientOrderID,
+	}
+	if !p.Price.IsZero() {
+		params.Type = server.StopLimitOrder
+		params.Price = p.Price
 	}
 
+	return c.placeOrder(params)
+}
+
+func (c *Client) placeOrder(params *server.PlaceOrderRequest) (*server.PlaceOrderResponse, error) {
 	body, err := json.Marshal(params)
 	if err != nil {
 		return nil, err
@@ -165,9 +388,245 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 	}
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(&placeOrderResponse); err != nil {
+	if err := decode(resp, &placeOrderResponse); err != nil {
 		return nil, err
 	}
 
 	return placeOrderResponse, nil
 }
+
+// GetAccount returns the available and held balances of the user in the
+// ledger of the exchange.
+func (c *Client) GetAccount(userID int64) (*server.AccountResponse, error) {
+	e := fmt.Sprintf("%s/account/%d", Endpoint, userID)
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &server.AccountResponse{}
+	if err := decode(resp, &account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (c *Client) Deposit(p *server.DepositRequest) (*server.AccountResponse, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint + "/deposit"
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &server.AccountResponse{}
+	if err := decode(resp, &account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (c *Client) GetStopOrders(market server.Market, userID int64) ([]*server.StopOrder, error) {
+	e := fmt.Sprintf("%s/book/%s/orders/%d/stops", Endpoint, market, userID)
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stops := []*server.StopOrder{}
+	if err := decode(resp, &stops); err != nil {
+		return nil, err
+	}
+	return stops, nil
+}
+
+func (c *Client) AmendStopOrder(market server.Market, orderID int64, p *server.AmendStopOrderRequest) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	e := fmt.Sprintf("%s/book/%s/stop/%d", Endpoint, market, orderID)
+	req, err := http.NewRequest(http.MethodPut, e, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return decode(resp, nil)
+}
+
+func (c *Client) CancelStopOrder(market server.Market, orderID int64) error {
+	e := fmt.Sprintf("%s/book/%s/stop/%d", Endpoint, market, orderID)
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return decode(resp, nil)
+}
+
+// GetSettlements returns how far the settlement of every trade of the user
+// got.
+func (c *Client) GetSettlements(userID int64) ([]*server.TradeSettlement, error) {
+	e := fmt.Sprintf("%s/settlements/%d", Endpoint, userID)
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	trades := []*server.TradeSettlement{}
+	if err := decode(resp, &trades); err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
+
+// GetFailedSettlements returns the settlements that ran out of attempts.
+func (c *Client) GetFailedSettlements() ([]*server.Settlement, error) {
+	e := Endpoint + "/admin/settlements/failed"
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	settlements := []*server.Settlement{}
+	if err := decode(resp, &settlements); err != nil {
+		return nil, err
+	}
+	return settlements, nil
+}
+
+// RedriveSettlement queues a failed settlement again.
+func (c *Client) RedriveSettlement(id int64) (*server.Settlement, error) {
+	e := fmt.Sprintf("%s/admin/settlements/%d/redrive", Endpoint, id)
+
+	req, err := http.NewRequest(http.MethodPost, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	settlement := &server.Settlement{}
+	if err := decode(resp, &settlement); err != nil {
+		return nil, err
+	}
+	return settlement, nil
+}
+
+// GetMarkets returns the markets of the exchange.
+func (c *Client) GetMarkets() ([]server.MarketConfig, error) {
+	e := Endpoint + "/markets"
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	markets := []server.MarketConfig{}
+	if err := decode(resp, &markets); err != nil {
+		return nil, err
+	}
+	return markets, nil
+}
+
+// AddMarket opens a market on the exchange.
+func (c *Client) AddMarket(cfg *server.MarketConfig) (*server.MarketConfig, error) {
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint + "/admin/markets"
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	market := &server.MarketConfig{}
+	if err := decode(resp, &market); err != nil {
+		return nil, err
+	}
+	return market, nil
+}
+
+// SetMarketStatus halts the market or lets it trade again.
+func (c *Client) SetMarketStatus(market server.Market, status server.MarketStatus) (*server.MarketConfig, error) {
+	body, err := json.Marshal(&server.SetMarketStatusRequest{Status: status})
+	if err != nil {
+		return nil, err
+	}
+
+	e := fmt.Sprintf("%s/admin/markets/%s/status", Endpoint, market)
+	req, err := http.NewRequest(http.MethodPut, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &server.MarketConfig{}
+	if err := decode(resp, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
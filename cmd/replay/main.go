@@ -0,0 +1,41 @@
+// Replay prints the matches the exchange made for a range of its journal.
+//
+//	go run ./cmd/replay -journal exchange.journal -from 100 -to 200
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+	"github.com/jeffersonsong/crypto-exchange/server"
+)
+
+func main() {
+	var (
+		path = flag.String("journal", "exchange.journal", "journal to replay")
+		from = flag.Uint64("from", 1, "first sequence number to print the matches of")
+		to   = flag.Uint64("to", 0, "last sequence number to replay, 0 for the whole journal")
+	)
+	flag.Parse()
+
+	// The exchange logs every command it applies.
+	log.SetOutput(io.Discard)
+
+	// Markets added at runtime are in the journal, the configured ones not.
+	markets := server.DefaultConfig().Markets
+	err := server.ReplayJournal(*path, markets, *from, *to, func(cmd server.Command, matches []orderbook.Match) {
+		for _, match := range matches {
+			fmt.Printf("%d %s %s | price [%s] | size [%s] | ask [%d/%d] | bid [%d/%d]\n",
+				cmd.Seq, cmd.Market, cmd.Type, match.Price, match.SizeFilled,
+				match.Ask.ID, match.Ask.UserID, match.Bid.ID, match.Bid.UserID)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
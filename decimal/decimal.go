@@ -0,0 +1,435 @@
+package decimal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// MaxScale is the largest number of decimal places a Decimal can carry.
+const MaxScale = 18
+
+var (
+	ErrInvalidDecimal = errors.New("invalid decimal")
+	ErrPrecisionLoss  = errors.New("decimal does not fit the requested scale without losing precision")
+	ErrOverflow       = errors.New("decimal overflow")
+)
+
+var pow10 = func() [MaxScale + 1]int64 {
+	var p [MaxScale + 1]int64
+	p[0] = 1
+	for i := 1; i <= MaxScale; i++ {
+		p[i] = p[i-1] * 10
+	}
+	return p
+}()
+
+// Decimal is a fixed-point decimal number stored as an integer count of
+// 10^-scale units, so 12.34 is stored as value 1234 with scale 2. Prices are
+// kept as a number of ticks and sizes as a number of lots of the market scale.
+//
+// The zero value is 0 with scale 0 and is ready to use. Two decimals holding
+// the same number with different scales are Equal but not ==, so values used
+// as map keys must be brought to the same scale first.
+type Decimal struct {
+	value int64
+	scale uint8
+}
+
+var Zero = Decimal{}
+
+// New returns value * 10^-scale.
+func New(value int64, scale uint8) Decimal {
+	if scale > MaxScale {
+		panic(fmt.Errorf("%w: scale %d is larger than %d", ErrOverflow, scale, MaxScale))
+	}
+	return Decimal{value: value, scale: scale}
+}
+
+func NewFromInt(i int64) Decimal {
+	return Decimal{value: i}
+}
+
+// NewFromString parses a plain decimal string such as "-12.340".
+func NewFromString(s string) (Decimal, error) {
+	str := s
+	neg := false
+	if strings.HasPrefix(str, "-") || strings.HasPrefix(str, "+") {
+		neg = str[0] == '-'
+		str = str[1:]
+	}
+
+	intPart, fracPart, hasDot := strings.Cut(str, ".")
+	if intPart == "" && fracPart == "" || hasDot && fracPart == "" {
+		return Zero, fmt.Errorf("%w: %q", ErrInvalidDecimal, s)
+	}
+	if len(fracPart) > MaxScale {
+		return Zero, fmt.Errorf("%w: %q has more than %d decimals", ErrPrecisionLoss, s, MaxScale)
+	}
+
+	digits := intPart + fracPart
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return Zero, fmt.Errorf("%w: %q", ErrInvalidDecimal, s)
+		}
+	}
+
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Zero, fmt.Errorf("%w: %q", ErrOverflow, s)
+	}
+	if neg {
+		value = -value
+	}
+
+	return Decimal{value: value, scale: uint8(len(fracPart))}, nil
+}
+
+// RequireFromString is like NewFromString but panics if s is not a valid
+// decimal. It is meant for constants and tests.
+func RequireFromString(s string) Decimal {
+	d, err := NewFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Value returns the unscaled integer value of d.
+func (d Decimal) Value() int64 {
+	return d.value
+}
+
+func (d Decimal) Scale() uint8 {
+	return d.scale
+}
+
+// Rescale returns d with exactly the given scale. It fails if d has more
+// significant decimals than scale allows or if the result overflows.
+func (d Decimal) Rescale(scale uint8) (Decimal, error) {
+	if scale > MaxScale {
+		return Zero, fmt.Errorf("%w: scale %d is larger than %d", ErrOverflow, scale, MaxScale)
+	}
+
+	if scale >= d.scale {
+		value, ok := mulPow10(d.value, scale-d.scale)
+		if !ok {
+			return Zero, fmt.Errorf("%w: %s at scale %d", ErrOverflow, d, scale)
+		}
+		return Decimal{value: value, scale: scale}, nil
+	}
+
+	p := pow10[d.scale-scale]
+	if d.value%p != 0 {
+		return Zero, fmt.Errorf("%w: %s at scale %d", ErrPrecisionLoss, d, scale)
+	}
+	return Decimal{value: d.value / p, scale: scale}, nil
+}
+
+// Truncate returns d with exactly the given scale, dropping any decimals that
+// do not fit. It panics if the result overflows.
+func (d Decimal) Truncate(scale uint8) Decimal {
+	if scale >= d.scale {
+		return d.mustRescale(scale)
+	}
+	return Decimal{value: d.value / pow10[d.scale-scale], scale: scale}
+}
+
+// Add returns d + d2. It panics if the result overflows, values that come
+// from outside go through CheckedAdd.
+func (d Decimal) Add(d2 Decimal) Decimal {
+	return must(d.CheckedAdd(d2))
+}
+
+func (d Decimal) Sub(d2 Decimal) Decimal {
+	return must(d.CheckedSub(d2))
+}
+
+// CheckedAdd returns d + d2, or ErrOverflow when it does not fit.
+func (d Decimal) CheckedAdd(d2 Decimal) (Decimal, error) {
+	a, b, err := checkedAlign(d, d2)
+	if err != nil {
+		return Zero, err
+	}
+	sum := a.value + b.value
+	if (sum > a.value) != (b.value > 0) {
+		return Zero, fmt.Errorf("%w: %s + %s", ErrOverflow, d, d2)
+	}
+	return Decimal{value: sum, scale: a.scale}, nil
+}
+
+// CheckedSub returns d - d2, or ErrOverflow when it does not fit.
+func (d Decimal) CheckedSub(d2 Decimal) (Decimal, error) {
+	if d2.value == math.MinInt64 {
+		return Zero, fmt.Errorf("%w: %s - %s", ErrOverflow, d, d2)
+	}
+	return d.CheckedAdd(Decimal{value: -d2.value, scale: d2.scale})
+}
+
+func (d Decimal) Neg() Decimal {
+	if d.value == math.MinInt64 {
+		panic(fmt.Errorf("%w: -%s", ErrOverflow, d))
+	}
+	return Decimal{value: -d.value, scale: d.scale}
+}
+
+func (d Decimal) Abs() Decimal {
+	if d.value < 0 {
+		return d.Neg()
+	}
+	return d
+}
+
+// Mul returns d * d2 exactly. Trailing zeros are dropped from the result, so
+// 1.50 * 2.00 is 3, which keeps notional values far from overflowing. It
+// panics if the result overflows, values that come from outside go through
+// CheckedMul.
+func (d Decimal) Mul(d2 Decimal) Decimal {
+	return must(d.CheckedMul(d2))
+}
+
+// CheckedMul returns d * d2 exactly, or ErrOverflow when it does not fit.
+func (d Decimal) CheckedMul(d2 Decimal) (Decimal, error) {
+	product := new(big.Int).Mul(big.NewInt(d.value), big.NewInt(d2.value))
+	return fromBig(product, int(d.scale)+int(d2.scale))
+}
+
+// CheckedMulTruncate returns d * d2 with exactly the given scale, dropping
+// any decimals that do not fit, or ErrOverflow when the result does not fit.
+// Unlike Mul followed by Truncate, decimals beyond the scale never overflow.
+func (d Decimal) CheckedMulTruncate(d2 Decimal, scale uint8) (Decimal, error) {
+	product := new(big.Int).Mul(big.NewInt(d.value), big.NewInt(d2.value))
+	if s := d.scale + d2.scale; s > scale {
+		product.Quo(product, bigPow10(s-scale))
+	} else {
+		product.Mul(product, bigPow10(scale-s))
+	}
+	if !product.IsInt64() {
+		return Zero, fmt.Errorf("%w: %s at scale %d", ErrOverflow, product, scale)
+	}
+	return Decimal{value: product.Int64(), scale: scale}, nil
+}
+
+// Div returns d / d2 truncated to the given scale. It panics if d2 is zero.
+func (d Decimal) Div(d2 Decimal, scale uint8) Decimal {
+	if d2.value == 0 {
+		panic("decimal division by zero")
+	}
+
+	// d.value * 10^(scale + d2.scale - d.scale) / d2.value
+	num := big.NewInt(d.value)
+	den := big.NewInt(d2.value)
+	shift := int(scale) + int(d2.scale) - int(d.scale)
+	if shift >= 0 {
+		num.Mul(num, bigPow10(uint8(shift)))
+	} else {
+		den.Mul(den, bigPow10(uint8(-shift)))
+	}
+
+	quo := new(big.Int).Quo(num, den)
+	if !quo.IsInt64() {
+		panic(fmt.Errorf("%w: %s / %s", ErrOverflow, d, d2))
+	}
+	return Decimal{value: quo.Int64(), scale: scale}
+}
+
+// Cmp returns -1, 0 or +1 depending on whether d is less than, equal to or
+// greater than d2.
+func (d Decimal) Cmp(d2 Decimal) int {
+	if d.scale == d2.scale {
+		return cmpInt(d.value, d2.value)
+	}
+
+	if d.scale < d2.scale {
+		if a, ok := mulPow10(d.value, d2.scale-d.scale); ok {
+			return cmpInt(a, d2.value)
+		}
+	} else if b, ok := mulPow10(d2.value, d.scale-d2.scale); ok {
+		return cmpInt(d.value, b)
+	}
+
+	// The smaller scale overflows when rescaled, fall back to big integers.
+	x := new(big.Int).Mul(big.NewInt(d.value), bigPow10(d2.scale))
+	y := new(big.Int).Mul(big.NewInt(d2.value), bigPow10(d.scale))
+	return x.Cmp(y)
+}
+
+func (d Decimal) Equal(d2 Decimal) bool              { return d.Cmp(d2) == 0 }
+func (d Decimal) LessThan(d2 Decimal) bool           { return d.Cmp(d2) < 0 }
+func (d Decimal) LessThanOrEqual(d2 Decimal) bool    { return d.Cmp(d2) <= 0 }
+func (d Decimal) GreaterThan(d2 Decimal) bool        { return d.Cmp(d2) > 0 }
+func (d Decimal) GreaterThanOrEqual(d2 Decimal) bool { return d.Cmp(d2) >= 0 }
+
+func (d Decimal) Sign() int {
+	return cmpInt(d.value, 0)
+}
+
+func (d Decimal) IsZero() bool     { return d.value == 0 }
+func (d Decimal) IsPositive() bool { return d.value > 0 }
+func (d Decimal) IsNegative() bool { return d.value < 0 }
+
+func Min(a, b Decimal) Decimal {
+	if a.LessThan(b) {
+		return a
+	}
+	return b
+}
+
+func Max(a, b Decimal) Decimal {
+	if a.GreaterThan(b) {
+		return a
+	}
+	return b
+}
+
+// IntPart returns the integer part of d, truncated towards zero.
+func (d Decimal) IntPart() int64 {
+	return d.value / pow10[d.scale]
+}
+
+// Float64 returns the closest float64 to d. It is only meant for display and
+// logging, never for arithmetic.
+func (d Decimal) Float64() float64 {
+	return float64(d.value) / float64(pow10[d.scale])
+}
+
+// BigInt returns d * 10^scale as an integer, for example an ether amount
+// converted to wei with a scale of 18. It fails if d has more decimals than
+// scale.
+func (d Decimal) BigInt(scale uint8) (*big.Int, error) {
+	if d.scale > scale {
+		r, err := d.Rescale(scale)
+		if err != nil {
+			return nil, err
+		}
+		return big.NewInt(r.value), nil
+	}
+
+	n := big.NewInt(d.value)
+	return n.Mul(n, bigPow10(scale-d.scale)), nil
+}
+
+func (d Decimal) String() string {
+	s := strconv.FormatInt(d.value, 10)
+	if d.scale == 0 {
+		return s
+	}
+
+	neg := d.value < 0
+	if neg {
+		s = s[1:]
+	}
+	if len(s) <= int(d.scale) {
+		s = strings.Repeat("0", int(d.scale)-len(s)+1) + s
+	}
+
+	point := len(s) - int(d.scale)
+	s = s[:point] + "." + s[point:]
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// MarshalJSON encodes d as a JSON string so that no precision is lost by
+// clients that decode numbers as floats.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + d.String() + `"`), nil
+}
+
+// UnmarshalJSON accepts both JSON strings and JSON numbers.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	dec, err := NewFromString(s)
+	if err != nil {
+		return err
+	}
+	*d = dec
+	return nil
+}
+
+func (d Decimal) mustRescale(scale uint8) Decimal {
+	r, err := d.Rescale(scale)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func must(d Decimal, err error) Decimal {
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// checkedAlign returns a and b rescaled to the larger of both scales.
+func checkedAlign(a, b Decimal) (Decimal, Decimal, error) {
+	var err error
+	switch {
+	case a.scale < b.scale:
+		a, err = a.Rescale(b.scale)
+	case a.scale > b.scale:
+		b, err = b.Rescale(a.scale)
+	}
+	return a, b, err
+}
+
+// fromBig returns n * 10^-scale without trailing zeros. It fails if the
+// result does not fit without losing precision.
+func fromBig(n *big.Int, scale int) (Decimal, error) {
+	ten := big.NewInt(10)
+	for scale > 0 {
+		q, r := new(big.Int).QuoRem(n, ten, new(big.Int))
+		if r.Sign() != 0 {
+			break
+		}
+		n = q
+		scale--
+	}
+
+	if scale > MaxScale || !n.IsInt64() {
+		return Zero, fmt.Errorf("%w: %s at scale %d", ErrOverflow, n, scale)
+	}
+	return Decimal{value: n.Int64(), scale: uint8(scale)}, nil
+}
+
+func bigPow10(n uint8) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func mulPow10(v int64, n uint8) (int64, bool) {
+	if n == 0 || v == 0 {
+		return v, true
+	}
+	if n > MaxScale {
+		return 0, false
+	}
+	p := pow10[n]
+	r := v * p
+	if r/p != v {
+		return 0, false
+	}
+	return r, true
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,165 @@
+package decimal
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestNewFromString(t *testing.T) {
+	tests := []struct {
+		in    string
+		value int64
+		scale uint8
+		err   error
+	}{
+		{"0", 0, 0, nil},
+		{"12.34", 1234, 2, nil},
+		{"-0.001", -1, 3, nil},
+		{"+7.", 0, 0, ErrInvalidDecimal},
+		{".5", 5, 1, nil},
+		{"1e5", 0, 0, ErrInvalidDecimal},
+		{"NaN", 0, 0, ErrInvalidDecimal},
+		{"", 0, 0, ErrInvalidDecimal},
+		{"99999999999999999999", 0, 0, ErrOverflow},
+		{"0.0000000000000000001", 0, 0, ErrPrecisionLoss},
+	}
+
+	for _, tt := range tests {
+		d, err := NewFromString(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%q: err = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && (d.Value() != tt.value || d.Scale() != tt.scale) {
+			t.Errorf("%q: got %d@%d, want %d@%d", tt.in, d.Value(), d.Scale(), tt.value, tt.scale)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := map[Decimal]string{
+		New(1234, 2):  "12.34",
+		New(-5, 3):    "-0.005",
+		New(100, 0):   "100",
+		New(0, 2):     "0.00",
+		New(-1200, 2): "-12.00",
+	}
+
+	for d, want := range tests {
+		if d.String() != want {
+			t.Errorf("got %s, want %s", d, want)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a := RequireFromString("0.1")
+	b := RequireFromString("0.2")
+
+	if !a.Add(b).Equal(RequireFromString("0.3")) {
+		t.Errorf("0.1 + 0.2 = %s", a.Add(b))
+	}
+	if !a.Sub(b).Equal(RequireFromString("-0.1")) {
+		t.Errorf("0.1 - 0.2 = %s", a.Sub(b))
+	}
+	if got := RequireFromString("10000.25").Mul(RequireFromString("1.5")); got.String() != "15000.375" {
+		t.Errorf("mul = %s", got)
+	}
+	if got := RequireFromString("10").Div(RequireFromString("3"), 4); got.String() != "3.3333" {
+		t.Errorf("div = %s", got)
+	}
+	if RequireFromString("1.50").Cmp(RequireFromString("1.5")) != 0 {
+		t.Errorf("1.50 != 1.5")
+	}
+	if !RequireFromString("2").GreaterThan(RequireFromString("1.99999999")) {
+		t.Errorf("2 <= 1.99999999")
+	}
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	price := RequireFromString("900000000.01")
+	size := RequireFromString("2.00000002")
+
+	if _, err := price.CheckedMul(size); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected %s * %s to overflow, got %v", price, size, err)
+	}
+	if _, err := New(math.MaxInt64, 0).CheckedAdd(NewFromInt(1)); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected max + 1 to overflow, got %v", err)
+	}
+	if _, err := New(math.MaxInt64, 0).CheckedAdd(New(1, 1)); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected max + 0.1 to overflow when aligned, got %v", err)
+	}
+	if _, err := New(math.MinInt64, 0).CheckedSub(NewFromInt(1)); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected min - 1 to overflow, got %v", err)
+	}
+	if got, err := price.CheckedMul(NewFromInt(2)); err != nil || got.String() != "1800000000.02" {
+		t.Errorf("expected 1800000000.02, got %s, %v", got, err)
+	}
+	if got, err := price.CheckedSub(price); err != nil || !got.IsZero() {
+		t.Errorf("expected 0, got %s, %v", got, err)
+	}
+
+	// A fee of 0.15% on a notional near the maximum only overflows before
+	// it is truncated.
+	notional := New(math.MaxInt64/2, 10)
+	rate := RequireFromString("0.0015")
+	if _, err := notional.CheckedMul(rate); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected %s * %s to overflow, got %v", notional, rate, err)
+	}
+	if got, err := notional.CheckedMulTruncate(rate, 10); err != nil || got.String() != "691752.9027641081" {
+		t.Errorf("expected 691752.9027641081, got %s, %v", got, err)
+	}
+	if got, err := RequireFromString("1.5").CheckedMulTruncate(NewFromInt(2), 2); err != nil || got.String() != "3.00" {
+		t.Errorf("expected 3.00, got %s, %v", got, err)
+	}
+	if _, err := notional.CheckedMulTruncate(NewFromInt(3), 10); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected %s * 3 to overflow, got %v", notional, err)
+	}
+}
+
+func TestRescale(t *testing.T) {
+	d, err := RequireFromString("1.5").Rescale(8)
+	if err != nil || d.Value() != 150_000_000 {
+		t.Errorf("got %v, %v", d, err)
+	}
+
+	if _, err := RequireFromString("1.505").Rescale(2); !errors.Is(err, ErrPrecisionLoss) {
+		t.Errorf("err = %v", err)
+	}
+
+	if got := RequireFromString("1.505").Truncate(2); got.String() != "1.50" {
+		t.Errorf("truncate = %s", got)
+	}
+}
+
+func TestBigInt(t *testing.T) {
+	wei, err := RequireFromString("1.5").BigInt(18)
+	if err != nil || wei.String() != "1500000000000000000" {
+		t.Errorf("got %v, %v", wei, err)
+	}
+
+	if _, err := RequireFromString("0.001").BigInt(2); !errors.Is(err, ErrPrecisionLoss) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type payload struct {
+		Price Decimal
+	}
+
+	b, err := json.Marshal(payload{Price: RequireFromString("10000.10")})
+	if err != nil || string(b) != `{"Price":"10000.10"}` {
+		t.Errorf("got %s, %v", b, err)
+	}
+
+	var p payload
+	if err := json.Unmarshal([]byte(`{"Price":12.5}`), &p); err != nil || p.Price.String() != "12.5" {
+		t.Errorf("got %s, %v", p.Price, err)
+	}
+	if err := json.Unmarshal([]byte(`{"Price":"abc"}`), &p); err == nil {
+		t.Errorf("expected an error")
+	}
+}
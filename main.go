@@ -1,12 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
-	"math"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+
 	"github.com/jeffersonsong/crypto-exchange/client"
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
 	"github.com/jeffersonsong/crypto-exchange/server"
 )
 
@@ -18,41 +22,41 @@ var (
 	tick = 2 * time.Second
 )
 
-func marketOrderPlacer(c *client.Client) {
+func marketOrderPlacer(c *client.Client, market server.Market) {
 	ticker := time.NewTicker(5 * time.Second)
 
 	for {
 		otherMarketSellOrder := &client.PlaceOrderParams{
 			UserID: 8,
 			Bid:    false,
-			Size:   5000,
+			Size:   decimal.NewFromInt(5000),
 		}
 
-		orderResp, err := c.PlaceMarketOrder(otherMarketSellOrder)
+		_, err := c.PlaceMarketOrder(market, otherMarketSellOrder)
 		if err != nil {
-			log.Println(orderResp.OrderID)
+			log.Println(err)
 		}
 
 		marketSellOrder := &client.PlaceOrderParams{
 			UserID: 666,
 			Bid:    false,
-			Size:   3000,
+			Size:   decimal.NewFromInt(3000),
 		}
 
-		orderResp, err = c.PlaceMarketOrder(marketSellOrder)
+		_, err = c.PlaceMarketOrder(market, marketSellOrder)
 		if err != nil {
-			log.Println(orderResp.OrderID)
+			log.Println(err)
 		}
 
 		marketBuyOrder := &client.PlaceOrderParams{
 			UserID: 666,
 			Bid:    true,
-			Size:   1000,
+			Size:   decimal.NewFromInt(1000),
 		}
 
-		orderResp, err = c.PlaceMarketOrder(marketBuyOrder)
+		_, err = c.PlaceMarketOrder(market, marketBuyOrder)
 		if err != nil {
-			log.Println(orderResp.OrderID)
+			log.Println(err)
 		}
 
 		<-ticker.C
@@ -61,39 +65,41 @@ func marketOrderPlacer(c *client.Client) {
 
 const userID = 7
 
-func makeMarketSimple(c *client.Client) {
+func makeMarketSimple(c *client.Client, market server.Market) {
 	ticker := time.NewTicker(tick)
 
 	for {
-		orders, err := c.GetOrders(userID)
+		orders, err := c.GetOrders(market, userID)
 		if err != nil {
 			log.Println(err)
 		}
 
-		bestAsk, err := c.GetBestAsk()
+		bestAsk, err := c.GetBestAsk(market)
 		if err != nil {
 			log.Println(err)
 		}
-		bestBid, err := c.GetBestBid()
+		bestBid, err := c.GetBestBid(market)
 		if err != nil {
 			log.Println(err)
 		}
 
-		spread := math.Abs(bestAsk - bestBid)
-		fmt.Printf("best bid: %.2f, ask: %.2f, spread: %.2f\n", bestBid, bestAsk, spread)
+		spread := bestAsk.Sub(bestBid).Abs()
+		fmt.Printf("best bid: %s, ask: %s, spread: %s\n", bestBid, bestAsk, spread)
 
 		// place the bid
 		if len(orders.Bids) < maxOrders {
 			bidLimit := &client.PlaceOrderParams{
 				UserID: userID,
 				Bid:    true,
-				Price:  bestBid + 100,
-				Size:   1000,
+				Price:  bestBid.Add(decimal.NewFromInt(100)),
+				Size:   decimal.NewFromInt(1000),
+				// only ever add liquidity
+				PostOnly: orderbook.PostOnlySlide,
 			}
 
-			bidOrderResp, err := c.PlaceLimitOrder(bidLimit)
+			_, err := c.PlaceLimitOrder(market, bidLimit)
 			if err != nil {
-				log.Println(bidOrderResp.OrderID)
+				log.Println(err)
 			}
 		}
 
@@ -102,13 +108,15 @@ func makeMarketSimple(c *client.Client) {
 			askLimit := &client.PlaceOrderParams{
 				UserID: userID,
 				Bid:    false,
-				Price:  bestAsk - 100,
-				Size:   1000,
+				Price:  bestAsk.Sub(decimal.NewFromInt(100)),
+				Size:   decimal.NewFromInt(1000),
+				// only ever add liquidity
+				PostOnly: orderbook.PostOnlySlide,
 			}
 
-			askOrderResp, err := c.PlaceLimitOrder(askLimit)
+			_, err := c.PlaceLimitOrder(market, askLimit)
 			if err != nil {
-				log.Println(askOrderResp.OrderID)
+				log.Println(err)
 			}
 		}
 
@@ -116,27 +124,27 @@ func makeMarketSimple(c *client.Client) {
 	}
 }
 
-func seedMarket(c *client.Client) error {
+func seedMarket(c *client.Client, market server.Market) error {
 	ask := &client.PlaceOrderParams{
 		UserID: 8,
 		Bid:    false,
-		Price:  10_000.0,
-		Size:   10_000.0,
+		Price:  decimal.NewFromInt(10_000),
+		Size:   decimal.NewFromInt(10_000),
 	}
 
 	bid := &client.PlaceOrderParams{
 		UserID: 8,
 		Bid:    true,
-		Price:  9_000.0,
-		Size:   10_000.0,
+		Price:  decimal.NewFromInt(9_000),
+		Size:   decimal.NewFromInt(10_000),
 	}
 
-	_, err := c.PlaceLimitOrder(ask)
+	_, err := c.PlaceLimitOrder(market, ask)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.PlaceLimitOrder(bid)
+	_, err = c.PlaceLimitOrder(market, bid)
 	if err != nil {
 		return err
 	}
@@ -146,21 +154,35 @@ func seedMarket(c *client.Client) error {
 
 // TODO - Migrate to Python
 func main() {
-	go server.StartServer()
+	cfg := server.DefaultConfig()
+	flag.StringVar((*string)(&cfg.Settler), "settler", string(cfg.Settler), "settle on the ETH node, a SIMULATED chain or in MEMORY")
+	flag.StringVar(&cfg.RPCURL, "rpc", cfg.RPCURL, "node the ETH settler connects to")
+	flag.Uint64Var(&cfg.Confirmations, "confirmations", cfg.Confirmations, "blocks a transfer on chain needs to be final")
+	usdToken := flag.String("usd-token", "", "ERC-20 contract of USD on the ETH node")
+	flag.BoolVar(&cfg.TestDeposits, "test-deposits", cfg.TestDeposits, "let POST /deposit credit users without a transfer, for testing")
+	flag.Parse()
+
+	if *usdToken != "" {
+		usd := cfg.Assets[server.AssetUSD]
+		usd.Token = common.HexToAddress(*usdToken)
+		cfg.Assets[server.AssetUSD] = usd
+	}
+
+	go server.StartServer(cfg)
 
 	time.Sleep(1 * time.Second)
 
 	c := client.NewClient()
 
-	if err := seedMarket(c); err != nil {
+	if err := seedMarket(c, server.MarketETH); err != nil {
 		panic(err)
 	}
 
-	go makeMarketSimple(c)
+	go makeMarketSimple(c, server.MarketETH)
 
 	time.Sleep(1 * time.Second)
 
-	marketOrderPlacer(c)
+	marketOrderPlacer(c, server.MarketETH)
 
 	select {}
 }
@@ -0,0 +1,62 @@
+package orderbook
+
+import "container/heap"
+
+// expiryQueue is a min-heap of the GoodTilDate orders in the book ordered by
+// expiry. Every order knows its position in it, so orders that leave the book
+// early are removed right away.
+type expiryQueue []*Order
+
+func (q expiryQueue) Len() int { return len(q) }
+func (q expiryQueue) Less(i, j int) bool {
+	if q[i].ExpiresAt == q[j].ExpiresAt {
+		return q[i].Timestamp < q[j].Timestamp
+	}
+	return q[i].ExpiresAt < q[j].ExpiresAt
+}
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].expiryIndex, q[j].expiryIndex = i+1, j+1
+}
+
+func (q *expiryQueue) Push(x any) {
+	o := x.(*Order)
+	*q = append(*q, o)
+	o.expiryIndex = len(*q)
+}
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	o := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	o.expiryIndex = 0
+	return o
+}
+
+func (q *expiryQueue) push(o *Order) {
+	heap.Push(q, o)
+}
+
+// remove takes the order out of the queue, if it is in it.
+func (q *expiryQueue) remove(o *Order) {
+	if o.expiryIndex > 0 {
+		heap.Remove(q, o.expiryIndex-1)
+	}
+}
+
+// popExpired removes and returns the orders that expire at or before now, the
+// earliest first.
+func (q *expiryQueue) popExpired(now int64) []*Order {
+	var orders []*Order
+	for q.Len() > 0 && (*q)[0].ExpiresAt <= now {
+		orders = append(orders, heap.Pop(q).(*Order))
+	}
+	return orders
+}
+
+// due reports whether the earliest order in the queue expires at or before
+// now.
+func (q expiryQueue) due(now int64) bool {
+	return q.Len() > 0 && q[0].ExpiresAt <= now
+}
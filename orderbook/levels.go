@@ -0,0 +1,138 @@
+package orderbook
+
+import (
+	"math/rand"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+const maxLevelHeight = 32
+
+// priceLevels keeps the limits of one side of the book ordered from the best
+// to the worst price in a skip list. Insert and Remove are O(log n), Best is
+// O(1) and Each walks the limits in price order without sorting.
+type priceLevels struct {
+	head   *levelNode
+	height int
+	length int
+
+	// before reports whether a limit at price a comes before one at price b.
+	before func(a, b decimal.Decimal) bool
+	rnd    *rand.Rand
+}
+
+type levelNode struct {
+	limit *Limit
+	next  []*levelNode
+}
+
+func newAskLevels() *priceLevels {
+	return newPriceLevels(func(a, b decimal.Decimal) bool { return a.LessThan(b) })
+}
+
+func newBidLevels() *priceLevels {
+	return newPriceLevels(func(a, b decimal.Decimal) bool { return a.GreaterThan(b) })
+}
+
+func newPriceLevels(before func(a, b decimal.Decimal) bool) *priceLevels {
+	return &priceLevels{
+		head:   &levelNode{next: make([]*levelNode, maxLevelHeight)},
+		height: 1,
+		before: before,
+		rnd:    rand.New(rand.NewSource(1)),
+	}
+}
+
+func (pl *priceLevels) Len() int {
+	return pl.length
+}
+
+// Best returns the limit with the best price or nil if there is none.
+func (pl *priceLevels) Best() *Limit {
+	if first := pl.head.next[0]; first != nil {
+		return first.limit
+	}
+	return nil
+}
+
+// Insert adds the limit at its price. The caller makes sure there is no other
+// limit at the same price.
+func (pl *priceLevels) Insert(l *Limit) {
+	var update [maxLevelHeight]*levelNode
+	node := pl.head
+	for i := pl.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && pl.before(node.next[i].limit.Price, l.Price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	height := pl.randomHeight()
+	if height > pl.height {
+		for i := pl.height; i < height; i++ {
+			update[i] = pl.head
+		}
+		pl.height = height
+	}
+
+	newNode := &levelNode{limit: l, next: make([]*levelNode, height)}
+	for i := 0; i < height; i++ {
+		newNode.next[i] = update[i].next[i]
+		update[i].next[i] = newNode
+	}
+	pl.length++
+}
+
+// Remove deletes the limit and reports whether it was found.
+func (pl *priceLevels) Remove(l *Limit) bool {
+	var update [maxLevelHeight]*levelNode
+	node := pl.head
+	for i := pl.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && pl.before(node.next[i].limit.Price, l.Price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	target := node.next[0]
+	if target == nil || target.limit != l {
+		return false
+	}
+
+	for i := 0; i < len(target.next); i++ {
+		update[i].next[i] = target.next[i]
+	}
+	for pl.height > 1 && pl.head.next[pl.height-1] == nil {
+		pl.height--
+	}
+	pl.length--
+	return true
+}
+
+// Each calls fn for every limit from the best to the worst price until fn
+// returns false. fn must not insert or remove limits.
+func (pl *priceLevels) Each(fn func(l *Limit) bool) {
+	for node := pl.head.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.limit) {
+			return
+		}
+	}
+}
+
+// Slice returns the limits from the best to the worst price.
+func (pl *priceLevels) Slice() []*Limit {
+	limits := make([]*Limit, 0, pl.length)
+	pl.Each(func(l *Limit) bool {
+		limits = append(limits, l)
+		return true
+	})
+	return limits
+}
+
+func (pl *priceLevels) randomHeight() int {
+	height := 1
+	for height < maxLevelHeight && pl.rnd.Intn(4) == 0 {
+		height++
+	}
+	return height
+}
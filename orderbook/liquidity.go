@@ -0,0 +1,120 @@
+package orderbook
+
+import (
+	"fmt"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+// LiquidityPolicy tells what a market order does when the book cannot fill it
+// completely.
+type LiquidityPolicy string
+
+const (
+	// RejectOnInsufficientLiquidity drops the whole order without filling
+	// anything.
+	RejectOnInsufficientLiquidity LiquidityPolicy = "REJECT"
+	// PartialFill fills whatever volume there is and cancels the rest.
+	PartialFill LiquidityPolicy = "PARTIAL_FILL"
+	// SlippageLimit fills as long as prices stay within MaxSlippage of the
+	// best price and cancels the rest.
+	SlippageLimit LiquidityPolicy = "SLIPPAGE_LIMIT"
+)
+
+// InsufficientLiquidityError is returned for market orders that could not be
+// filled completely. Filled and AvgPrice describe what was filled before the
+// rest of the order was cancelled.
+type InsufficientLiquidityError struct {
+	OrderID   int64
+	Bid       bool
+	Policy    LiquidityPolicy
+	Requested decimal.Decimal
+	Available decimal.Decimal
+	Filled    decimal.Decimal
+	AvgPrice  decimal.Decimal
+}
+
+func (e *InsufficientLiquidityError) Error() string {
+	side := "bid"
+	if e.Bid {
+		side = "ask"
+	}
+	return fmt.Sprintf("not enough %s volume [size: %s] for market order [size: %s], filled [size: %s]", side, e.Available, e.Requested, e.Filled)
+}
+
+// MarketBuyCost is the most filling the bid at market can cost with the book
+// as it is. Orders of the same user are skipped when the bid prevents self
+// trades, since it would go deeper into the book instead. It fails when the
+// cost overflows.
+func (ob *Orderbook) MarketBuyCost(o *Order) (decimal.Decimal, error) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.marketBuyCost(o)
+}
+
+func (ob *Orderbook) marketBuyCost(o *Order) (decimal.Decimal, error) {
+	var (
+		cost      = decimal.Zero
+		remaining = o.Size
+		err       error
+	)
+	ob.asks.Each(func(l *Limit) bool {
+		for _, resting := range l.Orders {
+			if !remaining.IsPositive() {
+				return false
+			}
+			if o.SelfTradePrevention != "" && resting.UserID == o.UserID {
+				continue
+			}
+			size := decimal.Min(remaining, resting.Size)
+			notional, mulErr := l.Price.CheckedMul(size)
+			if mulErr != nil {
+				err = mulErr
+				return false
+			}
+			if cost, err = cost.CheckedAdd(notional); err != nil {
+				return false
+			}
+			remaining = remaining.Sub(size)
+		}
+		return true
+	})
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return cost, nil
+}
+
+// FillSummary returns the total size of the matches and their volume weighted
+// average price truncated to the given scale.
+func FillSummary(matches []Match, priceScale uint8) (filled, avgPrice decimal.Decimal) {
+	notional := decimal.Zero
+	for _, match := range matches {
+		filled = filled.Add(match.SizeFilled)
+		notional = notional.Add(match.Price.Mul(match.SizeFilled))
+	}
+
+	if filled.IsZero() {
+		return filled, decimal.New(0, priceScale)
+	}
+	return filled, notional.Div(filled, priceScale)
+}
+
+// slippageLimit returns the worst price a market order may reach under the
+// SlippageLimit policy, relative to the best price on the opposite side.
+func (ob *Orderbook) slippageLimit(o *Order) (decimal.Decimal, bool) {
+	best := ob.bids.Best()
+	if o.Bid {
+		best = ob.asks.Best()
+	}
+	if best == nil {
+		return decimal.Zero, false
+	}
+
+	one := decimal.NewFromInt(1)
+	if o.Bid {
+		return best.Price.Mul(one.Add(ob.MaxSlippage)).Truncate(ob.PriceScale), true
+	}
+	return best.Price.Mul(one.Sub(ob.MaxSlippage)).Truncate(ob.PriceScale), true
+}
@@ -1,33 +1,149 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
-	"math"
-	"math/rand"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
 )
 
+// Match is a fill between a resting order, the maker, and the incoming order
+// that took its liquidity, the taker. TakerBid tells whether the taker is the
+// bid.
 type Match struct {
 	Ask        *Order
 	Bid        *Order
-	SizeFilled float64
-	Price      float64
+	SizeFilled decimal.Decimal
+	Price      decimal.Decimal
+	TakerBid   bool
+}
+
+// Maker returns the order that rested in the book.
+func (m Match) Maker() *Order {
+	if m.TakerBid {
+		return m.Ask
+	}
+	return m.Bid
+}
+
+// Taker returns the order that took the liquidity of the maker.
+func (m Match) Taker() *Order {
+	if m.TakerBid {
+		return m.Bid
+	}
+	return m.Ask
+}
+
+// TimeInForce tells how long an order stays active. The zero value behaves
+// like GoodTilCancelled.
+type TimeInForce string
+
+const (
+	// GoodTilCancelled orders rest in the book until they are filled or
+	// cancelled.
+	GoodTilCancelled TimeInForce = "GTC"
+	// ImmediateOrCancel orders fill what they can right away and drop the
+	// rest instead of resting in the book.
+	ImmediateOrCancel TimeInForce = "IOC"
+	// FillOrKill orders are either filled completely right away or dropped
+	// without touching the book.
+	FillOrKill TimeInForce = "FOK"
+	// GoodTilDate orders rest in the book until Order.ExpiresAt.
+	GoodTilDate TimeInForce = "GTD"
+)
+
+// PostOnly tells what happens to an order that must only add liquidity when
+// it would cross the book. The zero value means the order is not post-only.
+type PostOnly string
+
+const (
+	// PostOnlyReject rejects the order.
+	PostOnlyReject PostOnly = "REJECT"
+	// PostOnlySlide reprices the order one tick away from the best price on
+	// the other side.
+	PostOnlySlide PostOnly = "SLIDE"
+)
+
+var (
+	ErrPostOnlyWouldCross = errors.New("post-only order would cross the book")
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrInvalidSize        = errors.New("size must be positive")
+)
+
+// SelfTradePrevention is what happens when an incoming order would match a
+// resting order of the same user.
+type SelfTradePrevention string
+
+const (
+	// CancelNewest cancels the incoming order.
+	CancelNewest SelfTradePrevention = "CANCEL_NEWEST"
+	// CancelOldest cancels the resting order.
+	CancelOldest SelfTradePrevention = "CANCEL_OLDEST"
+	// CancelBoth cancels both orders.
+	CancelBoth SelfTradePrevention = "CANCEL_BOTH"
+	// DecrementAndCancel reduces both orders by the smaller of their sizes,
+	// which cancels the smaller one.
+	DecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL"
+)
+
+// SelfTrade is a match between two orders of the same user that was
+// prevented. MakerSize and TakerSize are the sizes that were cancelled from
+// the resting and the incoming order.
+type SelfTrade struct {
+	Maker     *Order
+	Taker     *Order
+	Mode      SelfTradePrevention
+	MakerSize decimal.Decimal
+	TakerSize decimal.Decimal
 }
 
 type Order struct {
-	ID        int64
-	UserID    int64
-	Size      float64
-	Bid       bool
-	Limit     *Limit
-	Timestamp int64
+	ID          int64
+	UserID      int64
+	Size        decimal.Decimal
+	Bid         bool
+	Limit       *Limit
+	Timestamp   int64
+	TimeInForce TimeInForce
+	// ExpiresAt is the unix time in nanoseconds at which a GoodTilDate order
+	// is removed from the book.
+	ExpiresAt int64
+	PostOnly  PostOnly
+	// ReduceOnly orders may only reduce the position of the user. The book
+	// itself does not know about positions, the exchange enforces it.
+	ReduceOnly bool
+	// DisplaySize makes a limit order an iceberg order that only shows
+	// that much of its size at a time. Hidden is the reserve that is not
+	// displayed, Size always includes it.
+	DisplaySize decimal.Decimal
+	Hidden      decimal.Decimal
+	// SelfTradePrevention tells what happens when the order would match an
+	// order of the same user. The zero value allows self trades.
+	SelfTradePrevention SelfTradePrevention
+	// ClientOrderID is an optional ID the user chose for the order.
+	ClientOrderID string
+
+	// expiryIndex is one more than the position of the order in the expiry
+	// queue of the book, 0 when it is not in it.
+	expiryIndex int
 }
 
-func NewOrder(bid bool, size float64, userID int64) *Order {
+// lastOrderID is the last ID handed out by NewOrderID.
+var lastOrderID atomic.Int64
+
+// NewOrderID returns the next ID of a sequence shared by the whole process, so
+// IDs never collide within it. Callers that must keep IDs unique across
+// restarts, like the exchange, assign their own.
+func NewOrderID() int64 {
+	return lastOrderID.Add(1)
+}
+
+func NewOrder(bid bool, size decimal.Decimal, userID int64) *Order {
 	return &Order{
-		ID:        int64(rand.Intn(1000000)),
+		ID:        NewOrderID(),
 		UserID:    userID,
 		Size:      size,
 		Bid:       bid,
@@ -36,32 +152,32 @@ func NewOrder(bid bool, size float64, userID int64) *Order {
 }
 
 func (o *Order) String() string {
-	return fmt.Sprintf("[size: %.2f]", o.Size)
+	return fmt.Sprintf("[size: %s]", o.Size)
 }
 
 func (o *Order) IsFilled() bool {
-	return o.Size == 0.0
+	return o.Size.IsZero()
 }
 
-type Limit struct {
-	Price       float64
-	Orders      []*Order
-	TotalVolume float64
+func (o *Order) IsIceberg() bool {
+	return o.DisplaySize.IsPositive()
 }
 
-type ByBestAsk []*Limit
-
-func (a ByBestAsk) Len() int           { return len(a) }
-func (a ByBestAsk) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByBestAsk) Less(i, j int) bool { return a[i].Price < a[j].Price }
-
-type ByBestBid []*Limit
+// VisibleSize returns the part of the size that is displayed in the book.
+func (o *Order) VisibleSize() decimal.Decimal {
+	return o.Size.Sub(o.Hidden)
+}
 
-func (b ByBestBid) Len() int           { return len(b) }
-func (b ByBestBid) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b ByBestBid) Less(i, j int) bool { return b[i].Price > b[j].Price }
+type Limit struct {
+	Price  decimal.Decimal
+	Orders []*Order
+	// TotalVolume includes the hidden reserve of iceberg orders,
+	// VisibleVolume only what is displayed.
+	TotalVolume   decimal.Decimal
+	VisibleVolume decimal.Decimal
+}
 
-func NewLimit(price float64) *Limit {
+func NewLimit(price decimal.Decimal) *Limit {
 	return &Limit{
 		Price:  price,
 		Orders: []*Order{},
@@ -69,13 +185,19 @@ func NewLimit(price float64) *Limit {
 }
 
 func (l *Limit) String() string {
-	return fmt.Sprintf("[price = %.2f, volume = %.2f]", l.Price, l.TotalVolume)
+	return fmt.Sprintf("[price = %s, volume = %s]", l.Price, l.TotalVolume)
 }
 
 func (l *Limit) AddOrder(o *Order) {
 	o.Limit = l
+	o.Hidden = decimal.Zero
+	if o.IsIceberg() && o.Size.GreaterThan(o.DisplaySize) {
+		o.Hidden = o.Size.Sub(o.DisplaySize)
+	}
+
 	l.Orders = append(l.Orders, o)
-	l.TotalVolume += o.Size
+	l.TotalVolume = l.TotalVolume.Add(o.Size)
+	l.VisibleVolume = l.VisibleVolume.Add(o.VisibleSize())
 }
 
 func (l *Limit) DeleteOrder(o *Order) {
@@ -87,42 +209,113 @@ func (l *Limit) DeleteOrder(o *Order) {
 	}
 
 	o.Limit = nil
-	l.TotalVolume -= o.Size
+	l.TotalVolume = l.TotalVolume.Sub(o.Size)
+	l.VisibleVolume = l.VisibleVolume.Sub(o.VisibleSize())
 }
 
-func (l *Limit) Fill(o *Order) []Match {
+// ReduceOrder lowers the size of a resting order to size without changing its
+// place in the queue. The hidden reserve of iceberg orders is reduced first.
+func (l *Limit) ReduceOrder(o *Order, size decimal.Decimal) {
+	visible := o.VisibleSize()
+	reduction := o.Size.Sub(size)
+
+	o.Hidden = decimal.Max(o.Hidden.Sub(reduction), decimal.Zero)
+	o.Size = size
+
+	l.TotalVolume = l.TotalVolume.Sub(reduction)
+	l.VisibleVolume = l.VisibleVolume.Sub(visible).Add(o.VisibleSize())
+}
+
+// Fill matches the order against the orders of the limit in time priority.
+// An iceberg order whose displayed slice is used up refreshes it from its
+// hidden reserve and moves to the back of the queue, where it can be matched
+// again by the same order.
+//
+// When the order meets an order of the same user and has a
+// SelfTradePrevention mode, no match is made and the prevented trade is
+// returned instead.
+func (l *Limit) Fill(o *Order) ([]Match, []SelfTrade) {
 	var (
-		matches        []Match
-		ordersToDelete []*Order
+		matches    []Match
+		selfTrades []SelfTrade
 	)
 
-	for _, order := range l.Orders {
+	for len(l.Orders) > 0 && !o.IsFilled() {
+		order := l.Orders[0]
+
+		if order.UserID == o.UserID && o.SelfTradePrevention != "" {
+			selfTrades = append(selfTrades, l.preventSelfTrade(order, o))
+			continue
+		}
+
 		match := l.fillOrder(order, o)
 		matches = append(matches, match)
 
-		l.TotalVolume -= match.SizeFilled
+		l.TotalVolume = l.TotalVolume.Sub(match.SizeFilled)
+		l.VisibleVolume = l.VisibleVolume.Sub(match.SizeFilled)
 
-		if order.IsFilled() {
-			ordersToDelete = append(ordersToDelete, order)
+		switch {
+		case order.IsFilled():
+			l.DeleteOrder(order)
+		case order.VisibleSize().IsZero():
+			order.Hidden = decimal.Max(order.Hidden.Sub(order.DisplaySize), decimal.Zero)
+			l.VisibleVolume = l.VisibleVolume.Add(order.VisibleSize())
+			l.Orders = append(DeleteKeepOrder(l.Orders, 0), order)
 		}
+	}
 
-		if o.IsFilled() {
-			break
-		}
+	return matches, selfTrades
+}
+
+// preventSelfTrade applies the SelfTradePrevention mode of the incoming order
+// to itself and the resting order it would have matched. Cancelling the
+// incoming order sets its size to zero, so it neither matches nor rests.
+func (l *Limit) preventSelfTrade(resting, incoming *Order) SelfTrade {
+	st := SelfTrade{
+		Maker: resting,
+		Taker: incoming,
+		Mode:  incoming.SelfTradePrevention,
 	}
 
-	for _, order := range ordersToDelete {
-		l.DeleteOrder(order)
+	cancelMaker := func() {
+		st.MakerSize = resting.Size
+		l.DeleteOrder(resting)
+	}
+	cancelTaker := func() {
+		st.TakerSize = incoming.Size
+		incoming.Size = decimal.New(0, incoming.Size.Scale())
 	}
 
-	return matches
+	switch incoming.SelfTradePrevention {
+	case CancelOldest:
+		cancelMaker()
+	case CancelBoth:
+		cancelMaker()
+		cancelTaker()
+	case DecrementAndCancel:
+		size := decimal.Min(resting.Size, incoming.Size)
+		if size.Equal(resting.Size) {
+			cancelMaker()
+		} else {
+			st.MakerSize = size
+			l.ReduceOrder(resting, resting.Size.Sub(size))
+		}
+		st.TakerSize = size
+		incoming.Size = incoming.Size.Sub(size)
+	default:
+		cancelTaker()
+	}
+
+	return st
 }
 
+// fillOrder matches the resting order a against the incoming order b for as
+// much as a displays.
 func (l *Limit) fillOrder(a, b *Order) Match {
 	var (
 		bid        *Order
 		ask        *Order
-		sizeFilled float64
+		sizeFilled decimal.Decimal
 	)
 
 	if a.Bid {
@@ -131,83 +324,393 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 		bid, ask = b, a
 	}
 
-	sizeFilled = math.Min(a.Size, b.Size)
-	a.Size -= sizeFilled
-	b.Size -= sizeFilled
+	sizeFilled = decimal.Min(a.VisibleSize(), b.Size)
+	a.Size = a.Size.Sub(sizeFilled)
+	b.Size = b.Size.Sub(sizeFilled)
 
 	return Match{
 		Bid:        bid,
 		Ask:        ask,
 		SizeFilled: sizeFilled,
 		Price:      l.Price,
+		TakerBid:   b.Bid,
 	}
 }
 
+// CancelReason tells why an order left the book without being filled.
+type CancelReason string
+
+const (
+	CancelReasonUser       CancelReason = "CANCELLED"
+	CancelReasonExpired    CancelReason = "EXPIRED"
+	CancelReasonImmediate  CancelReason = "IOC"
+	CancelReasonFillOrKill CancelReason = "FOK"
+
+	CancelReasonInsufficientLiquidity CancelReason = "INSUFFICIENT_LIQUIDITY"
+	CancelReasonPostOnly              CancelReason = "POST_ONLY"
+	CancelReasonReduceOnly            CancelReason = "REDUCE_ONLY"
+	CancelReasonSelfTrade             CancelReason = "SELF_TRADE"
+	// CancelReasonRejected cancels a triggered stop order OnTrigger refused.
+	CancelReasonRejected CancelReason = "REJECTED"
+)
+
+// CancelEvent is emitted every time an order, or what is left of it, is
+// removed without being filled. Self trade prevention may only cancel part of
+// an order, in which case the order stays in the book with a smaller size.
+type CancelEvent struct {
+	Order *Order
+	// Size is the size that was cancelled.
+	Size      decimal.Decimal
+	Reason    CancelReason
+	Timestamp int64
+}
+
 type Orderbook struct {
-	asks []*Limit
-	bids []*Limit
+	asks *priceLevels
+	bids *priceLevels
+
+	expiries expiryQueue
+
+	// askVolume and bidVolume include the hidden reserve of iceberg orders.
+	askVolume        decimal.Decimal
+	bidVolume        decimal.Decimal
+	askVisibleVolume decimal.Decimal
+	bidVisibleVolume decimal.Decimal
+
+	// lastPrice is the price of the latest match and markPrice the price
+	// set from outside, both can trigger stop orders.
+	lastPrice decimal.Decimal
+	markPrice decimal.Decimal
+	stops     map[int64]*StopOrder
+	stopSeq   int64
+
+	// PriceScale and SizeScale are the number of decimals prices and sizes
+	// are kept with. Every price and size entering the book is brought to
+	// these scales so that equal prices always share the same Limit.
+	PriceScale uint8
+	SizeScale  uint8
+	// TickSize is the price difference between two adjacent price levels,
+	// used to reprice post-only orders.
+	TickSize decimal.Decimal
+
+	// LiquidityPolicy decides what happens to market orders the book cannot
+	// fill completely. MaxSlippage is the fraction of the best price a
+	// market order may move the price by under the SlippageLimit policy.
+	LiquidityPolicy LiquidityPolicy
+	MaxSlippage     decimal.Decimal
 
 	mu        sync.RWMutex
-	AskLimits map[float64]*Limit
-	BidLimits map[float64]*Limit
+	AskLimits map[decimal.Decimal]*Limit
+	BidLimits map[decimal.Decimal]*Limit
 	Orders    map[int64]*Order
+
+	// OnCancel, when set, is called with the orderbook lock held for every
+	// CancelEvent. It must not call back into the orderbook.
+	OnCancel func(CancelEvent)
+	// OnTrigger, when set, is called with the orderbook lock held for every
+	// triggered stop order before it enters the book. Cost is the most
+	// filling a stop market bid can cost with the book as it is, zero for
+	// other stops. An error cancels the stop with CancelReasonRejected. It
+	// must not call back into the orderbook.
+	OnTrigger func(s *StopOrder, cost decimal.Decimal) error
 }
 
-func NewOrderbook() *Orderbook {
+func NewOrderbook(priceScale, sizeScale uint8) *Orderbook {
 	return &Orderbook{
-		asks:      []*Limit{},
-		bids:      []*Limit{},
-		AskLimits: make(map[float64]*Limit),
-		BidLimits: make(map[float64]*Limit),
+		asks:             newAskLevels(),
+		bids:             newBidLevels(),
+		askVolume:        decimal.New(0, sizeScale),
+		bidVolume:        decimal.New(0, sizeScale),
+		askVisibleVolume: decimal.New(0, sizeScale),
+		bidVisibleVolume: decimal.New(0, sizeScale),
+		stops:            make(map[int64]*StopOrder),
+		PriceScale:       priceScale,
+		SizeScale:        sizeScale,
+		TickSize:         decimal.New(1, priceScale),
+
+		LiquidityPolicy: RejectOnInsufficientLiquidity,
+
+		AskLimits: make(map[decimal.Decimal]*Limit),
+		BidLimits: make(map[decimal.Decimal]*Limit),
 		Orders:    make(map[int64]*Order),
 	}
 }
 
-func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
+// PlaceMarketOrder fills the order against the opposite side of the book at
+// any price. When there is not enough volume, the time in force of the order
+// or else the LiquidityPolicy of the book decides what happens:
+// ImmediateOrCancel fills what it can and drops the rest, FillOrKill drops the
+// whole order. In every other case an *InsufficientLiquidityError is returned
+// together with the matches that were made.
+func (ob *Orderbook) PlaceMarketOrder(o *Order) ([]Match, error) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
-	matches := []Match{}
+	return ob.placeMarketOrder(o)
+}
 
-	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
+func (ob *Orderbook) placeMarketOrder(o *Order) ([]Match, error) {
+	o.Size = o.Size.Truncate(ob.SizeScale)
+	requested := o.Size
+
+	policy := ob.LiquidityPolicy
+	switch o.TimeInForce {
+	case ImmediateOrCancel:
+		policy = PartialFill
+	case FillOrKill:
+		policy = RejectOnInsufficientLiquidity
+	}
+
+	canMatch := func(decimal.Decimal) bool { return true }
+	if policy == SlippageLimit {
+		if limitPrice, ok := ob.slippageLimit(o); ok {
+			canMatch = func(price decimal.Decimal) bool {
+				if o.Bid {
+					return price.LessThanOrEqual(limitPrice)
+				}
+				return price.GreaterThanOrEqual(limitPrice)
+			}
 		}
+	}
+
+	reason := CancelReasonInsufficientLiquidity
+	switch o.TimeInForce {
+	case ImmediateOrCancel:
+		reason = CancelReasonImmediate
+	case FillOrKill:
+		reason = CancelReasonFillOrKill
+	}
+
+	available := ob.matchableVolume(o, canMatch)
+	if available.LessThan(requested) && policy == RejectOnInsufficientLiquidity {
+		ob.emitCancel(o, o.Size, reason)
+		return []Match{}, ob.liquidityError(o, policy, requested, available, nil)
+	}
+
+	matches := ob.match(o, canMatch)
+	if o.IsFilled() {
+		return matches, nil
+	}
+
+	ob.emitCancel(o, o.Size, reason)
+	if o.TimeInForce == ImmediateOrCancel {
+		return matches, nil
+	}
+	return matches, ob.liquidityError(o, policy, requested, available, matches)
+}
+
+func (ob *Orderbook) liquidityError(o *Order, policy LiquidityPolicy, requested, available decimal.Decimal, matches []Match) error {
+	filled, avgPrice := FillSummary(matches, ob.PriceScale)
+	return &InsufficientLiquidityError{
+		OrderID:   o.ID,
+		Bid:       o.Bid,
+		Policy:    policy,
+		Requested: requested,
+		Available: available,
+		Filled:    filled,
+		AvgPrice:  avgPrice,
+	}
+}
+
+// PlaceLimitOrder matches the order against the opposite side of the book for
+// as long as the resting prices are at or better than the given price. Whatever
+// remains unfilled afterwards rests in the book at that price.
+//
+// The time in force of the order decides what happens to the remainder:
+// ImmediateOrCancel drops it, FillOrKill drops the whole order unless it can
+// be filled completely and GoodTilDate rests it until it expires.
+//
+// Post-only orders never match: depending on their PostOnly mode they are
+// rejected with ErrPostOnlyWouldCross or repriced one tick away from the best
+// price on the other side when they would cross the book.
+//
+// Prices and sizes with more decimals than the scales of the book are
+// truncated, callers are expected to validate them beforehand.
+func (ob *Orderbook) PlaceLimitOrder(price decimal.Decimal, o *Order) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return ob.placeLimitOrder(price, o)
+}
 
-		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
+func (ob *Orderbook) placeLimitOrder(price decimal.Decimal, o *Order) ([]Match, error) {
+	price = price.Truncate(ob.PriceScale)
+	o.Size = o.Size.Truncate(ob.SizeScale)
+	o.DisplaySize = o.DisplaySize.Truncate(ob.SizeScale)
 
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(!o.Bid, limit)
+	canMatch := func(limitPrice decimal.Decimal) bool {
+		if o.Bid {
+			return limitPrice.LessThanOrEqual(price)
+		}
+		return limitPrice.GreaterThanOrEqual(price)
+	}
+
+	if o.PostOnly != "" {
+		if best := ob.bestOpposite(o); best != nil && canMatch(best.Price) {
+			if o.PostOnly != PostOnlySlide {
+				ob.emitCancel(o, o.Size, CancelReasonPostOnly)
+				return []Match{}, ErrPostOnlyWouldCross
 			}
+			price = ob.slide(o, best.Price)
 		}
+	}
 
-	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
+	if o.TimeInForce == FillOrKill {
+		if available := ob.matchableVolume(o, canMatch); available.LessThan(o.Size) {
+			ob.emitCancel(o, o.Size, CancelReasonFillOrKill)
+			return []Match{}, ob.liquidityError(o, RejectOnInsufficientLiquidity, o.Size, available, nil)
 		}
+	}
+
+	matches := ob.match(o, canMatch)
+
+	if o.IsFilled() {
+		return matches, nil
+	}
+
+	switch o.TimeInForce {
+	case ImmediateOrCancel:
+		ob.emitCancel(o, o.Size, CancelReasonImmediate)
+	case FillOrKill:
+		// Never rests, even if self trade prevention left some of it.
+		ob.emitCancel(o, o.Size, CancelReasonFillOrKill)
+	case GoodTilDate:
+		ob.addOrder(price, o)
+		ob.expiries.push(o)
+	default:
+		ob.addOrder(price, o)
+	}
 
-		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
+	return matches, nil
+}
 
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(!o.Bid, limit)
+func (ob *Orderbook) bestOpposite(o *Order) *Limit {
+	if o.Bid {
+		return ob.asks.Best()
+	}
+	return ob.bids.Best()
+}
+
+// slide returns the price one tick away from the best price on the other side
+// of the book, where a post-only order rests without crossing.
+func (ob *Orderbook) slide(o *Order, bestOpposite decimal.Decimal) decimal.Decimal {
+	if o.Bid {
+		return bestOpposite.Sub(ob.TickSize)
+	}
+	return bestOpposite.Add(ob.TickSize)
+}
+
+// matchableVolume returns how much of the order could be filled right away,
+// counting no further than the size of the order. When the order prevents
+// self trades, orders of the same user are skipped with CancelOldest, since
+// they are cancelled instead of matched. The other modes use up some or all
+// of the order on them, a fill-or-kill order only counts what it fills
+// before it gets to one.
+func (ob *Orderbook) matchableVolume(o *Order, canMatch func(price decimal.Decimal) bool) decimal.Decimal {
+	levels := ob.bids
+	if o.Bid {
+		levels = ob.asks
+	}
+
+	volume := decimal.Zero
+	levels.Each(func(l *Limit) bool {
+		if !canMatch(l.Price) {
+			return false
+		}
+		if o.SelfTradePrevention == "" {
+			volume = volume.Add(l.TotalVolume)
+			return volume.LessThan(o.Size)
+		}
+
+		before := volume
+		for i, resting := range l.Orders {
+			switch {
+			case resting.UserID != o.UserID:
+				volume = volume.Add(resting.Size)
+			case o.SelfTradePrevention == CancelOldest:
+			case o.TimeInForce != FillOrKill:
+				volume = volume.Add(resting.Size)
+			default:
+				// Icebergs ahead of it fill their displayed slice and go
+				// to the back of the queue, behind it.
+				volume = before
+				for _, ahead := range l.Orders[:i] {
+					volume = volume.Add(ahead.VisibleSize())
+				}
+				return false
+			}
+		}
+		return volume.LessThan(o.Size)
+	})
+
+	return volume
+}
+
+// match fills the order against the opposite side of the book, best price
+// first, while canMatch accepts the price of the next limit.
+func (ob *Orderbook) match(o *Order, canMatch func(price decimal.Decimal) bool) []Match {
+	levels := ob.bids
+	if o.Bid {
+		levels = ob.asks
+	}
+
+	matches := []Match{}
+
+	for !o.IsFilled() {
+		limit := levels.Best()
+		if limit == nil || !canMatch(limit.Price) {
+			break
+		}
+
+		var (
+			limitMatches []Match
+			selfTrades   []SelfTrade
+		)
+		ob.trackVolume(!o.Bid, limit, func() { limitMatches, selfTrades = limit.Fill(o) })
+
+		for _, st := range selfTrades {
+			ob.handleSelfTrade(st)
+		}
+
+		for _, match := range limitMatches {
+			if match.Bid.IsFilled() {
+				ob.forget(match.Bid)
+			}
+			if match.Ask.IsFilled() {
+				ob.forget(match.Ask)
 			}
+			ob.lastPrice = match.Price
+			matches = append(matches, match)
+		}
+
+		if len(limit.Orders) == 0 {
+			ob.clearLimit(!o.Bid, limit)
 		}
 	}
 
 	return matches
 }
 
-func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
+// handleSelfTrade emits a CancelEvent for each order a prevented self trade
+// cancelled some or all of.
+func (ob *Orderbook) handleSelfTrade(st SelfTrade) {
+	if st.Maker.Limit == nil {
+		ob.forget(st.Maker)
+	}
+	if st.MakerSize.IsPositive() {
+		ob.emitCancel(st.Maker, st.MakerSize, CancelReasonSelfTrade)
+	}
+	if st.TakerSize.IsPositive() {
+		ob.emitCancel(st.Taker, st.TakerSize, CancelReasonSelfTrade)
+	}
+}
 
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
+func (ob *Orderbook) addOrder(price decimal.Decimal, o *Order) {
+	var (
+		limit *Limit
+		ok    bool
+	)
 
-	var ok bool
 	if o.Bid {
 		limit, ok = ob.BidLimits[price]
 	} else {
@@ -218,74 +721,223 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		limit = NewLimit(price)
 
 		if o.Bid {
-			ob.bids = append(ob.bids, limit)
+			ob.bids.Insert(limit)
 			ob.BidLimits[price] = limit
 		} else {
-			ob.asks = append(ob.asks, limit)
+			ob.asks.Insert(limit)
 			ob.AskLimits[price] = limit
 		}
 	}
 
 	ob.Orders[o.ID] = o
-	limit.AddOrder(o)
+	ob.trackVolume(o.Bid, limit, func() { limit.AddOrder(o) })
+}
+
+// trackVolume calls fn, which changes the limit, and applies the resulting
+// change of the limit volumes to the volumes of its side of the book.
+func (ob *Orderbook) trackVolume(bid bool, l *Limit, fn func()) {
+	total, visible := l.TotalVolume, l.VisibleVolume
+	fn()
+	total, visible = l.TotalVolume.Sub(total), l.VisibleVolume.Sub(visible)
+
+	if bid {
+		ob.bidVolume = ob.bidVolume.Add(total)
+		ob.bidVisibleVolume = ob.bidVisibleVolume.Add(visible)
+	} else {
+		ob.askVolume = ob.askVolume.Add(total)
+		ob.askVisibleVolume = ob.askVisibleVolume.Add(visible)
+	}
 }
 
 func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 	if bid {
 		delete(ob.BidLimits, l.Price)
-		for i := 0; i < len(ob.bids); i++ {
-			if ob.bids[i] == l {
-				ob.bids = DeleteOrderChanged(ob.bids, i)
-			}
-		}
+		ob.bids.Remove(l)
 	} else {
 		delete(ob.AskLimits, l.Price)
-		for i := 0; i < len(ob.asks); i++ {
-			if ob.asks[i] == l {
-				ob.asks = DeleteOrderChanged(ob.asks, i)
-			}
-		}
+		ob.asks.Remove(l)
 	}
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.cancelOrder(o, CancelReasonUser)
+}
+
+// AmendOrder changes the price and the open size of a resting order
+// atomically. Reducing the size at the same price keeps the time priority of
+// the order. Changing the price or increasing the size takes the order out of
+// the book and places it again like PlaceLimitOrder does, at the back of the
+// queue, which may match it right away, with timestamp as its new time.
+func (ob *Orderbook) AmendOrder(o *Order, price, size decimal.Decimal, timestamp int64) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if o.Limit == nil || ob.Orders[o.ID] != o {
+		return nil, ErrOrderNotFound
+	}
+
+	price = price.Truncate(ob.PriceScale)
+	size = size.Truncate(ob.SizeScale)
+	if !size.IsPositive() {
+		return nil, ErrInvalidSize
+	}
+
 	limit := o.Limit
-	limit.DeleteOrder(o)
-	delete(ob.Orders, o.ID)
+	if price.Equal(limit.Price) && size.LessThanOrEqual(o.Size) {
+		ob.trackVolume(o.Bid, limit, func() { limit.ReduceOrder(o, size) })
+		return []Match{}, nil
+	}
+
+	if o.PostOnly == PostOnlyReject {
+		if best := ob.bestOpposite(o); best != nil && (o.Bid && best.Price.LessThanOrEqual(price) || !o.Bid && best.Price.GreaterThanOrEqual(price)) {
+			return nil, ErrPostOnlyWouldCross
+		}
+	}
 
+	ob.trackVolume(o.Bid, limit, func() { limit.DeleteOrder(o) })
+	// The timestamp breaks ties in the expiry queue, the order goes back
+	// into it if it rests again.
+	ob.forget(o)
 	if len(limit.Orders) == 0 {
 		ob.clearLimit(o.Bid, limit)
 	}
+
+	o.Size = size
+	o.Timestamp = timestamp
+
+	return ob.placeLimitOrder(price, o)
 }
 
-func (ob *Orderbook) BidTotalVolume() float64 {
-	totalVolume := 0.0
+// CancelOrderWithReason is like CancelOrder but lets the caller tell why the
+// order is cancelled in the emitted CancelEvent.
+func (ob *Orderbook) CancelOrderWithReason(o *Order, reason CancelReason) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.cancelOrder(o, reason)
+}
+
+// ExpireOrders removes every GoodTilDate order that expired at or before now
+// and returns the events emitted for them.
+func (ob *Orderbook) ExpireOrders(now time.Time) []CancelEvent {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-	for _, limit := range ob.bids {
-		totalVolume += limit.TotalVolume
+	events := []CancelEvent{}
+	for _, o := range ob.expiries.popExpired(now.UnixNano()) {
+		events = append(events, ob.cancelOrder(o, CancelReasonExpired))
 	}
 
-	return totalVolume
+	return events
 }
 
-func (ob *Orderbook) AskTotalVolume() float64 {
-	totalVolume := 0.0
+// HasExpiredOrders reports whether ExpireOrders at now has orders to cancel.
+func (ob *Orderbook) HasExpiredOrders(now time.Time) bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
 
-	for _, limit := range ob.asks {
-		totalVolume += limit.TotalVolume
+	return ob.expiries.due(now.UnixNano())
+}
+
+func (ob *Orderbook) cancelOrder(o *Order, reason CancelReason) CancelEvent {
+	limit := o.Limit
+	ob.trackVolume(o.Bid, limit, func() { limit.DeleteOrder(o) })
+	ob.forget(o)
+
+	if len(limit.Orders) == 0 {
+		ob.clearLimit(o.Bid, limit)
 	}
 
-	return totalVolume
+	return ob.emitCancel(o, o.Size, reason)
 }
 
+// forget removes the order, which left the book, from the orders and the
+// expiry queue of the book.
+func (ob *Orderbook) forget(o *Order) {
+	delete(ob.Orders, o.ID)
+	ob.expiries.remove(o)
+}
+
+func (ob *Orderbook) emitCancel(o *Order, size decimal.Decimal, reason CancelReason) CancelEvent {
+	event := CancelEvent{
+		Order:     o,
+		Size:      size,
+		Reason:    reason,
+		Timestamp: time.Now().UnixNano(),
+	}
+	if ob.OnCancel != nil {
+		ob.OnCancel(event)
+	}
+	return event
+}
+
+func (ob *Orderbook) BidTotalVolume() decimal.Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bidVolume
+}
+
+func (ob *Orderbook) AskTotalVolume() decimal.Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.askVolume
+}
+
+// BidVisibleVolume is like BidTotalVolume without the hidden reserve of
+// iceberg orders.
+func (ob *Orderbook) BidVisibleVolume() decimal.Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bidVisibleVolume
+}
+
+// AskVisibleVolume is like AskTotalVolume without the hidden reserve of
+// iceberg orders.
+func (ob *Orderbook) AskVisibleVolume() decimal.Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.askVisibleVolume
+}
+
+// Asks returns the ask limits from the lowest to the highest price.
 func (ob *Orderbook) Asks() []*Limit {
-	sort.Sort(ByBestAsk(ob.asks))
-	return ob.asks
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.asks.Slice()
 }
 
+// Bids returns the bid limits from the highest to the lowest price.
 func (ob *Orderbook) Bids() []*Limit {
-	sort.Sort(ByBestBid(ob.bids))
-	return ob.bids
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bids.Slice()
+}
+
+// BestAsk returns the ask limit with the lowest price or nil if there are no
+// asks.
+func (ob *Orderbook) BestAsk() *Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.asks.Best()
+}
+
+// BestBid returns the bid limit with the highest price or nil if there are no
+// bids.
+func (ob *Orderbook) BestBid() *Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bids.Best()
 }
 
 func DeleteKeepOrder[T any](s []*T, i int) []*T {
@@ -293,8 +945,3 @@ func DeleteKeepOrder[T any](s []*T, i int) []*T {
 	s[len(s)-1] = nil
 	return s[:len(s)-1]
 }
-
-func DeleteOrderChanged[T any](s []*T, i int) []*T {
-	s[i] = s[len(s)-1]
-	return s[:len(s)-1]
-}
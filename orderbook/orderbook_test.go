@@ -1,22 +1,45 @@
 package orderbook
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
 )
 
 func assert(t *testing.T, a, b any) {
+	t.Helper()
+
+	if da, ok := a.(decimal.Decimal); ok {
+		if db, ok := b.(decimal.Decimal); ok && da.Equal(db) {
+			return
+		}
+	}
 	if !reflect.DeepEqual(a, b) {
 		t.Errorf("%+v != %+v", a, b)
 	}
 }
 
+// d is a shorthand for whole decimal numbers.
+func d(i int64) decimal.Decimal {
+	return decimal.NewFromInt(i)
+}
+
+func newOrderbook() *Orderbook {
+	return NewOrderbook(2, 8)
+}
+
 func TestLimit(t *testing.T) {
-	l := NewLimit(10_000)
-	buyOrderA := NewOrder(true, 5, 0)
-	buyOrderB := NewOrder(true, 8, 0)
-	buyOrderC := NewOrder(true, 10, 0)
+	l := NewLimit(d(10_000))
+	buyOrderA := NewOrder(true, d(5), 0)
+	buyOrderB := NewOrder(true, d(8), 0)
+	buyOrderC := NewOrder(true, d(10), 0)
 
 	l.AddOrder(buyOrderA)
 	l.AddOrder(buyOrderB)
@@ -27,76 +50,91 @@ func TestLimit(t *testing.T) {
 	fmt.Println(l)
 }
 
+func TestNewOrderIDsIncrease(t *testing.T) {
+	a := NewOrder(true, d(1), 0)
+	b := NewOrder(false, d(1), 0)
+
+	assert(t, b.ID > a.ID, true)
+	assert(t, NewOrderID() > b.ID, true)
+}
+
 func TestPlaceLimitOrder(t *testing.T) {
-	ob := NewOrderbook()
+	ob := newOrderbook()
 
-	sellOrderA := NewOrder(false, 10, 0)
-	sellOrderB := NewOrder(false, 5, 0)
-	ob.PlaceLimitOrder(10_000, sellOrderA)
-	ob.PlaceLimitOrder(9_000, sellOrderB)
+	sellOrderA := NewOrder(false, d(10), 0)
+	sellOrderB := NewOrder(false, d(5), 0)
+	ob.PlaceLimitOrder(d(10_000), sellOrderA)
+	ob.PlaceLimitOrder(d(9_000), sellOrderB)
 
 	assert(t, len(ob.Orders), 2)
 	assert(t, ob.Orders[sellOrderA.ID], sellOrderA)
 	assert(t, ob.Orders[sellOrderB.ID], sellOrderB)
-	assert(t, len(ob.asks), 2)
+	assert(t, ob.asks.Len(), 2)
 }
 
 func TestPlaceMarketOrder(t *testing.T) {
-	ob := NewOrderbook()
+	ob := newOrderbook()
 
-	sellOrder := NewOrder(false, 20, 0)
-	ob.PlaceLimitOrder(10_000, sellOrder)
+	sellOrder := NewOrder(false, d(20), 0)
+	ob.PlaceLimitOrder(d(10_000), sellOrder)
 
-	buyOrder := NewOrder(true, 10, 0)
-	matches := ob.PlaceMarketOrder(buyOrder)
+	buyOrder := NewOrder(true, d(10), 0)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
 
 	assert(t, len(matches), 1)
-	assert(t, len(ob.asks), 1)
-	assert(t, ob.AskTotalVolume(), 10.0)
+	assert(t, ob.asks.Len(), 1)
+	assert(t, ob.AskTotalVolume(), d(10))
 	assert(t, matches[0].Ask, sellOrder)
 	assert(t, matches[0].Bid, buyOrder)
-	assert(t, matches[0].SizeFilled, 10.0)
-	assert(t, matches[0].Price, 10_000.0)
+	assert(t, matches[0].SizeFilled, d(10))
+	assert(t, matches[0].Price, d(10_000))
+	assert(t, matches[0].TakerBid, true)
+	assert(t, matches[0].Maker(), sellOrder)
+	assert(t, matches[0].Taker(), buyOrder)
 	assert(t, buyOrder.IsFilled(), true)
 
 	fmt.Printf("%+v", matches)
 }
 
 func TestPlaceMarketOrderMultiFill(t *testing.T) {
-	ob := NewOrderbook()
+	ob := newOrderbook()
 
-	buyOrderA := NewOrder(true, 5, 0)
-	buyOrderB := NewOrder(true, 8, 0)
-	buyOrderC := NewOrder(true, 10, 0)
-	buyOrderD := NewOrder(true, 1, 0)
+	buyOrderA := NewOrder(true, d(5), 0)
+	buyOrderB := NewOrder(true, d(8), 0)
+	buyOrderC := NewOrder(true, d(10), 0)
+	buyOrderD := NewOrder(true, d(1), 0)
 
-	ob.PlaceLimitOrder(5_000, buyOrderC)
-	ob.PlaceLimitOrder(5_000, buyOrderD)
-	ob.PlaceLimitOrder(9_000, buyOrderB)
-	ob.PlaceLimitOrder(10_000, buyOrderA)
+	ob.PlaceLimitOrder(d(5_000), buyOrderC)
+	ob.PlaceLimitOrder(d(5_000), buyOrderD)
+	ob.PlaceLimitOrder(d(9_000), buyOrderB)
+	ob.PlaceLimitOrder(d(10_000), buyOrderA)
 
-	assert(t, ob.BidTotalVolume(), 24.0)
+	assert(t, ob.BidTotalVolume(), d(24))
 
-	sellOrder := NewOrder(false, 20, 0)
-	matches := ob.PlaceMarketOrder(sellOrder)
+	sellOrder := NewOrder(false, d(20), 0)
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+	assert(t, err, nil)
 
-	assert(t, ob.BidTotalVolume(), 4.0)
+	assert(t, ob.BidTotalVolume(), d(4))
 	assert(t, len(matches), 3)
-	assert(t, len(ob.bids), 1)
+	assert(t, ob.bids.Len(), 1)
+	assert(t, matches[0].Maker(), buyOrderA)
+	assert(t, matches[2].Taker(), sellOrder)
 
 	fmt.Printf("%+v", matches)
 }
 
 func TestCancelOrderBid(t *testing.T) {
-	ob := NewOrderbook()
-	buyOrder := NewOrder(true, 4, 0)
-	price := 10_000.0
+	ob := newOrderbook()
+	buyOrder := NewOrder(true, d(4), 0)
+	price := decimal.New(10_000_00, 2)
 	ob.PlaceLimitOrder(price, buyOrder)
 
-	assert(t, ob.BidTotalVolume(), 4.0)
+	assert(t, ob.BidTotalVolume(), d(4))
 
 	ob.CancelOrder(buyOrder)
-	assert(t, ob.BidTotalVolume(), 0.0)
+	assert(t, ob.BidTotalVolume(), d(0))
 
 	_, ok := ob.Orders[buyOrder.ID]
 	assert(t, ok, false)
@@ -106,15 +144,15 @@ func TestCancelOrderBid(t *testing.T) {
 }
 
 func TestCancelOrderAsk(t *testing.T) {
-	ob := NewOrderbook()
-	sellOrder := NewOrder(false, 4, 0)
-	price := 10_000.0
+	ob := newOrderbook()
+	sellOrder := NewOrder(false, d(4), 0)
+	price := decimal.New(10_000_00, 2)
 	ob.PlaceLimitOrder(price, sellOrder)
 
-	assert(t, ob.AskTotalVolume(), 4.0)
+	assert(t, ob.AskTotalVolume(), d(4))
 
 	ob.CancelOrder(sellOrder)
-	assert(t, ob.AskTotalVolume(), 0.0)
+	assert(t, ob.AskTotalVolume(), d(0))
 
 	_, ok := ob.Orders[sellOrder.ID]
 	assert(t, ok, false)
@@ -122,3 +160,911 @@ func TestCancelOrderAsk(t *testing.T) {
 	_, ok = ob.AskLimits[price]
 	assert(t, ok, false)
 }
+
+func TestPlaceLimitOrderCrossing(t *testing.T) {
+	ob := newOrderbook()
+
+	sellOrderA := NewOrder(false, d(5), 0)
+	sellOrderB := NewOrder(false, d(5), 0)
+	ob.PlaceLimitOrder(d(10_000), sellOrderA)
+	ob.PlaceLimitOrder(d(10_200), sellOrderB)
+
+	buyOrder := NewOrder(true, d(8), 0)
+	matches, err := ob.PlaceLimitOrder(d(10_100), buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Ask, sellOrderA)
+	assert(t, matches[0].Bid, buyOrder)
+	assert(t, matches[0].SizeFilled, d(5))
+	assert(t, matches[0].Price, d(10_000))
+
+	assert(t, ob.AskTotalVolume(), d(5))
+	assert(t, ob.BidTotalVolume(), d(3))
+	assert(t, buyOrder.Limit.Price, d(10_100))
+	assert(t, len(ob.Orders), 2)
+
+	_, ok := ob.AskLimits[decimal.New(10_000_00, 2)]
+	assert(t, ok, false)
+}
+
+func TestPlaceLimitOrderCrossingFullyFilled(t *testing.T) {
+	ob := newOrderbook()
+
+	buyOrderA := NewOrder(true, d(5), 0)
+	buyOrderB := NewOrder(true, d(5), 0)
+	ob.PlaceLimitOrder(d(10_000), buyOrderA)
+	ob.PlaceLimitOrder(d(9_500), buyOrderB)
+
+	sellOrder := NewOrder(false, d(7), 0)
+	matches, err := ob.PlaceLimitOrder(d(9_000), sellOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Price, d(10_000))
+	assert(t, matches[1].Price, d(9_500))
+	assert(t, sellOrder.IsFilled(), true)
+	assert(t, sellOrder.Limit == nil, true)
+	assert(t, ob.asks.Len(), 0)
+	assert(t, ob.BidTotalVolume(), d(3))
+	assert(t, len(ob.Orders), 1)
+}
+
+func TestPlaceLimitOrderSamePriceDifferentScale(t *testing.T) {
+	ob := newOrderbook()
+
+	sellOrderA := NewOrder(false, decimal.RequireFromString("0.1"), 0)
+	sellOrderB := NewOrder(false, decimal.RequireFromString("0.2"), 0)
+	ob.PlaceLimitOrder(decimal.RequireFromString("10000.1"), sellOrderA)
+	ob.PlaceLimitOrder(decimal.RequireFromString("10000.10"), sellOrderB)
+
+	assert(t, ob.asks.Len(), 1)
+	assert(t, ob.AskTotalVolume(), decimal.RequireFromString("0.3"))
+
+	buyOrder := NewOrder(true, decimal.RequireFromString("0.3"), 0)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 2)
+	assert(t, buyOrder.IsFilled(), true)
+	assert(t, ob.asks.Len(), 0)
+	assert(t, len(ob.Orders), 0)
+}
+
+func TestPriceLevelsOrder(t *testing.T) {
+	asks := newAskLevels()
+	bids := newBidLevels()
+
+	limits := map[int64]*Limit{}
+	for _, i := range rand.Perm(100) {
+		limits[int64(i)] = NewLimit(d(int64(i)))
+		asks.Insert(limits[int64(i)])
+		bids.Insert(NewLimit(d(int64(i))))
+	}
+
+	assert(t, asks.Best().Price, d(0))
+	assert(t, bids.Best().Price, d(99))
+
+	for i := int64(0); i < 100; i += 2 {
+		assert(t, asks.Remove(limits[i]), true)
+	}
+	assert(t, asks.Remove(NewLimit(d(1))), false)
+	assert(t, asks.Len(), 50)
+	assert(t, asks.Best().Price, d(1))
+
+	prev := d(-1)
+	asks.Each(func(l *Limit) bool {
+		assert(t, l.Price.GreaterThan(prev), true)
+		prev = l.Price
+		return true
+	})
+
+	var prices []decimal.Decimal
+	for _, l := range bids.Slice()[:3] {
+		prices = append(prices, l.Price)
+	}
+	assert(t, prices, []decimal.Decimal{d(99), d(98), d(97)})
+}
+
+var benchmarkSizes = []int{10_000, 100_000, 1_000_000}
+
+// byBestAsk is how the asks used to be kept: an unordered slice sorted on
+// every access. It is only kept around to compare against in the benchmarks.
+type byBestAsk []*Limit
+
+func (a byBestAsk) Len() int           { return len(a) }
+func (a byBestAsk) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byBestAsk) Less(i, j int) bool { return a[i].Price.LessThan(a[j].Price) }
+
+// restingAsks returns a book with n resting asks, each at its own price, and
+// the same limits as a slice.
+func restingAsks(n int) (*Orderbook, []*Limit) {
+	ob := newOrderbook()
+	for _, i := range rand.Perm(n) {
+		ob.PlaceLimitOrder(d(int64(10_000+i)), NewOrder(false, d(1), 0))
+	}
+	return ob, ob.Asks()
+}
+
+func BenchmarkBestAsk(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		ob, limits := restingAsks(n)
+
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = ob.BestAsk()
+			}
+		})
+
+		b.Run(fmt.Sprintf("sort/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sort.Sort(byBestAsk(limits))
+				_ = limits[0]
+			}
+		})
+	}
+}
+
+func BenchmarkPlaceCancelLimitOrder(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		ob, limits := restingAsks(n)
+
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				o := NewOrder(false, d(1), 0)
+				ob.PlaceLimitOrder(d(int64(10_000+n+i%n)), o)
+				ob.CancelOrder(o)
+			}
+		})
+
+		b.Run(fmt.Sprintf("sort/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				limit := NewLimit(d(int64(10_000 + n + i%n)))
+				limits = append(limits, limit)
+				sort.Sort(byBestAsk(limits))
+
+				for j := 0; j < len(limits); j++ {
+					if limits[j] == limit {
+						limits[j] = limits[len(limits)-1]
+						limits = limits[:len(limits)-1]
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMarketOrder(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		ob, _ := restingAsks(n)
+
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ob.PlaceLimitOrder(d(1), NewOrder(false, d(1), 0))
+				ob.PlaceMarketOrder(NewOrder(true, d(1), 0))
+			}
+		})
+	}
+}
+
+func TestPlaceLimitOrderImmediateOrCancel(t *testing.T) {
+	ob := newOrderbook()
+	var events []CancelEvent
+	ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(5), 0))
+
+	buyOrder := NewOrder(true, d(8), 0)
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceLimitOrder(d(10_000), buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 1)
+	assert(t, buyOrder.Limit == nil, true)
+	assert(t, ob.BidTotalVolume(), d(0))
+	assert(t, len(ob.Orders), 0)
+	assert(t, len(events), 1)
+	assert(t, events[0].Reason, CancelReasonImmediate)
+	assert(t, events[0].Size, d(3))
+}
+
+func TestPlaceLimitOrderFillOrKill(t *testing.T) {
+	ob := newOrderbook()
+	var events []CancelEvent
+	ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+
+	sellOrderA := NewOrder(false, d(5), 0)
+	sellOrderB := NewOrder(false, d(5), 0)
+	ob.PlaceLimitOrder(d(10_000), sellOrderA)
+	ob.PlaceLimitOrder(d(10_500), sellOrderB)
+
+	killed := NewOrder(true, d(8), 0)
+	killed.TimeInForce = FillOrKill
+	matches, err := ob.PlaceLimitOrder(d(10_000), killed)
+
+	var liquidityErr *InsufficientLiquidityError
+	assert(t, errors.As(err, &liquidityErr), true)
+	assert(t, liquidityErr.Available, d(5))
+	assert(t, len(matches), 0)
+	assert(t, killed.Size, d(8))
+	assert(t, ob.AskTotalVolume(), d(10))
+	assert(t, ob.BidTotalVolume(), d(0))
+	assert(t, len(events), 1)
+	assert(t, events[0].Reason, CancelReasonFillOrKill)
+
+	filled := NewOrder(true, d(8), 0)
+	filled.TimeInForce = FillOrKill
+	matches, err = ob.PlaceLimitOrder(d(10_500), filled)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 2)
+	assert(t, filled.IsFilled(), true)
+	assert(t, ob.AskTotalVolume(), d(2))
+}
+
+func TestPlaceMarketOrderFillOrKill(t *testing.T) {
+	ob := newOrderbook()
+	ob.PlaceLimitOrder(d(10_000), NewOrder(true, d(5), 0))
+
+	sellOrder := NewOrder(false, d(6), 0)
+	sellOrder.TimeInForce = FillOrKill
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+
+	var liquidityErr *InsufficientLiquidityError
+	assert(t, errors.As(err, &liquidityErr), true)
+	assert(t, liquidityErr.Filled, d(0))
+	assert(t, len(matches), 0)
+	assert(t, ob.BidTotalVolume(), d(5))
+}
+
+func TestFillOrKillSelfTradePrevention(t *testing.T) {
+	ob := newOrderbook()
+	var events []CancelEvent
+	ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+
+	// CancelOldest cancels the orders of the user instead of matching them,
+	// they do not count towards filling the order.
+	own := NewOrder(false, d(5), 1)
+	ob.PlaceLimitOrder(d(10_000), own)
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(3), 2))
+	ob.PlaceLimitOrder(d(10_100), NewOrder(false, d(2), 2))
+
+	killed := NewOrder(true, d(6), 1)
+	killed.TimeInForce = FillOrKill
+	killed.SelfTradePrevention = CancelOldest
+	matches, err := ob.PlaceLimitOrder(d(10_100), killed)
+
+	var liquidityErr *InsufficientLiquidityError
+	assert(t, errors.As(err, &liquidityErr), true)
+	assert(t, liquidityErr.Available, d(5))
+	assert(t, len(matches), 0)
+	assert(t, killed.Limit == nil, true)
+	assert(t, ob.AskTotalVolume(), d(10))
+	assert(t, ob.BidTotalVolume(), d(0))
+	assert(t, len(events), 1)
+	assert(t, events[0].Reason, CancelReasonFillOrKill)
+
+	filled := NewOrder(true, d(5), 1)
+	filled.TimeInForce = FillOrKill
+	filled.SelfTradePrevention = CancelOldest
+	matches, err = ob.PlaceLimitOrder(d(10_100), filled)
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, filled.IsFilled(), true)
+	assert(t, own.Limit == nil, true)
+	assert(t, ob.AskTotalVolume(), d(0))
+	assert(t, ob.BidTotalVolume(), d(0))
+
+	// CancelNewest cancels the order itself once it gets to an order of the
+	// user, only what is ahead of that counts.
+	ob = newOrderbook()
+	events = nil
+	ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(3), 2))
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(5), 1))
+	ob.PlaceLimitOrder(d(10_100), NewOrder(false, d(4), 2))
+
+	killed = NewOrder(true, d(6), 1)
+	killed.TimeInForce = FillOrKill
+	killed.SelfTradePrevention = CancelNewest
+	matches, err = ob.PlaceLimitOrder(d(10_100), killed)
+	assert(t, errors.As(err, &liquidityErr), true)
+	assert(t, liquidityErr.Available, d(3))
+	assert(t, len(matches), 0)
+	assert(t, killed.Limit == nil, true)
+	assert(t, ob.AskTotalVolume(), d(12))
+	assert(t, ob.BidTotalVolume(), d(0))
+	assert(t, len(events), 1)
+	assert(t, events[0].Reason, CancelReasonFillOrKill)
+
+	filled = NewOrder(true, d(3), 1)
+	filled.TimeInForce = FillOrKill
+	filled.SelfTradePrevention = CancelNewest
+	matches, err = ob.PlaceLimitOrder(d(10_100), filled)
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, filled.IsFilled(), true)
+	assert(t, ob.AskTotalVolume(), d(9))
+	assert(t, ob.BidTotalVolume(), d(0))
+}
+
+func TestExpireOrders(t *testing.T) {
+	ob := newOrderbook()
+	var events []CancelEvent
+	ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+
+	now := time.Now()
+
+	early := NewOrder(true, d(1), 0)
+	early.TimeInForce = GoodTilDate
+	early.ExpiresAt = now.Add(time.Minute).UnixNano()
+
+	late := NewOrder(true, d(2), 0)
+	late.TimeInForce = GoodTilDate
+	late.ExpiresAt = now.Add(time.Hour).UnixNano()
+
+	cancelled := NewOrder(true, d(3), 0)
+	cancelled.TimeInForce = GoodTilDate
+	cancelled.ExpiresAt = now.Add(time.Second).UnixNano()
+
+	ob.PlaceLimitOrder(d(9_000), late)
+	ob.PlaceLimitOrder(d(9_000), early)
+	ob.PlaceLimitOrder(d(9_500), cancelled)
+	ob.CancelOrder(cancelled)
+
+	filled := NewOrder(true, d(1), 0)
+	filled.TimeInForce = GoodTilDate
+	filled.ExpiresAt = now.Add(time.Second).UnixNano()
+	ob.PlaceLimitOrder(d(9_600), filled)
+	ob.PlaceMarketOrder(NewOrder(false, d(1), 1))
+
+	// Orders that leave the book early leave the queue with it.
+	assert(t, len(ob.expiries), 2)
+	assert(t, ob.HasExpiredOrders(now.Add(time.Second)), false)
+	assert(t, len(ob.ExpireOrders(now)), 0)
+
+	expired := ob.ExpireOrders(now.Add(2 * time.Minute))
+	assert(t, len(expired), 1)
+	assert(t, expired[0].Order, early)
+	assert(t, expired[0].Reason, CancelReasonExpired)
+	assert(t, ob.BidTotalVolume(), d(2))
+
+	expired = ob.ExpireOrders(now.Add(2 * time.Hour))
+	assert(t, len(expired), 1)
+	assert(t, expired[0].Order, late)
+	assert(t, ob.bids.Len(), 0)
+	assert(t, len(ob.Orders), 0)
+
+	// cancel, expire and expire again
+	assert(t, len(events), 3)
+	assert(t, events[0].Reason, CancelReasonUser)
+}
+
+func TestPlaceMarketOrderInsufficientLiquidity(t *testing.T) {
+	ob := newOrderbook()
+	var events []CancelEvent
+	ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+
+	ob.PlaceLimitOrder(d(10_000), NewOrder(true, d(5), 0))
+
+	sellOrder := NewOrder(false, d(8), 0)
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+
+	var liquidityErr *InsufficientLiquidityError
+	assert(t, errors.As(err, &liquidityErr), true)
+	assert(t, liquidityErr.Bid, false)
+	assert(t, liquidityErr.Requested, d(8))
+	assert(t, liquidityErr.Available, d(5))
+	assert(t, liquidityErr.Filled, d(0))
+	assert(t, err.Error(), "not enough bid volume [size: 5.00000000] for market order [size: 8.00000000], filled [size: 0]")
+	assert(t, len(matches), 0)
+	assert(t, ob.BidTotalVolume(), d(5))
+	assert(t, events[0].Reason, CancelReasonInsufficientLiquidity)
+}
+
+func TestPlaceMarketOrderPartialFill(t *testing.T) {
+	ob := newOrderbook()
+	ob.LiquidityPolicy = PartialFill
+
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(2), 0))
+	ob.PlaceLimitOrder(d(10_100), NewOrder(false, d(2), 0))
+
+	buyOrder := NewOrder(true, d(5), 0)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	var liquidityErr *InsufficientLiquidityError
+	assert(t, errors.As(err, &liquidityErr), true)
+	assert(t, len(matches), 2)
+	assert(t, liquidityErr.Filled, d(4))
+	assert(t, liquidityErr.AvgPrice, d(10_050))
+	assert(t, buyOrder.Size, d(1))
+	assert(t, ob.AskTotalVolume(), d(0))
+}
+
+func TestPlaceMarketOrderSlippageLimit(t *testing.T) {
+	ob := newOrderbook()
+	ob.LiquidityPolicy = SlippageLimit
+	ob.MaxSlippage = decimal.RequireFromString("0.01")
+
+	ob.PlaceLimitOrder(d(10_000), NewOrder(true, d(2), 0))
+	ob.PlaceLimitOrder(d(9_900), NewOrder(true, d(2), 0))
+	ob.PlaceLimitOrder(d(9_899), NewOrder(true, d(2), 0))
+
+	sellOrder := NewOrder(false, d(5), 0)
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+
+	var liquidityErr *InsufficientLiquidityError
+	assert(t, errors.As(err, &liquidityErr), true)
+	assert(t, len(matches), 2)
+	assert(t, liquidityErr.Filled, d(4))
+	assert(t, liquidityErr.AvgPrice, d(9_950))
+	assert(t, ob.BidTotalVolume(), d(2))
+	assert(t, ob.BestBid().Price, d(9_899))
+}
+
+func TestPlaceMarketOrderImmediateOrCancel(t *testing.T) {
+	ob := newOrderbook()
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(2), 0))
+
+	buyOrder := NewOrder(true, d(5), 0)
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, buyOrder.Size, d(3))
+}
+
+func TestPlaceLimitOrderPostOnly(t *testing.T) {
+	ob := newOrderbook()
+	var events []CancelEvent
+	ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(5), 0))
+	ob.PlaceLimitOrder(d(9_000), NewOrder(true, d(5), 0))
+
+	rejected := NewOrder(true, d(1), 0)
+	rejected.PostOnly = PostOnlyReject
+	matches, err := ob.PlaceLimitOrder(d(10_000), rejected)
+
+	assert(t, err, ErrPostOnlyWouldCross)
+	assert(t, len(matches), 0)
+	assert(t, rejected.Limit == nil, true)
+	assert(t, ob.AskTotalVolume(), d(5))
+	assert(t, events[0].Reason, CancelReasonPostOnly)
+
+	slid := NewOrder(true, d(1), 0)
+	slid.PostOnly = PostOnlySlide
+	matches, err = ob.PlaceLimitOrder(d(10_500), slid)
+
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	assert(t, slid.Limit.Price, decimal.RequireFromString("9999.99"))
+	assert(t, ob.BestBid(), slid.Limit)
+
+	resting := NewOrder(false, d(1), 0)
+	resting.PostOnly = PostOnlyReject
+	_, err = ob.PlaceLimitOrder(d(10_001), resting)
+
+	assert(t, err, nil)
+	assert(t, resting.Limit.Price, d(10_001))
+}
+
+func TestTriggerStopsCascade(t *testing.T) {
+	ob := newOrderbook()
+
+	ob.PlaceLimitOrder(d(10_000), NewOrder(true, d(1), 1))
+	ob.PlaceLimitOrder(d(9_900), NewOrder(true, d(1), 1))
+	ob.PlaceLimitOrder(d(9_800), NewOrder(true, d(1), 1))
+	ob.PlaceLimitOrder(d(9_700), NewOrder(true, d(5), 1))
+
+	stopA := &StopOrder{Order: NewOrder(false, d(1), 2), StopPrice: d(9_900), Trigger: TriggerLastTrade}
+	stopB := &StopOrder{Order: NewOrder(false, d(1), 3), StopPrice: d(9_950), Trigger: TriggerLastTrade}
+	stopC := &StopOrder{Order: NewOrder(false, d(1), 4), StopPrice: d(9_000), Trigger: TriggerLastTrade}
+	stopLimit := &StopOrder{Order: NewOrder(false, d(2), 5), StopPrice: d(9_800), LimitPrice: d(9_750), IsLimit: true, Trigger: TriggerBestPrice}
+
+	for _, s := range []*StopOrder{stopA, stopB, stopC, stopLimit} {
+		assert(t, ob.PlaceStopOrder(s), nil)
+	}
+
+	assert(t, len(ob.TriggerStops()), 0)
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(false, d(1), 6))
+	assert(t, err, nil)
+	assert(t, matches[0].Price, d(10_000))
+	assert(t, len(ob.TriggerStops()), 0)
+
+	// A trade at 9_900 triggers A and B, which are placed in that order and
+	// take 9_800 and 9_700. That leaves 9_700 as the best bid, which
+	// triggers the stop limit order.
+	matches, _ = ob.PlaceMarketOrder(NewOrder(false, d(1), 6))
+	assert(t, matches[0].Price, d(9_900))
+
+	triggers := ob.TriggerStops()
+	assert(t, len(triggers), 3)
+	assert(t, triggers[0].Stop, stopA)
+	assert(t, triggers[0].Matches[0].Price, d(9_800))
+	assert(t, triggers[1].Stop, stopB)
+	assert(t, triggers[1].Matches[0].Price, d(9_700))
+	assert(t, triggers[2].Stop, stopLimit)
+	assert(t, len(triggers[2].Matches), 0)
+	assert(t, stopLimit.Order.Limit.Price, d(9_750))
+
+	assert(t, ob.LastPrice(), d(9_700))
+	assert(t, ob.StopOrders(), []*StopOrder{stopC})
+}
+
+func TestTriggerStopsMarkPrice(t *testing.T) {
+	ob := newOrderbook()
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(5), 1))
+
+	stop := &StopOrder{Order: NewOrder(true, d(1), 2), StopPrice: d(9_500), Trigger: TriggerMarkPrice}
+	assert(t, ob.PlaceStopOrder(stop), nil)
+
+	ob.SetMarkPrice(d(9_400))
+	assert(t, len(ob.TriggerStops()), 0)
+
+	ob.SetMarkPrice(d(9_500))
+	triggers := ob.TriggerStops()
+	assert(t, len(triggers), 1)
+	assert(t, triggers[0].Matches[0].Price, d(10_000))
+	assert(t, ob.AskTotalVolume(), d(4))
+}
+
+func TestTriggerStopsOnTrigger(t *testing.T) {
+	ob := newOrderbook()
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(1), 1))
+	ob.PlaceLimitOrder(d(10_500), NewOrder(false, d(1), 1))
+
+	errRefused := errors.New("refused")
+	var costs []decimal.Decimal
+	ob.OnTrigger = func(s *StopOrder, cost decimal.Decimal) error {
+		costs = append(costs, cost)
+		if s.Order.UserID == 3 {
+			return errRefused
+		}
+		return nil
+	}
+	var cancels []CancelEvent
+	ob.OnCancel = func(event CancelEvent) { cancels = append(cancels, event) }
+
+	refused := &StopOrder{Order: NewOrder(true, d(1), 3), StopPrice: d(9_000), Trigger: TriggerMarkPrice}
+	allowed := &StopOrder{Order: NewOrder(true, d(2), 2), StopPrice: d(9_000), Trigger: TriggerMarkPrice}
+	assert(t, ob.PlaceStopOrder(refused), nil)
+	assert(t, ob.PlaceStopOrder(allowed), nil)
+
+	// The refused stop is cancelled before it fills, the other one is told
+	// what filling it at market costs.
+	ob.SetMarkPrice(d(9_000))
+	triggers := ob.TriggerStops()
+	assert(t, len(triggers), 2)
+	assert(t, triggers[0].Err, errRefused)
+	assert(t, len(triggers[0].Matches), 0)
+	assert(t, len(triggers[1].Matches), 2)
+	assert(t, costs, []decimal.Decimal{d(10_000), d(20_500)})
+	assert(t, len(cancels), 1)
+	assert(t, cancels[0].Order, refused.Order)
+	assert(t, cancels[0].Reason, CancelReasonRejected)
+}
+
+func TestAmendAndCancelStopOrder(t *testing.T) {
+	ob := newOrderbook()
+
+	stop := &StopOrder{Order: NewOrder(true, d(1), 2), StopPrice: d(9_500), Trigger: TriggerLastTrade}
+	assert(t, ob.PlaceStopOrder(stop), nil)
+	assert(t, ob.PlaceStopOrder(&StopOrder{Order: NewOrder(true, d(1), 2), StopPrice: d(9_500)}), ErrInvalidTrigger)
+
+	assert(t, ob.AmendStopOrder(stop.Order.ID, d(0), d(0), d(2)), ErrInvalidStopPrice)
+	assert(t, ob.AmendStopOrder(stop.Order.ID, d(9_600), d(0), d(2)), nil)
+	assert(t, stop.StopPrice, d(9_600))
+	assert(t, stop.Order.Size, d(2))
+	assert(t, ob.HasStopOrder(stop.Order.ID), true)
+
+	cancelled, err := ob.CancelStopOrder(stop.Order.ID)
+	assert(t, err, nil)
+	assert(t, cancelled, stop)
+	assert(t, ob.HasStopOrder(stop.Order.ID), false)
+
+	_, err = ob.CancelStopOrder(stop.Order.ID)
+	assert(t, err, ErrStopNotFound)
+	assert(t, len(ob.StopOrders()), 0)
+}
+
+func TestIcebergOrder(t *testing.T) {
+	ob := newOrderbook()
+
+	iceberg := NewOrder(false, d(10), 1)
+	iceberg.DisplaySize = d(2)
+	other := NewOrder(false, d(3), 2)
+
+	ob.PlaceLimitOrder(d(10_000), iceberg)
+	ob.PlaceLimitOrder(d(10_000), other)
+
+	limit := iceberg.Limit
+	assert(t, iceberg.VisibleSize(), d(2))
+	assert(t, iceberg.Hidden, d(8))
+	assert(t, limit.TotalVolume, d(13))
+	assert(t, limit.VisibleVolume, d(5))
+	assert(t, ob.AskTotalVolume(), d(13))
+	assert(t, ob.AskVisibleVolume(), d(5))
+
+	// The displayed slice is used up, the refreshed one goes behind other.
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, d(3), 3))
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Ask, iceberg)
+	assert(t, matches[0].SizeFilled, d(2))
+	assert(t, matches[1].Ask, other)
+	assert(t, matches[1].SizeFilled, d(1))
+	assert(t, limit.Orders, []*Order{other, iceberg})
+	assert(t, iceberg.VisibleSize(), d(2))
+	assert(t, iceberg.Hidden, d(6))
+	assert(t, ob.AskTotalVolume(), d(10))
+	assert(t, ob.AskVisibleVolume(), d(4))
+
+	// A large order keeps matching the refreshed slices.
+	matches, err = ob.PlaceMarketOrder(NewOrder(true, d(9), 3))
+	assert(t, err, nil)
+	assert(t, len(matches), 5)
+	assert(t, iceberg.Size, d(1))
+	assert(t, iceberg.VisibleSize(), d(1))
+	assert(t, iceberg.Hidden, d(0))
+	assert(t, ob.AskTotalVolume(), d(1))
+	assert(t, ob.AskVisibleVolume(), d(1))
+
+	ob.CancelOrder(iceberg)
+	assert(t, ob.AskTotalVolume(), d(0))
+	assert(t, ob.AskVisibleVolume(), d(0))
+}
+
+func TestAmendOrderReduceSizeKeepsPriority(t *testing.T) {
+	ob := newOrderbook()
+
+	buyOrderA := NewOrder(true, d(5), 0)
+	buyOrderB := NewOrder(true, d(5), 0)
+	ob.PlaceLimitOrder(d(10_000), buyOrderA)
+	ob.PlaceLimitOrder(d(10_000), buyOrderB)
+
+	matches, err := ob.AmendOrder(buyOrderA, d(10_000), d(2), 1)
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	assert(t, buyOrderA.Limit.Orders, []*Order{buyOrderA, buyOrderB})
+	assert(t, buyOrderA.Limit.TotalVolume, d(7))
+	assert(t, ob.BidTotalVolume(), d(7))
+	assert(t, ob.BidVisibleVolume(), d(7))
+}
+
+func TestAmendOrderRequeues(t *testing.T) {
+	ob := newOrderbook()
+
+	buyOrderA := NewOrder(true, d(5), 0)
+	buyOrderB := NewOrder(true, d(5), 0)
+	ob.PlaceLimitOrder(d(10_000), buyOrderA)
+	ob.PlaceLimitOrder(d(10_000), buyOrderB)
+
+	// increasing the size loses time priority
+	_, err := ob.AmendOrder(buyOrderA, d(10_000), d(6), 1)
+	assert(t, err, nil)
+	assert(t, buyOrderA.Limit.Orders, []*Order{buyOrderB, buyOrderA})
+	assert(t, ob.BidTotalVolume(), d(11))
+
+	// changing the price moves the order to the new limit
+	_, err = ob.AmendOrder(buyOrderB, d(9_000), d(5), 1)
+	assert(t, err, nil)
+	assert(t, buyOrderB.Limit.Price, d(9_000))
+	assert(t, ob.bids.Len(), 2)
+	assert(t, ob.BestBid(), buyOrderA.Limit)
+
+	// a new price crossing the book matches right away
+	sellOrder := NewOrder(false, d(3), 0)
+	ob.PlaceLimitOrder(d(10_500), sellOrder)
+
+	matches, err := ob.AmendOrder(sellOrder, d(10_000), d(3), 1)
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, sellOrder.IsFilled(), true)
+	assert(t, ob.asks.Len(), 0)
+	assert(t, ob.BidTotalVolume(), d(8))
+}
+
+func TestAmendOrderErrors(t *testing.T) {
+	ob := newOrderbook()
+
+	sellOrder := NewOrder(false, d(5), 0)
+	ob.PlaceLimitOrder(d(10_000), sellOrder)
+
+	buyOrder := NewOrder(true, d(5), 0)
+	buyOrder.PostOnly = PostOnlyReject
+	ob.PlaceLimitOrder(d(9_000), buyOrder)
+
+	_, err := ob.AmendOrder(buyOrder, d(10_000), d(5), 1)
+	assert(t, err, ErrPostOnlyWouldCross)
+	assert(t, buyOrder.Limit.Price, d(9_000))
+
+	_, err = ob.AmendOrder(buyOrder, d(9_000), d(0), 1)
+	assert(t, err, ErrInvalidSize)
+
+	ob.CancelOrder(sellOrder)
+	_, err = ob.AmendOrder(sellOrder, d(10_000), d(1), 1)
+	assert(t, err, ErrOrderNotFound)
+}
+
+func TestAmendGoodTilDateOrder(t *testing.T) {
+	ob := newOrderbook()
+	expiresAt := time.Now().Add(time.Minute)
+
+	first := NewOrder(true, d(1), 0)
+	second := NewOrder(true, d(1), 0)
+	for i, o := range []*Order{first, second} {
+		o.TimeInForce = GoodTilDate
+		o.ExpiresAt = expiresAt.UnixNano()
+		o.Timestamp = int64(i + 1)
+		ob.PlaceLimitOrder(d(9_000), o)
+	}
+
+	// The amended order is queued once, with the time it was amended at, so
+	// it now expires after the other one.
+	_, err := ob.AmendOrder(first, d(9_000), d(2), 3)
+	assert(t, err, nil)
+	assert(t, first.Timestamp, int64(3))
+	assert(t, len(ob.expiries), 2)
+
+	expired := ob.ExpireOrders(expiresAt)
+	assert(t, len(expired), 2)
+	assert(t, expired[0].Order, second)
+	assert(t, expired[1].Order, first)
+	assert(t, len(ob.expiries), 0)
+}
+
+func TestAmendIcebergOrder(t *testing.T) {
+	ob := newOrderbook()
+
+	iceberg := NewOrder(false, d(10), 0)
+	iceberg.DisplaySize = d(2)
+	ob.PlaceLimitOrder(d(10_000), iceberg)
+
+	_, err := ob.AmendOrder(iceberg, d(10_000), d(7), 1)
+	assert(t, err, nil)
+	assert(t, iceberg.Hidden, d(5))
+	assert(t, ob.AskVisibleVolume(), d(2))
+
+	_, err = ob.AmendOrder(iceberg, d(10_000), d(1), 1)
+	assert(t, err, nil)
+	assert(t, iceberg.Hidden, d(0))
+	assert(t, ob.AskTotalVolume(), d(1))
+	assert(t, ob.AskVisibleVolume(), d(1))
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	tests := []struct {
+		mode         SelfTradePrevention
+		takerSize    int64
+		makerLeft    int64
+		takerLeft    int64
+		matched      int64
+		makerResting bool
+		events       int
+	}{
+		{CancelNewest, 3, 5, 0, 0, true, 1},
+		{CancelOldest, 3, 0, 0, 3, false, 1},
+		{CancelBoth, 3, 0, 0, 0, false, 2},
+		{DecrementAndCancel, 3, 2, 0, 0, true, 2},
+		{DecrementAndCancel, 8, 0, 0, 3, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			ob := newOrderbook()
+			var events []CancelEvent
+			ob.OnCancel = func(e CancelEvent) { events = append(events, e) }
+
+			maker := NewOrder(false, d(5), 1)
+			other := NewOrder(false, d(3), 2)
+			ob.PlaceLimitOrder(d(10_000), maker)
+			ob.PlaceLimitOrder(d(10_000), other)
+
+			taker := NewOrder(true, d(tt.takerSize), 1)
+			taker.SelfTradePrevention = tt.mode
+			matches, err := ob.PlaceMarketOrder(taker)
+			assert(t, err, nil)
+
+			var matched decimal.Decimal
+			for _, m := range matches {
+				assert(t, m.Ask, other)
+				matched = matched.Add(m.SizeFilled)
+			}
+			assert(t, matched, d(tt.matched))
+			assert(t, maker.Limit != nil, tt.makerResting)
+			assert(t, taker.IsFilled(), true)
+			assert(t, len(events), tt.events)
+			for _, e := range events {
+				assert(t, e.Reason, CancelReasonSelfTrade)
+			}
+
+			if tt.makerResting {
+				assert(t, maker.Size, d(tt.makerLeft))
+				assert(t, ob.Orders[maker.ID], maker)
+			} else {
+				_, ok := ob.Orders[maker.ID]
+				assert(t, ok, false)
+			}
+			assert(t, ob.AskTotalVolume(), d(3+tt.makerLeft-tt.matched))
+		})
+	}
+}
+
+func TestSelfTradeAllowedByDefault(t *testing.T) {
+	ob := newOrderbook()
+
+	maker := NewOrder(false, d(5), 1)
+	ob.PlaceLimitOrder(d(10_000), maker)
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, d(2), 1))
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, maker.Size, d(3))
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	now := time.Now()
+
+	ob := newOrderbook()
+	iceberg := NewOrder(false, d(10), 1)
+	iceberg.DisplaySize = d(2)
+	gtd := NewOrder(true, d(3), 2)
+	gtd.TimeInForce = GoodTilDate
+	gtd.ExpiresAt = now.Add(time.Minute).UnixNano()
+
+	ob.PlaceLimitOrder(d(10_000), iceberg)
+	ob.PlaceLimitOrder(d(10_000), NewOrder(false, d(4), 2))
+	ob.PlaceLimitOrder(d(10_100), NewOrder(false, d(1), 3))
+	ob.PlaceLimitOrder(d(9_000), gtd)
+	ob.PlaceMarketOrder(NewOrder(true, d(3), 3))
+	ob.PlaceStopOrder(&StopOrder{Order: NewOrder(true, d(1), 4), StopPrice: d(10_050), Trigger: TriggerLastTrade})
+
+	b, err := json.Marshal(ob.Snapshot(42))
+	assert(t, err, nil)
+	var snap Snapshot
+	assert(t, json.Unmarshal(b, &snap), nil)
+	assert(t, snap.Seq, uint64(42))
+
+	restored := newOrderbook()
+	assert(t, restored.Restore(&snap), nil)
+
+	assert(t, restored.AskTotalVolume(), ob.AskTotalVolume())
+	assert(t, restored.AskVisibleVolume(), ob.AskVisibleVolume())
+	assert(t, restored.BidTotalVolume(), ob.BidTotalVolume())
+	assert(t, restored.LastPrice(), ob.LastPrice())
+	assert(t, len(restored.Orders), len(ob.Orders))
+	assert(t, len(restored.StopOrders()), 1)
+
+	// The queue of the level is restored in time priority, the iceberg
+	// behind the order it was requeued after.
+	limit := restored.AskLimits[decimal.New(10_000_00, 2)]
+	assert(t, len(limit.Orders), 2)
+	assert(t, limit.Orders[1].ID, iceberg.ID)
+	assert(t, limit.Orders[1].Hidden, iceberg.Hidden)
+
+	// Both books behave the same from here on.
+	want, err := ob.PlaceMarketOrder(NewOrder(true, d(10), 5))
+	assert(t, err, nil)
+	got, err := restored.PlaceMarketOrder(NewOrder(true, d(10), 5))
+	assert(t, err, nil)
+	assert(t, len(got), len(want))
+	for i := range want {
+		assert(t, got[i].Ask.ID, want[i].Ask.ID)
+		assert(t, got[i].Price, want[i].Price)
+		assert(t, got[i].SizeFilled, want[i].SizeFilled)
+	}
+	assert(t, len(restored.TriggerStops()), len(ob.TriggerStops()))
+
+	events := restored.ExpireOrders(now.Add(time.Hour))
+	assert(t, len(events), 1)
+	assert(t, events[0].Order.ID, gtd.ID)
+}
+
+func TestRestoreScaleMismatch(t *testing.T) {
+	snap := newOrderbook().Snapshot(1)
+	assert(t, NewOrderbook(4, 8).Restore(snap) != nil, true)
+}
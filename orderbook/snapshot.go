@@ -0,0 +1,159 @@
+package orderbook
+
+import (
+	"fmt"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+// Snapshot is the full state of an orderbook after the command with the
+// sequence number Seq was applied to it. Levels are listed from the best
+// price on and their orders in time priority.
+type Snapshot struct {
+	Seq             uint64
+	PriceScale      uint8
+	SizeScale       uint8
+	TickSize        decimal.Decimal
+	LiquidityPolicy LiquidityPolicy
+	MaxSlippage     decimal.Decimal
+	LastPrice       decimal.Decimal
+	MarkPrice       decimal.Decimal
+	StopSeq         int64
+	Asks            []LevelSnapshot
+	Bids            []LevelSnapshot
+	Stops           []StopSnapshot
+}
+
+// LevelSnapshot holds copies of the orders of a limit, which do not point
+// back to it.
+type LevelSnapshot struct {
+	Price  decimal.Decimal
+	Orders []Order
+}
+
+// StopSnapshot is a pending stop order with its place in the trigger order.
+type StopSnapshot struct {
+	StopOrder
+	Seq int64
+}
+
+// Snapshot returns the state of the book, to be restored with Restore.
+func (ob *Orderbook) Snapshot(seq uint64) *Snapshot {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	s := &Snapshot{
+		Seq:             seq,
+		PriceScale:      ob.PriceScale,
+		SizeScale:       ob.SizeScale,
+		TickSize:        ob.TickSize,
+		LiquidityPolicy: ob.LiquidityPolicy,
+		MaxSlippage:     ob.MaxSlippage,
+		LastPrice:       ob.lastPrice,
+		MarkPrice:       ob.markPrice,
+		StopSeq:         ob.stopSeq,
+		Asks:            snapshotLevels(ob.asks),
+		Bids:            snapshotLevels(ob.bids),
+		Stops:           []StopSnapshot{},
+	}
+
+	for _, stop := range ob.sortedStops() {
+		order := *stop.Order
+		snap := StopSnapshot{StopOrder: *stop, Seq: stop.seq}
+		snap.Order = &order
+		s.Stops = append(s.Stops, snap)
+	}
+
+	return s
+}
+
+func snapshotLevels(pl *priceLevels) []LevelSnapshot {
+	levels := []LevelSnapshot{}
+	pl.Each(func(l *Limit) bool {
+		level := LevelSnapshot{Price: l.Price, Orders: make([]Order, len(l.Orders))}
+		for i, o := range l.Orders {
+			level.Orders[i] = *o
+			level.Orders[i].Limit = nil
+		}
+		levels = append(levels, level)
+		return true
+	})
+	return levels
+}
+
+// Restore replaces the state of the book with the snapshot. OnCancel is kept.
+// The scales of the snapshot must be the ones of the book.
+func (ob *Orderbook) Restore(s *Snapshot) error {
+	if s.PriceScale != ob.PriceScale || s.SizeScale != ob.SizeScale {
+		return fmt.Errorf("snapshot scales [%d/%d] do not match the book [%d/%d]", s.PriceScale, s.SizeScale, ob.PriceScale, ob.SizeScale)
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.asks = newAskLevels()
+	ob.bids = newBidLevels()
+	ob.expiries = nil
+	ob.askVolume = decimal.New(0, ob.SizeScale)
+	ob.bidVolume = decimal.New(0, ob.SizeScale)
+	ob.askVisibleVolume = decimal.New(0, ob.SizeScale)
+	ob.bidVisibleVolume = decimal.New(0, ob.SizeScale)
+	ob.lastPrice = s.LastPrice
+	ob.markPrice = s.MarkPrice
+	ob.stops = make(map[int64]*StopOrder)
+	ob.stopSeq = s.StopSeq
+	ob.TickSize = s.TickSize
+	ob.LiquidityPolicy = s.LiquidityPolicy
+	ob.MaxSlippage = s.MaxSlippage
+	ob.AskLimits = make(map[decimal.Decimal]*Limit)
+	ob.BidLimits = make(map[decimal.Decimal]*Limit)
+	ob.Orders = make(map[int64]*Order)
+
+	for _, level := range s.Asks {
+		ob.restoreLevel(false, level)
+	}
+	for _, level := range s.Bids {
+		ob.restoreLevel(true, level)
+	}
+
+	for _, snap := range s.Stops {
+		stop := snap.StopOrder
+		order := *snap.Order
+		stop.Order = &order
+		stop.seq = snap.Seq
+		ob.stops[order.ID] = &stop
+	}
+
+	return nil
+}
+
+// restoreLevel adds the orders of the level as they are, without matching
+// them and without recomputing the hidden reserve of iceberg orders.
+func (ob *Orderbook) restoreLevel(bid bool, level LevelSnapshot) {
+	limit := NewLimit(level.Price)
+
+	for _, order := range level.Orders {
+		o := order
+		o.Limit = limit
+		limit.Orders = append(limit.Orders, &o)
+		limit.TotalVolume = limit.TotalVolume.Add(o.Size)
+		limit.VisibleVolume = limit.VisibleVolume.Add(o.VisibleSize())
+
+		ob.Orders[o.ID] = &o
+		if o.TimeInForce == GoodTilDate {
+			ob.expiries.push(&o)
+		}
+	}
+
+	if bid {
+		ob.bids.Insert(limit)
+		ob.BidLimits[limit.Price] = limit
+		ob.bidVolume = ob.bidVolume.Add(limit.TotalVolume)
+		ob.bidVisibleVolume = ob.bidVisibleVolume.Add(limit.VisibleVolume)
+	} else {
+		ob.asks.Insert(limit)
+		ob.AskLimits[limit.Price] = limit
+		ob.askVolume = ob.askVolume.Add(limit.TotalVolume)
+		ob.askVisibleVolume = ob.askVisibleVolume.Add(limit.VisibleVolume)
+	}
+}
@@ -0,0 +1,249 @@
+package orderbook
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+// TriggerType is the price a stop order watches.
+type TriggerType string
+
+const (
+	// TriggerLastTrade watches the price of the latest match.
+	TriggerLastTrade TriggerType = "LAST_TRADE"
+	// TriggerBestPrice watches the best ask for buy stops and the best bid
+	// for sell stops.
+	TriggerBestPrice TriggerType = "BEST_PRICE"
+	// TriggerMarkPrice watches the price set with SetMarkPrice.
+	TriggerMarkPrice TriggerType = "MARK_PRICE"
+)
+
+var (
+	ErrStopNotFound     = errors.New("stop order not found")
+	ErrInvalidStopPrice = errors.New("stop price must be positive")
+	ErrInvalidTrigger   = errors.New("invalid stop trigger")
+	ErrStopLimitNoPrice = errors.New("stop limit orders need a positive limit price")
+	ErrInvalidStopSize  = errors.New("stop order size must be positive")
+)
+
+// StopOrder waits outside the book until the price it watches reaches
+// StopPrice: at or above it for buy stops, at or below it for sell stops.
+// It then enters the book as a market order, or as a limit order at
+// LimitPrice when IsLimit is set.
+type StopOrder struct {
+	Order      *Order
+	StopPrice  decimal.Decimal
+	LimitPrice decimal.Decimal
+	IsLimit    bool
+	Trigger    TriggerType
+
+	// seq orders the stops by placement so that triggering is deterministic.
+	seq int64
+}
+
+// StopTrigger is the outcome of a stop order that was triggered.
+type StopTrigger struct {
+	Stop    *StopOrder
+	Matches []Match
+	Err     error
+}
+
+// PlaceStopOrder adds the stop order to the pending stops. It is evaluated
+// with the next call to TriggerStops.
+func (ob *Orderbook) PlaceStopOrder(s *StopOrder) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	s.StopPrice = s.StopPrice.Truncate(ob.PriceScale)
+	s.LimitPrice = s.LimitPrice.Truncate(ob.PriceScale)
+	s.Order.Size = s.Order.Size.Truncate(ob.SizeScale)
+
+	if err := validateStop(s); err != nil {
+		return err
+	}
+
+	ob.stopSeq++
+	s.seq = ob.stopSeq
+	ob.stops[s.Order.ID] = s
+
+	return nil
+}
+
+// AmendStopOrder changes the stop price, limit price and size of a pending
+// stop order. The stop keeps its place in the trigger order.
+func (ob *Orderbook) AmendStopOrder(id int64, stopPrice, limitPrice, size decimal.Decimal) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	s, ok := ob.stops[id]
+	if !ok {
+		return ErrStopNotFound
+	}
+
+	amended := *s
+	amended.StopPrice = stopPrice.Truncate(ob.PriceScale)
+	amended.LimitPrice = limitPrice.Truncate(ob.PriceScale)
+	amendedOrder := *s.Order
+	amendedOrder.Size = size.Truncate(ob.SizeScale)
+	amended.Order = &amendedOrder
+
+	if err := validateStop(&amended); err != nil {
+		return err
+	}
+
+	s.StopPrice = amended.StopPrice
+	s.LimitPrice = amended.LimitPrice
+	s.Order.Size = amendedOrder.Size
+
+	return nil
+}
+
+// CancelStopOrder removes a pending stop order and returns it.
+func (ob *Orderbook) CancelStopOrder(id int64) (*StopOrder, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	s, ok := ob.stops[id]
+	if !ok {
+		return nil, ErrStopNotFound
+	}
+	delete(ob.stops, id)
+
+	return s, nil
+}
+
+// StopOrders returns the pending stop orders in the order they were placed.
+func (ob *Orderbook) StopOrders() []*StopOrder {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.sortedStops()
+}
+
+// HasStopOrder reports whether the stop order with the ID is pending.
+func (ob *Orderbook) HasStopOrder(id int64) bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	_, ok := ob.stops[id]
+	return ok
+}
+
+// SetMarkPrice sets the price watched by TriggerMarkPrice stops.
+func (ob *Orderbook) SetMarkPrice(price decimal.Decimal) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.markPrice = price.Truncate(ob.PriceScale)
+}
+
+// LastPrice returns the price of the latest match, zero if there was none.
+func (ob *Orderbook) LastPrice() decimal.Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.lastPrice
+}
+
+// TriggerStops places every pending stop order whose trigger price has been
+// reached through the same paths as PlaceMarketOrder and PlaceLimitOrder. It
+// is meant to be called after every batch of matches. Stops are triggered one
+// at a time in the order they were placed and the prices are evaluated again
+// after each of them, so cascades always unfold the same way.
+func (ob *Orderbook) TriggerStops() []StopTrigger {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	triggers := []StopTrigger{}
+	for {
+		s := ob.nextTriggeredStop()
+		if s == nil {
+			return triggers
+		}
+		delete(ob.stops, s.Order.ID)
+
+		trigger := StopTrigger{Stop: s}
+		switch err := ob.checkTrigger(s); {
+		case err != nil:
+			ob.emitCancel(s.Order, s.Order.Size, CancelReasonRejected)
+			trigger.Err = err
+		case s.IsLimit:
+			trigger.Matches, trigger.Err = ob.placeLimitOrder(s.LimitPrice, s.Order)
+		default:
+			trigger.Matches, trigger.Err = ob.placeMarketOrder(s.Order)
+		}
+		triggers = append(triggers, trigger)
+	}
+}
+
+// checkTrigger asks OnTrigger whether the triggered stop may enter the book.
+func (ob *Orderbook) checkTrigger(s *StopOrder) error {
+	if ob.OnTrigger == nil {
+		return nil
+	}
+
+	cost := decimal.Zero
+	if s.Order.Bid && !s.IsLimit {
+		var err error
+		if cost, err = ob.marketBuyCost(s.Order); err != nil {
+			return err
+		}
+	}
+	return ob.OnTrigger(s, cost)
+}
+
+func (ob *Orderbook) nextTriggeredStop() *StopOrder {
+	for _, s := range ob.sortedStops() {
+		price, ok := ob.triggerPrice(s)
+		if !ok {
+			continue
+		}
+		if s.Order.Bid && price.GreaterThanOrEqual(s.StopPrice) || !s.Order.Bid && price.LessThanOrEqual(s.StopPrice) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (ob *Orderbook) triggerPrice(s *StopOrder) (decimal.Decimal, bool) {
+	switch s.Trigger {
+	case TriggerBestPrice:
+		if best := ob.bestOpposite(s.Order); best != nil {
+			return best.Price, true
+		}
+		return decimal.Zero, false
+	case TriggerMarkPrice:
+		return ob.markPrice, !ob.markPrice.IsZero()
+	default:
+		return ob.lastPrice, !ob.lastPrice.IsZero()
+	}
+}
+
+func (ob *Orderbook) sortedStops() []*StopOrder {
+	stops := make([]*StopOrder, 0, len(ob.stops))
+	for _, s := range ob.stops {
+		stops = append(stops, s)
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].seq < stops[j].seq })
+	return stops
+}
+
+func validateStop(s *StopOrder) error {
+	switch s.Trigger {
+	case TriggerLastTrade, TriggerBestPrice, TriggerMarkPrice:
+	default:
+		return ErrInvalidTrigger
+	}
+	if !s.StopPrice.IsPositive() {
+		return ErrInvalidStopPrice
+	}
+	if s.IsLimit && !s.LimitPrice.IsPositive() {
+		return ErrStopLimitNoPrice
+	}
+	if !s.Order.Size.IsPositive() {
+		return ErrInvalidStopSize
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+type (
+	DepositRequest struct {
+		UserID int64
+		Asset  Asset
+		Amount decimal.Decimal
+	}
+
+	AccountResponse struct {
+		UserID   int64
+		Balances map[Asset]AssetBalance
+	}
+)
+
+// holdFor returns what an order of the given size needs held at the given
+// price: the size in the base asset for asks, the notional in the quote
+// asset for bids. It fails when the notional overflows.
+func holdFor(assets MarketAssets, bid bool, price, size decimal.Decimal) (Asset, decimal.Decimal, error) {
+	if !bid {
+		return assets.Base, size, nil
+	}
+	notional, err := price.CheckedMul(size)
+	return assets.Quote, notional, err
+}
+
+// holdOrder reserves the funds the order needs before it goes into the book
+// of the market. Stop market bids hold their notional at the stop price.
+func (ex *Exchange) holdOrder(market Market, req *PlaceOrderRequest, order *orderbook.Order) error {
+	var (
+		asset  Asset
+		amount decimal.Decimal
+		err    error
+		assets = ex.marketAssets(market)
+	)
+
+	switch {
+	case req.Type == MarketOrder && order.Bid:
+		asset = assets.Quote
+		amount, err = ex.orderbook(market).MarketBuyCost(order)
+	case req.Type == StopMarketOrder:
+		asset, amount, err = holdFor(assets, order.Bid, req.StopPrice, order.Size)
+	default:
+		asset, amount, err = holdFor(assets, order.Bid, req.Price, order.Size)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ex.ledger.Hold(market, order.ID, order.UserID, asset, amount)
+}
+
+// holdTriggered makes a stop market bid that triggers hold what filling it
+// costs with the book as it is, it was only held at its stop price. It is
+// called from OnTrigger of the book, so a bid that cannot be afforded is
+// cancelled before it fills.
+func (ex *Exchange) holdTriggered(market Market, s *orderbook.StopOrder, cost decimal.Decimal) error {
+	if !s.Order.Bid || s.IsLimit {
+		return nil
+	}
+	extra := cost.Sub(ex.ledger.HoldOf(s.Order.ID))
+	if !extra.IsPositive() {
+		return nil
+	}
+	return ex.ledger.Hold(market, s.Order.ID, s.Order.UserID, ex.marketAssets(market).Quote, extra)
+}
+
+// syncHold brings what is held for the order in line with what is left of
+// it: nothing once it is out of the book, its size or notional while it
+// rests.
+func (ex *Exchange) syncHold(market Market, order *orderbook.Order) {
+	assets := ex.marketAssets(market)
+	asset, required := assets.Base, decimal.Zero
+	if order.Limit != nil {
+		var err error
+		if asset, required, err = holdFor(assets, order.Bid, order.Limit.Price, order.Size); err != nil {
+			log.Printf("hold order => %d | err [%v]", order.ID, err)
+			return
+		}
+	}
+
+	held := ex.ledger.HoldOf(order.ID)
+	switch held.Cmp(required) {
+	case 1:
+		if err := ex.ledger.Release(order.ID, held.Sub(required)); err != nil {
+			log.Printf("release order => %d | err [%v]", order.ID, err)
+		}
+	case -1:
+		if err := ex.ledger.Hold(market, order.ID, order.UserID, asset, required.Sub(held)); err != nil {
+			log.Printf("hold order => %d | err [%v]", order.ID, err)
+		}
+	}
+}
+
+// releaseBeyond releases what is held for the order beyond keep.
+func (ex *Exchange) releaseBeyond(orderID int64, keep decimal.Decimal) {
+	if err := ex.ledger.Release(orderID, ex.ledger.HoldOf(orderID).Sub(keep)); err != nil {
+		log.Printf("release order => %d | err [%v]", orderID, err)
+	}
+}
+
+// settleMatches moves the funds of the matches between the users in the
+// ledger, charges their fees and releases what their orders no longer need.
+// The book already made the matches, so one the ledger refuses leaves the
+// two apart: the market is halted until an operator reconciled them and
+// trades it again, and ErrUnsettled is returned.
+func (ex *Exchange) settleMatches(market Market, matches []orderbook.Match) error {
+	cfg, _ := ex.MarketConfig(market)
+	var unsettled error
+	for _, match := range matches {
+		bidFee, askFee, err := cfg.fees(match)
+		if err == nil {
+			err = ex.ledger.Settle(market, cfg.Assets(), match, bidFee, askFee)
+		}
+		if err != nil {
+			log.Printf("settle match => ask %d | bid %d | err [%v]", match.Ask.ID, match.Bid.ID, err)
+			if unsettled == nil {
+				unsettled = fmt.Errorf("%w: orders %d and %d: %v", ErrUnsettled, match.Ask.ID, match.Bid.ID, err)
+			}
+		}
+	}
+	for _, match := range matches {
+		ex.syncHold(market, match.Ask)
+		ex.syncHold(market, match.Bid)
+	}
+
+	if unsettled != nil {
+		ex.restoreMarketStatus(market, MarketHalted)
+		log.Printf("market status => %s | status [%s] | err [%v]", market, MarketHalted, unsettled)
+	}
+	return unsettled
+}
+
+// Deposit credits the user in the ledger and journals it like a command.
+func (ex *Exchange) Deposit(req DepositRequest) error {
+	ex.commandsMu.Lock()
+	defer ex.commandsMu.Unlock()
+
+	if ex.journal != nil {
+		cmd := Command{Type: DepositCommand, Timestamp: time.Now().UnixNano(), Deposit: &req}
+		if err := ex.journal.Append(&cmd); err != nil {
+			return err
+		}
+	}
+
+	return ex.ledger.Deposit(req.UserID, req.Asset, req.Amount)
+}
+
+func (ex *Exchange) handleDeposit(c echo.Context) error {
+	var req DepositRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	if _, ok := ex.Users[req.UserID]; !ok {
+		return invalid(fmt.Errorf("%w: %d", ErrUserNotFound, req.UserID))
+	}
+
+	scale, ok := ex.ledger.Scale(req.Asset)
+	if !ok {
+		return invalid(fmt.Errorf("%w: %s", ErrUnknownAsset, req.Asset))
+	}
+	amount, err := req.Amount.Rescale(scale)
+	if err != nil || !amount.IsPositive() {
+		return newError(http.StatusBadRequest, CodeInvalidRequest, "invalid amount: %s", req.Amount)
+	}
+	req.Amount = amount
+
+	if err := ex.Deposit(req); err != nil {
+		return err
+	}
+
+	log.Printf("deposit => user [%d] | asset [%s] | amount [%s]", req.UserID, req.Asset, req.Amount)
+
+	return c.JSON(http.StatusOK, &AccountResponse{UserID: req.UserID, Balances: ex.ledger.Balances(req.UserID)})
+}
+
+func (ex *Exchange) handleGetAccount(c echo.Context) error {
+	userID, err := intParam(c, "userID")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &AccountResponse{UserID: userID, Balances: ex.ledger.Balances(userID)})
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+// maxClientOrderIDLength is the longest ClientOrderID accepted.
+const maxClientOrderIDLength = 64
+
+// ClientOrder is what the exchange remembers of an order placed with a
+// ClientOrderID. Status and Response are the reply to the first placement,
+// which is sent again for every resubmission.
+type ClientOrder struct {
+	UserID        int64
+	ClientOrderID string
+	OrderID       int64
+	Market        Market
+	Status        int
+	Response      json.RawMessage
+}
+
+// ClientOrderResponse resolves a ClientOrderID. Order is only set while the
+// order rests in the book.
+type ClientOrderResponse struct {
+	ClientOrderID string
+	OrderID       int64
+	Market        Market
+	Order         *Order
+}
+
+// newOrderID returns the next order ID of the exchange.
+func (ex *Exchange) newOrderID() int64 {
+	return ex.lastOrderID.Add(1)
+}
+
+// observeOrderID makes sure the exchange never hands out the ID again. It is
+// only used while recovering.
+func (ex *Exchange) observeOrderID(id int64) {
+	if id > ex.lastOrderID.Load() {
+		ex.lastOrderID.Store(id)
+	}
+}
+
+func (ex *Exchange) clientOrder(userID int64, clientOrderID string) (*ClientOrder, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	co, ok := ex.clientOrders[userID][clientOrderID]
+	return co, ok
+}
+
+func (ex *Exchange) addClientOrder(co *ClientOrder) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if ex.clientOrders[co.UserID] == nil {
+		ex.clientOrders[co.UserID] = make(map[string]*ClientOrder)
+	}
+	ex.clientOrders[co.UserID][co.ClientOrderID] = co
+}
+
+// placeOrderOnce places the order of the command unless the user already
+// placed one with the same ClientOrderID. A resubmission changes nothing and
+// only gets the ClientOrder of the first placement back.
+func (ex *Exchange) placeOrderOnce(cmd Command) CommandResult {
+	req := cmd.Order
+	if req.ClientOrderID == "" {
+		return ex.placeOrder(cmd)
+	}
+
+	if co, ok := ex.clientOrder(req.UserID, req.ClientOrderID); ok {
+		log.Printf("duplicate order => user [%d] | client order id [%s] | order [%d]", req.UserID, req.ClientOrderID, co.OrderID)
+		return CommandResult{Duplicate: co}
+	}
+
+	res := ex.placeOrder(cmd)
+
+	status, reply := placeOrderReply(res)
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return CommandResult{Order: res.Order, Matches: res.Matches, Err: err}
+	}
+	ex.addClientOrder(&ClientOrder{
+		UserID:        req.UserID,
+		ClientOrderID: req.ClientOrderID,
+		OrderID:       cmd.OrderID,
+		Market:        cmd.Market,
+		Status:        status,
+		Response:      b,
+	})
+
+	return res
+}
+
+// clientOrdersOf returns the ClientOrders placed in the market.
+func (ex *Exchange) clientOrdersOf(market Market) []*ClientOrder {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	clientOrders := []*ClientOrder{}
+	for _, userOrders := range ex.clientOrders {
+		for _, co := range userOrders {
+			if co.Market == market {
+				clientOrders = append(clientOrders, co)
+			}
+		}
+	}
+	return clientOrders
+}
+
+// resolveClientOrder finds the ClientOrder named in the path among the
+// orders placed in the market of the path.
+func (ex *Exchange) resolveClientOrder(c echo.Context) (*ClientOrder, error) {
+	market := Market(c.Param("market"))
+	if _, ok := ex.market(market); !ok {
+		return nil, marketNotFound(market)
+	}
+	userID, err := intParam(c, "userID")
+	if err != nil {
+		return nil, err
+	}
+
+	co, ok := ex.clientOrder(userID, c.Param("clientOrderID"))
+	if !ok || co.Market != market {
+		return nil, invalid(fmt.Errorf("%w: client order %q", orderbook.ErrOrderNotFound, c.Param("clientOrderID")))
+	}
+	return co, nil
+}
+
+func (ex *Exchange) handleGetClientOrder(c echo.Context) error {
+	co, err := ex.resolveClientOrder(c)
+	if err != nil {
+		return err
+	}
+
+	resp := &ClientOrderResponse{
+		ClientOrderID: co.ClientOrderID,
+		OrderID:       co.OrderID,
+		Market:        co.Market,
+	}
+	for _, order := range ex.engine(co.Market).Snapshot().Orders[co.UserID] {
+		if order.ID == co.OrderID {
+			order := order
+			resp.Order = &order
+			break
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) handleCancelClientOrder(c echo.Context) error {
+	co, err := ex.resolveClientOrder(c)
+	if err != nil {
+		return err
+	}
+
+	res := ex.submit(Command{Type: CancelOrderCommand, Market: co.Market, OrderID: co.OrderID})
+	if res.Err != nil {
+		return invalid(res.Err)
+	}
+
+	log.Printf("order canceled id => %d | client order id [%s]", co.OrderID, co.ClientOrderID)
+	return c.JSON(http.StatusOK, map[string]any{"msg": "Order deleted"})
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+// engineQueueSize is how many commands can wait for the engine of a market
+// before senders block.
+const engineQueueSize = 1024
+
+type CommandType string
+
+const (
+	PlaceOrderCommand   CommandType = "PLACE_ORDER"
+	CancelOrderCommand  CommandType = "CANCEL_ORDER"
+	AmendOrderCommand   CommandType = "AMEND_ORDER"
+	AmendStopCommand    CommandType = "AMEND_STOP"
+	CancelStopCommand   CommandType = "CANCEL_STOP"
+	SetMarkPriceCommand CommandType = "SET_MARK_PRICE"
+	ExpireOrdersCommand CommandType = "EXPIRE_ORDERS"
+	AddUserCommand      CommandType = "ADD_USER"
+	DepositCommand      CommandType = "DEPOSIT"
+	// AddMarketCommand opens a market, SetMarketStatusCommand halts it or
+	// lets it trade again.
+	AddMarketCommand       CommandType = "ADD_MARKET"
+	SetMarketStatusCommand CommandType = "SET_MARKET_STATUS"
+	// RejectOrderCommand records an order that was refused before it
+	// reached the engine, it never gets to the book.
+	RejectOrderCommand CommandType = "REJECT_ORDER"
+)
+
+// Command is a change to the orderbook of a market, or the addition of a
+// user or a market. Prices and sizes are already rescaled to the scales of the book.
+type Command struct {
+	// Seq is the position of the command in the journal, 0 until it was
+	// written to it.
+	Seq    uint64
+	Type   CommandType
+	Market Market
+	// Timestamp is the unix time in nanoseconds at which the command was
+	// accepted. Placed orders get it as their timestamp and expiry runs at it.
+	Timestamp int64
+	// Order is the order to place, or the order that was rejected as it was
+	// sent and Reason why it was.
+	Order  *PlaceOrderRequest
+	Reason string `json:",omitempty"`
+	// OrderID is the ID of the order to place or that was rejected, or the
+	// order or stop order to cancel or amend.
+	OrderID int64
+	// Price is the new price of an amended order, the new limit price of an
+	// amended stop limit order or the mark price.
+	Price     decimal.Decimal
+	Size      decimal.Decimal
+	StopPrice decimal.Decimal
+	// User is the user to add.
+	User *UserData
+	// Deposit is the deposit to credit.
+	Deposit *DepositRequest
+	// MarketConfig is the market to add and Status the new status of the
+	// market.
+	MarketConfig *MarketConfig
+	Status       MarketStatus
+}
+
+// CommandResult holds the order a command placed or changed, every match it
+// caused, including the ones of triggered stop orders, and the reason the
+// command was refused. Matches can be set together with an error when a
+// market order was only partially filled. Duplicate is set instead when an
+// order was placed again with a ClientOrderID that was already used.
+// TradeIDs are the IDs of the trades of the matches in the trade store.
+type CommandResult struct {
+	Seq       uint64
+	Order     *orderbook.Order
+	Matches   []orderbook.Match
+	TradeIDs  []int64
+	Err       error
+	Duplicate *ClientOrder
+}
+
+// BookSnapshot is the state of an orderbook right after the command with the
+// journal sequence number Seq was applied, Seq is 0 without a journal. It is never changed once published, so
+// readers can use it without holding any lock.
+type BookSnapshot struct {
+	Seq       uint64
+	Book      OrderbookData
+	LastPrice decimal.Decimal
+	// Orders maps a user to their resting orders, with the full size.
+	Orders map[int64][]Order
+	Stops  []*StopOrder
+}
+
+func newBookSnapshot(seq uint64, ob *orderbook.Orderbook) *BookSnapshot {
+	snap := &BookSnapshot{
+		Seq: seq,
+		Book: OrderbookData{
+			TotalBidVolume:   ob.BidTotalVolume(),
+			TotalAskVolume:   ob.AskTotalVolume(),
+			VisibleBidVolume: ob.BidVisibleVolume(),
+			VisibleAskVolume: ob.AskVisibleVolume(),
+			Asks:             []*Order{},
+			Bids:             []*Order{},
+		},
+		LastPrice: ob.LastPrice(),
+		Orders:    make(map[int64][]Order),
+		Stops:     []*StopOrder{},
+	}
+
+	for _, limit := range ob.Asks() {
+		for _, order := range limit.Orders {
+			snap.Book.Asks = append(snap.Book.Asks, NewOrder(limit.Price, order))
+			snap.addUserOrder(limit.Price, order)
+		}
+	}
+	for _, limit := range ob.Bids() {
+		for _, order := range limit.Orders {
+			snap.Book.Bids = append(snap.Book.Bids, NewOrder(limit.Price, order))
+			snap.addUserOrder(limit.Price, order)
+		}
+	}
+	for _, stop := range ob.StopOrders() {
+		snap.Stops = append(snap.Stops, NewStopOrder(stop))
+	}
+
+	return snap
+}
+
+func (s *BookSnapshot) addUserOrder(price decimal.Decimal, order *orderbook.Order) {
+	o := NewOrder(price, order)
+	o.Size = order.Size
+	s.Orders[order.UserID] = append(s.Orders[order.UserID], *o)
+}
+
+// BestBid returns the best bid price, or false when there are no bids.
+func (s *BookSnapshot) BestBid() (decimal.Decimal, bool) {
+	if len(s.Book.Bids) == 0 {
+		return decimal.Decimal{}, false
+	}
+	return s.Book.Bids[0].Price, true
+}
+
+// BestAsk returns the best ask price, or false when there are no asks.
+func (s *BookSnapshot) BestAsk() (decimal.Decimal, bool) {
+	if len(s.Book.Asks) == 0 {
+		return decimal.Decimal{}, false
+	}
+	return s.Book.Asks[0].Price, true
+}
+
+type engineRequest struct {
+	cmd  Command
+	done chan CommandResult
+}
+
+// engine is the only writer of the orderbook of a market. It applies the
+// commands sent to it one at a time, in the order they were sent, and
+// publishes a new BookSnapshot after each of them.
+type engine struct {
+	market   Market
+	ob       *orderbook.Orderbook
+	apply    func(Command) CommandResult
+	requests chan engineRequest
+	seq      uint64
+	snapshot atomic.Pointer[BookSnapshot]
+}
+
+func newEngine(market Market, ob *orderbook.Orderbook, apply func(Command) CommandResult) *engine {
+	e := &engine{
+		market:   market,
+		ob:       ob,
+		apply:    apply,
+		requests: make(chan engineRequest, engineQueueSize),
+	}
+	e.snapshot.Store(newBookSnapshot(e.seq, ob))
+
+	go e.run()
+
+	return e
+}
+
+func (e *engine) run() {
+	for req := range e.requests {
+		res := e.safeApply(req.cmd)
+		if res.Seq != 0 {
+			e.seq = res.Seq
+		}
+
+		// Publish before answering, so the sender sees its own change.
+		e.snapshot.Store(newBookSnapshot(e.seq, e.ob))
+
+		req.done <- res
+	}
+}
+
+// safeApply applies the command and turns a panic while doing so into an
+// error, so one bad command cannot stop the engine of the market.
+func (e *engine) safeApply(cmd Command) (res CommandResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("apply command => market %s | seq %d | panic [%v]", e.market, cmd.Seq, r)
+			res = CommandResult{Seq: cmd.Seq, Err: fmt.Errorf("apply command: %v", r)}
+		}
+	}()
+	return e.apply(cmd)
+}
+
+// reset publishes the book again, as of the sequence number seq, after it
+// was restored. It must not be called while the engine applies commands.
+func (e *engine) reset(seq uint64) {
+	e.seq = seq
+	e.snapshot.Store(newBookSnapshot(e.seq, e.ob))
+}
+
+// submit sends the command to the engine and waits until it was applied.
+func (e *engine) submit(cmd Command) CommandResult {
+	done := make(chan CommandResult, 1)
+	e.requests <- engineRequest{cmd: cmd, done: done}
+	return <-done
+}
+
+// Snapshot returns the state of the book after the last applied command.
+func (e *engine) Snapshot() *BookSnapshot {
+	return e.snapshot.Load()
+}
+
+// submit stamps the command and hands it to the engine of its market.
+func (ex *Exchange) submit(cmd Command) CommandResult {
+	e := ex.engine(cmd.Market)
+	if e == nil {
+		return CommandResult{Err: fmt.Errorf("%w: %s", ErrMarketNotFound, cmd.Market)}
+	}
+
+	cmd.Timestamp = time.Now().UnixNano()
+	if cmd.Type == PlaceOrderCommand || cmd.Type == RejectOrderCommand {
+		cmd.OrderID = ex.newOrderID()
+	}
+	return e.submit(cmd)
+}
+
+// apply writes the command to the journal, unless it came from there, and
+// runs it. Every snapshotEvery commands of all engines it writes a snapshot
+// once the command ran. It is only called by the engine of the market of the
+// command.
+func (ex *Exchange) apply(cmd Command) CommandResult {
+	res := ex.run(cmd)
+
+	if ex.snapshotDir != "" && res.Seq != 0 && ex.applied.Add(1)%int64(ex.snapshotEvery) == 0 {
+		if err := ex.snapshot(); err != nil {
+			log.Printf("snapshot failed: %v", err)
+		}
+	}
+
+	return res
+}
+
+// run writes the command to the journal, unless it came from there, and
+// runs it before any other command gets a seq.
+func (ex *Exchange) run(cmd Command) CommandResult {
+	ex.commandsMu.Lock()
+	defer ex.commandsMu.Unlock()
+
+	if cmd.Seq == 0 && ex.journal != nil {
+		if err := ex.journal.Append(&cmd); err != nil {
+			return CommandResult{Err: fmt.Errorf("journal: %w", err)}
+		}
+	}
+
+	res := ex.execute(cmd)
+	res.Seq = cmd.Seq
+	res.TradeIDs = ex.recordTrades(cmd, res)
+	if m, ok := ex.market(cmd.Market); ok {
+		m.history.record(cmd, res)
+	}
+
+	return res
+}
+
+// execute runs the command against the orderbook of its market.
+func (ex *Exchange) execute(cmd Command) CommandResult {
+	switch cmd.Type {
+	case PlaceOrderCommand:
+		return ex.placeOrderOnce(cmd)
+	case CancelOrderCommand:
+		return ex.cancelOrder(cmd)
+	case AmendOrderCommand:
+		return ex.amendOrder(cmd)
+	case AmendStopCommand:
+		return ex.amendStopOrder(cmd)
+	case CancelStopCommand:
+		return ex.cancelStopOrder(cmd)
+	case SetMarkPriceCommand:
+		return ex.setMarkPrice(cmd)
+	case SetMarketStatusCommand:
+		return ex.setMarketStatus(cmd)
+	case ExpireOrdersCommand:
+		ex.orderbook(cmd.Market).ExpireOrders(time.Unix(0, cmd.Timestamp))
+		return CommandResult{}
+	case RejectOrderCommand:
+		// Only the order history keeps it.
+		return CommandResult{}
+	}
+
+	return CommandResult{Err: fmt.Errorf("unknown command: %q", cmd.Type)}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+const (
+	CodeMalformedRequest      ErrorCode = "MALFORMED_REQUEST"
+	CodeInvalidRequest        ErrorCode = "INVALID_REQUEST"
+	CodeMarketNotFound        ErrorCode = "MARKET_NOT_FOUND"
+	CodeOrderNotFound         ErrorCode = "ORDER_NOT_FOUND"
+	CodeStopOrderNotFound     ErrorCode = "STOP_ORDER_NOT_FOUND"
+	CodeUserNotFound          ErrorCode = "USER_NOT_FOUND"
+	CodeSettlementNotFound    ErrorCode = "SETTLEMENT_NOT_FOUND"
+	CodeNoPrice               ErrorCode = "NO_PRICE"
+	CodeRouteNotFound         ErrorCode = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed      ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeMarketExists          ErrorCode = "MARKET_EXISTS"
+	CodeSettlementNotFailed   ErrorCode = "SETTLEMENT_NOT_FAILED"
+	CodeMarketHalted          ErrorCode = "MARKET_HALTED"
+	CodeUnknownAsset          ErrorCode = "UNKNOWN_ASSET"
+	CodeInsufficientBalance   ErrorCode = "INSUFFICIENT_BALANCE"
+	CodeInsufficientLiquidity ErrorCode = "INSUFFICIENT_LIQUIDITY"
+	CodePostOnlyWouldCross    ErrorCode = "POST_ONLY_WOULD_CROSS"
+	CodeInternal              ErrorCode = "INTERNAL"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+type ErrorCode string
+
+// Error is the body of every error reply of the exchange. Status is the HTTP
+// status it is sent with, Details are set by some codes, like the fill of a
+// market order that ran out of liquidity.
+type Error struct {
+	Status  int `json:"-"`
+	Code    ErrorCode
+	Message string
+	Details map[string]any `json:",omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is reports whether the error is the reply to target, so errors decoded
+// from a reply still match the errors of the exchange.
+func (e *Error) Is(target error) bool {
+	for _, known := range knownErrors {
+		if known.code == e.Code && known.err == target {
+			return true
+		}
+	}
+	return false
+}
+
+func newError(status int, code ErrorCode, format string, args ...any) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// knownErrors are the errors of the exchange a reply has a code for.
+var knownErrors = []struct {
+	err    error
+	status int
+	code   ErrorCode
+}{
+	{ErrMarketNotFound, http.StatusNotFound, CodeMarketNotFound},
+	{orderbook.ErrOrderNotFound, http.StatusNotFound, CodeOrderNotFound},
+	{orderbook.ErrStopNotFound, http.StatusNotFound, CodeStopOrderNotFound},
+	{ErrUserNotFound, http.StatusNotFound, CodeUserNotFound},
+	{ErrSettlementNotFound, http.StatusNotFound, CodeSettlementNotFound},
+	{ErrMarketExists, http.StatusConflict, CodeMarketExists},
+	{ErrSettlementNotFailed, http.StatusConflict, CodeSettlementNotFailed},
+	{ErrMarketHalted, http.StatusBadRequest, CodeMarketHalted},
+	{ErrUnknownAsset, http.StatusBadRequest, CodeUnknownAsset},
+	{ErrInsufficientBalance, http.StatusBadRequest, CodeInsufficientBalance},
+	{orderbook.ErrPostOnlyWouldCross, http.StatusBadRequest, CodePostOnlyWouldCross},
+	{ErrUnsettled, http.StatusInternalServerError, CodeInternal},
+}
+
+// toError returns the reply to err, or nil when err is not an error of the
+// exchange.
+func toError(err error) *Error {
+	var (
+		apiErr       *Error
+		liquidityErr *orderbook.InsufficientLiquidityError
+		httpErr      *echo.HTTPError
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &liquidityErr):
+		e := newError(http.StatusUnprocessableEntity, CodeInsufficientLiquidity, "%s", liquidityErr)
+		e.Details = map[string]any{
+			"OrderID":   liquidityErr.OrderID,
+			"Requested": liquidityErr.Requested,
+			"Filled":    liquidityErr.Filled,
+			"AvgPrice":  liquidityErr.AvgPrice,
+		}
+		return e
+	case errors.As(err, &httpErr):
+		// Echo's own errors, like routes that do not exist.
+		code := CodeInvalidRequest
+		switch httpErr.Code {
+		case http.StatusNotFound:
+			code = CodeRouteNotFound
+		case http.StatusMethodNotAllowed:
+			code = CodeMethodNotAllowed
+		}
+		return newError(httpErr.Code, code, "%v", httpErr.Message)
+	}
+
+	for _, known := range knownErrors {
+		if errors.Is(err, known.err) {
+			return newError(known.status, known.code, "%s", err)
+		}
+	}
+	return nil
+}
+
+// invalid returns the reply to a request the exchange refused because of
+// err. Errors of the exchange keep their own code.
+func invalid(err error) *Error {
+	if e := toError(err); e != nil {
+		return e
+	}
+	return newError(http.StatusBadRequest, CodeInvalidRequest, "%s", err)
+}
+
+func marketNotFound(symbol Market) *Error {
+	return newError(http.StatusNotFound, CodeMarketNotFound, "%s: %s", ErrMarketNotFound, symbol)
+}
+
+func stopNotFound(id int64) *Error {
+	return newError(http.StatusNotFound, CodeStopOrderNotFound, "%s: %d", orderbook.ErrStopNotFound, id)
+}
+
+// bind decodes the JSON body of the request into v.
+func bind(c echo.Context, v any) error {
+	if err := json.NewDecoder(c.Request().Body).Decode(v); err != nil {
+		return newError(http.StatusBadRequest, CodeMalformedRequest, "invalid body: %v", err)
+	}
+	return nil
+}
+
+// intParam returns the path parameter name as an integer.
+func intParam(c echo.Context, name string) (int64, error) {
+	v, err := strconv.ParseInt(c.Param(name), 10, 64)
+	if err != nil {
+		return 0, newError(http.StatusBadRequest, CodeInvalidRequest, "invalid %s: %q", name, c.Param(name))
+	}
+	return v, nil
+}
+
+// intQuery returns the query parameter name as an integer, 0 when it is not
+// set.
+func intQuery(c echo.Context, name string) (int64, error) {
+	if c.QueryParam(name) == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(c.QueryParam(name), 10, 64)
+	if err != nil {
+		return 0, newError(http.StatusBadRequest, CodeInvalidRequest, "invalid %s: %q", name, c.QueryParam(name))
+	}
+	return v, nil
+}
+
+// httpErrorHandler replies with the JSON body of the error. Errors that are
+// not errors of the exchange are logged and replied to as INTERNAL.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	e := toError(err)
+	if e == nil {
+		log.Printf("%s %s => err [%v]", c.Request().Method, c.Request().URL.Path, err)
+		e = newError(http.StatusInternalServerError, CodeInternal, "internal error")
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(e.Status)
+	} else {
+		err = c.JSON(e.Status, e)
+	}
+	if err != nil {
+		log.Printf("%s %s => reply err [%v]", c.Request().Method, c.Request().URL.Path, err)
+	}
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+const (
+	// NEW and PARTIALLY_FILLED orders are open, they rest in the book or wait
+	// for their stop price. The other statuses are final.
+	OrderNew             OrderStatus = "NEW"
+	OrderPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	OrderFilled          OrderStatus = "FILLED"
+	OrderCancelled       OrderStatus = "CANCELLED"
+	OrderRejected        OrderStatus = "REJECTED"
+	OrderExpired         OrderStatus = "EXPIRED"
+
+	// defaultHistoryLimit is how many orders a page of the order history has
+	// unless the request asks for fewer, up to maxHistoryLimit.
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+
+	// maxFinalOrders is how many final orders the history of a market keeps,
+	// older ones are dropped from it, and from its snapshots, first.
+	maxFinalOrders = 10_000
+)
+
+type OrderStatus string
+
+func (s OrderStatus) valid() bool {
+	switch s {
+	case OrderNew, OrderPartiallyFilled, OrderFilled, OrderCancelled, OrderRejected, OrderExpired:
+		return true
+	}
+	return false
+}
+
+func (s OrderStatus) open() bool {
+	return s == OrderNew || s == OrderPartiallyFilled
+}
+
+// OrderRecord is an order of a user from the moment it was placed, whether
+// it was accepted or not. Size is the size filled plus what is still open,
+// FilledNotional the price times size of the fills in the quote asset.
+// Reason tells why a REJECTED or CANCELLED order was. Times are unix times in
+// nanoseconds.
+type OrderRecord struct {
+	ID             int64
+	UserID         int64
+	ClientOrderID  string
+	Market         Market
+	Type           OrderType
+	Bid            bool
+	Price          decimal.Decimal // only set for limit and stop limit orders.
+	StopPrice      decimal.Decimal // only set for stop orders.
+	Size           decimal.Decimal
+	FilledSize     decimal.Decimal
+	FilledNotional decimal.Decimal
+	AvgPrice       decimal.Decimal
+	Status         OrderStatus
+	Reason         string
+	CreatedAt      int64
+	UpdatedAt      int64
+}
+
+// OrderHistoryQuery picks the orders of a user in the order history. Zero
+// fields do not filter. Orders are placed at or after From and before To.
+// Pages go from the newest order to the oldest, Cursor is the NextCursor of
+// the previous page.
+type OrderHistoryQuery struct {
+	Market Market
+	Status []OrderStatus
+	From   int64
+	To     int64
+	Cursor int64
+	Limit  int
+}
+
+func (q *OrderHistoryQuery) match(rec *OrderRecord) bool {
+	if q.Cursor != 0 && rec.ID >= q.Cursor {
+		return false
+	}
+	if q.From != 0 && rec.CreatedAt < q.From || q.To != 0 && rec.CreatedAt >= q.To {
+		return false
+	}
+	if len(q.Status) == 0 {
+		return true
+	}
+	for _, status := range q.Status {
+		if rec.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderHistoryResponse is a page of the order history, the newest order
+// first. NextCursor is 0 on the last page.
+type OrderHistoryResponse struct {
+	Orders     []*OrderRecord
+	NextCursor int64
+}
+
+// historyOrder is an order a command touched, with the reason it was
+// cancelled for, if it was.
+type historyOrder struct {
+	order  *orderbook.Order
+	reason orderbook.CancelReason
+}
+
+// orderHistory keeps the open orders of a market and the last keep orders
+// that became final, in the order they did. The engine of the market
+// is its only writer: it collects the orders a command touches while
+// applying it, and records what became of them once it is done.
+type orderHistory struct {
+	ob      *orderbook.Orderbook
+	mu      sync.RWMutex
+	orders  map[int64]*OrderRecord
+	byUser  map[int64][]*OrderRecord
+	touched map[int64]*historyOrder
+	final   []int64
+	keep    int
+}
+
+func newOrderHistory(ob *orderbook.Orderbook) *orderHistory {
+	return &orderHistory{
+		ob:      ob,
+		keep:    maxFinalOrders,
+		orders:  make(map[int64]*OrderRecord),
+		byUser:  make(map[int64][]*OrderRecord),
+		touched: make(map[int64]*historyOrder),
+	}
+}
+
+func (h *orderHistory) touch(o *orderbook.Order) *historyOrder {
+	t, ok := h.touched[o.ID]
+	if !ok {
+		t = &historyOrder{order: o}
+		h.touched[o.ID] = t
+	}
+	return t
+}
+
+// cancelled notes the reason an order left the book for. It is called from
+// OnCancel of the book.
+func (h *orderHistory) cancelled(event orderbook.CancelEvent) {
+	h.touch(event.Order).reason = event.Reason
+}
+
+func (h *orderHistory) add(rec *OrderRecord) {
+	h.orders[rec.ID] = rec
+	// Users mostly place orders in the order of their IDs.
+	userOrders := h.byUser[rec.UserID]
+	i := sort.Search(len(userOrders), func(i int) bool { return userOrders[i].ID > rec.ID })
+	userOrders = append(userOrders, nil)
+	copy(userOrders[i+1:], userOrders[i:])
+	userOrders[i] = rec
+	h.byUser[rec.UserID] = userOrders
+}
+
+// finish notes the orders that became final, by ID so that replaying the
+// journal drops the same orders, and drops the oldest final orders beyond
+// keep.
+func (h *orderHistory) finish(ids []int64) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	h.final = append(h.final, ids...)
+
+	for len(h.final) > h.keep {
+		rec := h.orders[h.final[0]]
+		h.final = h.final[1:]
+		delete(h.orders, rec.ID)
+
+		userOrders := h.byUser[rec.UserID]
+		i := sort.Search(len(userOrders), func(i int) bool { return userOrders[i].ID >= rec.ID })
+		userOrders = append(userOrders[:i], userOrders[i+1:]...)
+		if len(userOrders) == 0 {
+			delete(h.byUser, rec.UserID)
+			continue
+		}
+		h.byUser[rec.UserID] = userOrders
+	}
+}
+
+// placed returns the record of the order the command placed or rejected.
+func (h *orderHistory) placed(cmd Command) *OrderRecord {
+	req := cmd.Order
+	return &OrderRecord{
+		ID:             cmd.OrderID,
+		UserID:         req.UserID,
+		ClientOrderID:  req.ClientOrderID,
+		Market:         cmd.Market,
+		Type:           req.Type,
+		Bid:            req.Bid,
+		Price:          req.Price,
+		StopPrice:      req.StopPrice,
+		Size:           req.Size,
+		FilledSize:     decimal.New(0, h.ob.SizeScale),
+		FilledNotional: decimal.New(0, h.ob.PriceScale+h.ob.SizeScale),
+		AvgPrice:       decimal.New(0, h.ob.PriceScale),
+		Status:         OrderNew,
+		CreatedAt:      cmd.Timestamp,
+	}
+}
+
+// record updates the orders the command placed, amended, filled or
+// cancelled.
+func (h *orderHistory) record(cmd Command, res CommandResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	defer func() { h.touched = make(map[int64]*historyOrder) }()
+
+	switch cmd.Type {
+	case PlaceOrderCommand:
+		if res.Order == nil || res.Duplicate != nil {
+			return
+		}
+		h.add(h.placed(cmd))
+		h.touch(res.Order)
+	case RejectOrderCommand:
+		rec := h.placed(cmd)
+		rec.Status = OrderRejected
+		rec.Reason = cmd.Reason
+		rec.UpdatedAt = cmd.Timestamp
+		h.add(rec)
+		h.finish([]int64{rec.ID})
+	case AmendOrderCommand:
+		// The book amended the order even when the ledger refused its
+		// matches.
+		if rec, ok := h.orders[cmd.OrderID]; ok && (res.Err == nil || errors.Is(res.Err, ErrUnsettled)) {
+			rec.Price = cmd.Price
+			rec.Size = rec.FilledSize.Add(cmd.Size)
+			h.touch(res.Order)
+		}
+	case AmendStopCommand:
+		if rec, ok := h.orders[cmd.OrderID]; ok && res.Err == nil {
+			rec.StopPrice = cmd.StopPrice
+			if rec.Type == StopLimitOrder {
+				rec.Price = cmd.Price
+			}
+			rec.Size = cmd.Size
+			rec.UpdatedAt = cmd.Timestamp
+		}
+	case CancelStopCommand:
+		// The stop left the book even when its hold was not released.
+		if res.Order != nil {
+			h.touch(res.Order).reason = orderbook.CancelReasonUser
+		}
+	}
+
+	for _, match := range res.Matches {
+		for _, o := range []*orderbook.Order{match.Ask, match.Bid} {
+			rec, ok := h.orders[o.ID]
+			if !ok {
+				continue
+			}
+			rec.FilledSize = rec.FilledSize.Add(match.SizeFilled)
+			rec.FilledNotional = rec.FilledNotional.Add(match.Price.Mul(match.SizeFilled))
+			rec.AvgPrice = rec.FilledNotional.Div(rec.FilledSize, h.ob.PriceScale)
+			h.touch(o)
+		}
+	}
+
+	var finished []int64
+	for id, t := range h.touched {
+		rec, ok := h.orders[id]
+		if !ok {
+			continue
+		}
+		rec.UpdatedAt = cmd.Timestamp
+		open := rec.Status.open()
+
+		switch {
+		case t.order.Limit != nil:
+			// Post-only orders may rest at another price than they asked for.
+			rec.Price = t.order.Limit.Price
+			rec.Status = OrderNew
+			if rec.FilledSize.IsPositive() {
+				rec.Status = OrderPartiallyFilled
+			}
+		case h.ob.HasStopOrder(id):
+			rec.Status = OrderNew
+		case cmd.Type == PlaceOrderCommand && id == cmd.OrderID && res.Err != nil && rec.FilledSize.IsZero():
+			rec.Status = OrderRejected
+			rec.Reason = res.Err.Error()
+		case t.reason == orderbook.CancelReasonExpired:
+			rec.Status = OrderExpired
+		case t.reason == orderbook.CancelReasonRejected:
+			rec.Status = OrderRejected
+			rec.Reason = string(t.reason)
+		case t.reason != "":
+			rec.Status = OrderCancelled
+			rec.Reason = string(t.reason)
+		default:
+			rec.Status = OrderFilled
+		}
+
+		if open && !rec.Status.open() {
+			finished = append(finished, id)
+		}
+	}
+	h.finish(finished)
+}
+
+// query returns the orders of the user that match the query, the newest
+// first, at most limit of them.
+func (h *orderHistory) query(userID int64, q *OrderHistoryQuery, limit int) []*OrderRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var records []*OrderRecord
+	userOrders := h.byUser[userID]
+	for i := len(userOrders) - 1; i >= 0 && len(records) < limit; i-- {
+		if q.match(userOrders[i]) {
+			rec := *userOrders[i]
+			records = append(records, &rec)
+		}
+	}
+	return records
+}
+
+// snapshot returns a copy of the open orders by ID, followed by the final
+// ones in the order they became final.
+func (h *orderHistory) snapshot() []*OrderRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	records := make([]*OrderRecord, 0, len(h.orders))
+	for _, rec := range h.orders {
+		if rec.Status.open() {
+			rec := *rec
+			records = append(records, &rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	for _, id := range h.final {
+		rec := *h.orders[id]
+		records = append(records, &rec)
+	}
+	return records
+}
+
+func (h *orderHistory) restore(records []*OrderRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.orders = make(map[int64]*OrderRecord, len(records))
+	h.byUser = make(map[int64][]*OrderRecord)
+	h.final = nil
+	// Snapshots list the final orders in the order they became final.
+	for _, rec := range records {
+		h.add(rec)
+		if !rec.Status.open() {
+			h.final = append(h.final, rec.ID)
+		}
+	}
+	h.finish(nil)
+}
+
+// pageLimit returns how many entries a page asked for with limit has, the
+// default when it is 0.
+func pageLimit(limit, max int) (int, error) {
+	switch {
+	case limit == 0:
+		return defaultHistoryLimit, nil
+	case limit < 0 || limit > max:
+		return 0, fmt.Errorf("limit must be between 1 and %d", max)
+	}
+	return limit, nil
+}
+
+// OrderHistory returns a page of the orders the user placed.
+func (ex *Exchange) OrderHistory(userID int64, q OrderHistoryQuery) (*OrderHistoryResponse, error) {
+	limit, err := pageLimit(q.Limit, maxHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range q.Status {
+		if !status.valid() {
+			return nil, fmt.Errorf("invalid order status: %q", status)
+		}
+	}
+
+	markets := ex.marketList()
+	if q.Market != "" {
+		m, ok := ex.market(q.Market)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrMarketNotFound, q.Market)
+		}
+		markets = []*market{m}
+	}
+
+	// One more than the page tells whether there is a next one.
+	var records []*OrderRecord
+	for _, m := range markets {
+		records = append(records, m.history.query(userID, &q, limit+1)...)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID > records[j].ID })
+
+	resp := &OrderHistoryResponse{Orders: []*OrderRecord{}}
+	if len(records) > limit {
+		records = records[:limit]
+		resp.NextCursor = records[limit-1].ID
+	}
+	resp.Orders = append(resp.Orders, records...)
+
+	return resp, nil
+}
+
+// handleGetOrderHistory returns the orders of the user, filtered by the
+// market, status, from and to query parameters and paged by cursor and
+// limit. Several statuses are separated by commas.
+func (ex *Exchange) handleGetOrderHistory(c echo.Context) error {
+	userID, err := intParam(c, "userID")
+	if err != nil {
+		return err
+	}
+
+	q := OrderHistoryQuery{Market: Market(c.QueryParam("market"))}
+	if status := c.QueryParam("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			q.Status = append(q.Status, OrderStatus(s))
+		}
+	}
+	for name, v := range map[string]*int64{"from": &q.From, "to": &q.To, "cursor": &q.Cursor} {
+		if *v, err = intQuery(c, name); err != nil {
+			return err
+		}
+	}
+	limit, err := intQuery(c, "limit")
+	if err != nil {
+		return err
+	}
+	q.Limit = int(limit)
+
+	resp, err := ex.OrderHistory(userID, q)
+	if err != nil {
+		return invalid(err)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+// maxJournalLine is the longest command the journal can read back.
+const maxJournalLine = 1 << 20
+
+// Journal is the write-ahead log of the exchange. Every accepted command is
+// written to it as one JSON line, with the next sequence number, before it is
+// applied, so replaying the journal rebuilds the exchange.
+type Journal struct {
+	mu  sync.Mutex
+	f   *os.File
+	seq uint64
+}
+
+// OpenJournal opens the journal at path for appending and creates it when it
+// does not exist. Sequence numbers continue after the last command in it.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{}
+
+	err := ReadJournal(path, func(cmd Command) error {
+		j.seq = cmd.Seq
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if j.f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Append stamps the command with the next sequence number and writes it.
+func (j *Journal) Append(cmd *Command) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	cmd.Seq = j.seq + 1
+	b, err := json.Marshal(cmd)
+	if err == nil {
+		_, err = j.f.Write(append(b, '\n'))
+	}
+	// The command runs once Append returns, it has to be on disk by then.
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		cmd.Seq = 0
+		return err
+	}
+
+	j.seq++
+	return nil
+}
+
+// Seq returns the sequence number of the last command written.
+func (j *Journal) Seq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.seq
+}
+
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// ReadJournal calls fn with every command of the journal at path, in order,
+// and stops at the first error.
+func ReadJournal(path string, fn func(Command) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJournalLine)
+
+	for line := 1; scanner.Scan(); line++ {
+		var cmd Command
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			return fmt.Errorf("journal %s line %d: %w", path, line, err)
+		}
+		if err := fn(cmd); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Replay applies the commands of the journal at path, up to and including the
+// sequence number to, or all of them when to is 0. Replayed commands are not
+// written to the journal again. fn, when set, is called with the result of
+// every command from the sequence number from on.
+func (ex *Exchange) Replay(path string, from, to uint64, fn func(Command, CommandResult)) error {
+	return ReadJournal(path, func(cmd Command) error {
+		if to != 0 && cmd.Seq > to {
+			return nil
+		}
+
+		res := ex.replay(cmd)
+		if fn != nil && cmd.Seq >= from {
+			fn(cmd, res)
+		}
+		return nil
+	})
+}
+
+func (ex *Exchange) replay(cmd Command) CommandResult {
+	if cmd.Type == PlaceOrderCommand || cmd.Type == RejectOrderCommand {
+		ex.observeOrderID(cmd.OrderID)
+	}
+	if cmd.Type == AddUserCommand {
+		_, err := ex.addUser(*cmd.User)
+		return CommandResult{Seq: cmd.Seq, Err: err}
+	}
+	if cmd.Type == DepositCommand {
+		err := ex.ledger.Deposit(cmd.Deposit.UserID, cmd.Deposit.Asset, cmd.Deposit.Amount)
+		return CommandResult{Seq: cmd.Seq, Err: err}
+	}
+	if cmd.Type == AddMarketCommand {
+		err := ex.addMarket(*cmd.MarketConfig)
+		return CommandResult{Seq: cmd.Seq, Err: err}
+	}
+
+	e := ex.engine(cmd.Market)
+	if e == nil {
+		return CommandResult{Seq: cmd.Seq, Err: fmt.Errorf("%w: %s", ErrMarketNotFound, cmd.Market)}
+	}
+	return e.submit(cmd)
+}
+
+// Recover rebuilds the exchange from the latest valid snapshot in snapshotDir
+// and the commands of the journal at path that came after it. All markets are
+// restored as of the same command, so the balances their commands are checked
+// against are the ones they saw. Users, deposits and markets are not part of
+// the snapshots, they are always replayed. Markets added by the journal are
+// restored once they are added. With a durable outbox, the replayed matches
+// it misses are queued for settlement. From then on every new command is
+// written to the journal and the markets are snapshotted into snapshotDir.
+func (ex *Exchange) Recover(path, snapshotDir string) error {
+	if err := os.MkdirAll(snapshotDir, 0o700); err != nil {
+		return err
+	}
+
+	durable := ex.outbox.Durable()
+	snap, err := LatestSnapshot(snapshotDir)
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	if snap != nil {
+		seq = snap.Seq
+	}
+	restore := func(market Market) error {
+		if snap == nil || snap.market(market) == nil {
+			return nil
+		}
+		return ex.restoreMarket(snap.market(market))
+	}
+	for _, m := range ex.marketList() {
+		if err := restore(m.config.Symbol); err != nil {
+			return err
+		}
+	}
+
+	err = ReadJournal(path, func(cmd Command) error {
+		switch cmd.Type {
+		case AddUserCommand, DepositCommand:
+		case AddMarketCommand:
+			if res := ex.replay(cmd); res.Err != nil || cmd.Seq > seq {
+				return nil
+			}
+			return restore(cmd.Market)
+		default:
+			if cmd.Seq <= seq {
+				return nil
+			}
+		}
+		res := ex.replay(cmd)
+		// Queue the settlements of matches that were journaled but never made
+		// it to the outbox, the outbox skips the ones it has.
+		if durable {
+			return ex.handleMatches(cmd.Market, res)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	journal, err := OpenJournal(path)
+	if err != nil {
+		return err
+	}
+	// Never hand out a sequence number a snapshot already covers, even when
+	// the journal is behind it.
+	if seq > journal.seq {
+		journal.seq = seq
+	}
+
+	ex.journal = journal
+	ex.snapshotDir = snapshotDir
+
+	return nil
+}
+
+// ReplayJournal replays the journal at path on an empty exchange with the
+// given markets that settles nothing and calls fn with the matches of every
+// command between the sequence numbers from and to, both included.
+func ReplayJournal(path string, markets []MarketConfig, from, to uint64, fn func(Command, []orderbook.Match)) error {
+	ex, err := NewExchange(exchangePrivateKey, nil, markets)
+	if err != nil {
+		return err
+	}
+
+	return ex.Replay(path, from, to, func(cmd Command, res CommandResult) {
+		fn(cmd, res.Matches)
+	})
+}
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+const (
+	AssetETH Asset = "ETH"
+	AssetUSD Asset = "USD"
+
+	// AvailableAccount holds what a user can spend, HeldAccount what is
+	// reserved for their open orders and ExternalAccount mirrors what came
+	// into the exchange from outside, so it only ever goes negative.
+	// FeeAccount collects the fees of the exchange, it belongs to no user
+	// and has UserID 0.
+	AvailableAccount AccountType = "AVAILABLE"
+	HeldAccount      AccountType = "HELD"
+	ExternalAccount  AccountType = "EXTERNAL"
+	FeeAccount       AccountType = "FEE"
+
+	// depositBook is the book deposits are posted to, it belongs to no market.
+	depositBook Market = ""
+)
+
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrUnbalancedEntry     = errors.New("unbalanced ledger entry")
+	// ErrUnsettled is a match the book made that the ledger refused, which
+	// halts its market.
+	ErrUnsettled = errors.New("match not settled in the ledger")
+)
+
+type (
+	Asset       string
+	AccountType string
+
+	// MarketAssets are the assets of a market: Base is bought and sold, and
+	// paid for with Quote.
+	MarketAssets struct {
+		Base  Asset
+		Quote Asset
+	}
+
+	Account struct {
+		UserID int64
+		Asset  Asset
+		Type   AccountType
+	}
+
+	// Posting credits Amount to Account, a negative Amount debits it. The
+	// postings of one entry add up to zero for every asset.
+	Posting struct {
+		Account Account
+		Amount  decimal.Decimal
+	}
+
+	// Hold is what is reserved in the held account of a user for one order.
+	Hold struct {
+		OrderID int64
+		UserID  int64
+		Market  Market
+		Asset   Asset
+		Amount  decimal.Decimal
+	}
+
+	AssetBalance struct {
+		Available decimal.Decimal
+		Held      decimal.Decimal
+	}
+
+	// LedgerSnapshot is what a market posted to the ledger and the holds of
+	// its open orders.
+	LedgerSnapshot struct {
+		Balances []Posting
+		Holds    []*Hold
+	}
+)
+
+// Ledger keeps the balances of the users with double-entry postings. Every
+// market posts to a book of its own, so it can be snapshotted with the
+// market, and the balance of an account is the sum of all books.
+type Ledger struct {
+	mu    sync.Mutex
+	books map[Market]map[Account]decimal.Decimal
+	holds map[int64]*Hold
+	// scales are the decimals the ledger keeps of every asset it knows.
+	// Quote assets are paid in notionals, price times size, and keep all
+	// the decimals of both.
+	scales map[Asset]uint8
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		books:  make(map[Market]map[Account]decimal.Decimal),
+		holds:  make(map[int64]*Hold),
+		scales: make(map[Asset]uint8),
+	}
+}
+
+// AddAsset makes the ledger keep the asset with at least scale decimals.
+func (l *Ledger) AddAsset(asset Asset, scale uint8) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if current, ok := l.scales[asset]; !ok || scale > current {
+		l.scales[asset] = scale
+	}
+}
+
+// Scale returns the decimals the ledger keeps of the asset, or false when it
+// does not know it.
+func (l *Ledger) Scale(asset Asset) (uint8, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	scale, ok := l.scales[asset]
+	return scale, ok
+}
+
+// Balance returns the balance of the account over all books.
+func (l *Ledger) Balance(account Account) decimal.Decimal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.balance(account)
+}
+
+// Balances returns the available and held balance of every asset of the user.
+func (l *Ledger) Balances(userID int64) map[Asset]AssetBalance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	balances := make(map[Asset]AssetBalance)
+	for asset, scale := range l.scales {
+		balances[asset] = AssetBalance{
+			Available: l.balance(Account{UserID: userID, Asset: asset, Type: AvailableAccount}).Truncate(scale),
+			Held:      l.balance(Account{UserID: userID, Asset: asset, Type: HeldAccount}).Truncate(scale),
+		}
+	}
+	return balances
+}
+
+// Post writes the entry to the book of the market. It fails when the entry
+// is not balanced or would overdraw an account of a user.
+func (l *Ledger) Post(market Market, postings ...Posting) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.post(market, true, postings)
+}
+
+// Deposit credits the user with amount of the asset.
+func (l *Ledger) Deposit(userID int64, asset Asset, amount decimal.Decimal) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("invalid deposit amount: %s", amount)
+	}
+
+	return l.Post(depositBook,
+		Posting{Account: Account{UserID: userID, Asset: asset, Type: ExternalAccount}, Amount: amount.Neg()},
+		Posting{Account: Account{UserID: userID, Asset: asset, Type: AvailableAccount}, Amount: amount},
+	)
+}
+
+// Hold moves amount of the asset of the user from available to held for the
+// order.
+func (l *Ledger) Hold(market Market, orderID, userID int64, asset Asset, amount decimal.Decimal) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !amount.IsPositive() {
+		return nil
+	}
+	hold, ok := l.holds[orderID]
+	if ok && hold.Asset != asset {
+		return fmt.Errorf("order %d already holds %s", orderID, hold.Asset)
+	}
+
+	err := l.post(market, true, []Posting{
+		{Account: Account{UserID: userID, Asset: asset, Type: AvailableAccount}, Amount: amount.Neg()},
+		{Account: Account{UserID: userID, Asset: asset, Type: HeldAccount}, Amount: amount},
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		hold = &Hold{OrderID: orderID, UserID: userID, Market: market, Asset: asset, Amount: decimal.Zero}
+		l.holds[orderID] = hold
+	}
+	hold.Amount = hold.Amount.Add(amount)
+
+	return nil
+}
+
+// HoldOf returns what is held for the order.
+func (l *Ledger) HoldOf(orderID int64) decimal.Decimal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if hold, ok := l.holds[orderID]; ok {
+		return hold.Amount
+	}
+	return decimal.Zero
+}
+
+// Release moves up to amount of what is held for the order back to available.
+func (l *Ledger) Release(orderID int64, amount decimal.Decimal) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hold, ok := l.holds[orderID]
+	if !ok || !amount.IsPositive() {
+		return nil
+	}
+	amount = decimal.Min(amount, hold.Amount)
+
+	err := l.post(hold.Market, false, []Posting{
+		{Account: Account{UserID: hold.UserID, Asset: hold.Asset, Type: HeldAccount}, Amount: amount.Neg()},
+		{Account: Account{UserID: hold.UserID, Asset: hold.Asset, Type: AvailableAccount}, Amount: amount},
+	})
+	if err != nil {
+		return err
+	}
+	l.consume(hold, amount)
+	return nil
+}
+
+// Settle moves the base asset of the match from the seller to the buyer and
+// its notional in the quote asset from the buyer to the seller. Both are
+// paid from the hold of their order first, anything beyond it from their
+// available balance, which must cover it. The buyer pays bidFee out of the
+// base asset they receive, the seller askFee out of the quote asset. All
+// legs are posted together, an error leaves the ledger as it was.
+func (l *Ledger) Settle(market Market, assets MarketAssets, match orderbook.Match, bidFee, askFee decimal.Decimal) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	notional, err := match.Price.CheckedMul(match.SizeFilled)
+	if err != nil {
+		return err
+	}
+
+	askPostings, askHold, fromAskHold := l.pay(match.Ask, assets.Base, match.SizeFilled, match.Bid.UserID)
+	bidPostings, bidHold, fromBidHold := l.pay(match.Bid, assets.Quote, notional, match.Ask.UserID)
+	postings := append(askPostings, bidPostings...)
+	postings = append(postings, feePostings(match.Bid.UserID, assets.Base, bidFee)...)
+	postings = append(postings, feePostings(match.Ask.UserID, assets.Quote, askFee)...)
+
+	if err := l.post(market, true, postings); err != nil {
+		return fmt.Errorf("match of orders %d and %d: %w", match.Ask.ID, match.Bid.ID, err)
+	}
+	if askHold != nil {
+		l.consume(askHold, fromAskHold)
+	}
+	if bidHold != nil {
+		l.consume(bidHold, fromBidHold)
+	}
+	return nil
+}
+
+// pay returns the postings paying amount of the asset for the order to the
+// user, and the hold of the order they take fromHold out of.
+func (l *Ledger) pay(order *orderbook.Order, asset Asset, amount decimal.Decimal, to int64) ([]Posting, *Hold, decimal.Decimal) {
+	fromHold := decimal.Zero
+	hold, ok := l.holds[order.ID]
+	if ok && hold.Asset == asset {
+		fromHold = decimal.Min(amount, hold.Amount)
+	} else {
+		hold = nil
+	}
+
+	postings := []Posting{
+		{Account: Account{UserID: to, Asset: asset, Type: AvailableAccount}, Amount: amount},
+		{Account: Account{UserID: order.UserID, Asset: asset, Type: HeldAccount}, Amount: fromHold.Neg()},
+	}
+	if rest := amount.Sub(fromHold); rest.IsPositive() {
+		postings = append(postings, Posting{Account: Account{UserID: order.UserID, Asset: asset, Type: AvailableAccount}, Amount: rest.Neg()})
+	}
+	return postings, hold, fromHold
+}
+
+// feePostings returns the postings moving the fee from the available balance of the
+// user to the fee account. It is only charged out of what the user just
+// received.
+func feePostings(userID int64, asset Asset, fee decimal.Decimal) []Posting {
+	if !fee.IsPositive() {
+		return nil
+	}
+	return []Posting{
+		{Account: Account{UserID: userID, Asset: asset, Type: AvailableAccount}, Amount: fee.Neg()},
+		{Account: Account{Asset: asset, Type: FeeAccount}, Amount: fee},
+	}
+}
+
+func (l *Ledger) consume(hold *Hold, amount decimal.Decimal) {
+	hold.Amount = hold.Amount.Sub(amount)
+	if !hold.Amount.IsPositive() {
+		delete(l.holds, hold.OrderID)
+	}
+}
+
+func (l *Ledger) balance(account Account) decimal.Decimal {
+	balance := decimal.Zero
+	for _, book := range l.books {
+		balance = balance.Add(book[account])
+	}
+	return balance
+}
+
+func (l *Ledger) post(market Market, checkFunds bool, postings []Posting) error {
+	sums := make(map[Asset]decimal.Decimal)
+	for i, posting := range postings {
+		scale, ok := l.scales[posting.Account.Asset]
+		if !ok {
+			return fmt.Errorf("unknown asset: %s", posting.Account.Asset)
+		}
+		amount, err := posting.Amount.Rescale(scale)
+		if err != nil {
+			return fmt.Errorf("%s amount: %w", posting.Account.Asset, err)
+		}
+		postings[i].Amount = amount
+		if sums[posting.Account.Asset], err = sums[posting.Account.Asset].CheckedAdd(amount); err != nil {
+			return fmt.Errorf("%s amount: %w", posting.Account.Asset, err)
+		}
+	}
+	for asset, sum := range sums {
+		if !sum.IsZero() {
+			return fmt.Errorf("%w: %s is off by %s", ErrUnbalancedEntry, asset, sum)
+		}
+	}
+
+	// Neither the book nor the balance over all books may overflow, so the
+	// change to every account is checked before any of them is written.
+	changes := make(map[Account]decimal.Decimal, len(postings))
+	for _, posting := range postings {
+		change, err := changes[posting.Account].CheckedAdd(posting.Amount)
+		if err != nil {
+			return fmt.Errorf("%s %s of user %d: %w", posting.Account.Type, posting.Account.Asset, posting.Account.UserID, err)
+		}
+		changes[posting.Account] = change
+	}
+	book := l.books[market]
+	for account, change := range changes {
+		balance := l.balance(account)
+		after, err := balance.CheckedAdd(change)
+		if err == nil {
+			_, err = book[account].CheckedAdd(change)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s of user %d: %w", account.Type, account.Asset, account.UserID, err)
+		}
+		if checkFunds && account.Type != ExternalAccount && change.IsNegative() && after.IsNegative() {
+			return fmt.Errorf("%w: %s %s of user %d is %s, needs %s", ErrInsufficientBalance,
+				account.Type, account.Asset, account.UserID, balance, change.Neg())
+		}
+	}
+
+	if book == nil {
+		book = make(map[Account]decimal.Decimal)
+		l.books[market] = book
+	}
+	for account, change := range changes {
+		book[account] = book[account].Add(change)
+	}
+
+	return nil
+}
+
+// Snapshot returns what the market posted and the holds of its orders.
+func (l *Ledger) Snapshot(market Market) *LedgerSnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := &LedgerSnapshot{Balances: []Posting{}, Holds: []*Hold{}}
+	for account, amount := range l.books[market] {
+		s.Balances = append(s.Balances, Posting{Account: account, Amount: amount})
+	}
+	for _, hold := range l.holds {
+		if hold.Market == market {
+			h := *hold
+			s.Holds = append(s.Holds, &h)
+		}
+	}
+
+	// Keep snapshots of the same state identical.
+	sort.Slice(s.Balances, func(i, j int) bool {
+		a, b := s.Balances[i].Account, s.Balances[j].Account
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		if a.Asset != b.Asset {
+			return a.Asset < b.Asset
+		}
+		return a.Type < b.Type
+	})
+	sort.Slice(s.Holds, func(i, j int) bool { return s.Holds[i].OrderID < s.Holds[j].OrderID })
+
+	return s
+}
+
+// Restore replaces the book and the holds of the market with the snapshot.
+func (l *Ledger) Restore(market Market, s *LedgerSnapshot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	book := make(map[Account]decimal.Decimal)
+	for _, posting := range s.Balances {
+		book[posting.Account] = posting.Amount
+	}
+	l.books[market] = book
+
+	for id, hold := range l.holds {
+		if hold.Market == market {
+			delete(l.holds, id)
+		}
+	}
+	for _, hold := range s.Holds {
+		h := *hold
+		l.holds[h.OrderID] = &h
+	}
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+const (
+	// Orders are only placed and amended in TRADING markets. HALTED markets
+	// keep their books, only take cancels and trigger no stop orders.
+	MarketTrading MarketStatus = "TRADING"
+	MarketHalted  MarketStatus = "HALTED"
+)
+
+var (
+	ErrMarketNotFound = errors.New("market not found")
+	ErrMarketExists   = errors.New("market already exists")
+	ErrMarketHalted   = errors.New("market is not trading")
+)
+
+// marketSymbol is what a market symbol looks like. Symbols go into paths and
+// snapshot file names, so they are kept to upper case letters and digits.
+var marketSymbol = regexp.MustCompile(`^[A-Z0-9]{1,16}$`)
+
+type MarketStatus string
+
+// MarketConfig is a trading pair: Base is bought and sold, and paid for with
+// Quote. Prices are multiples of TickSize and sizes multiples of LotSize,
+// their decimals are the decimals the book keeps. Orders are between
+// MinSize and MaxSize, priced at most MaxPrice and worth between
+// MinNotional and MaxNotional in Quote, a zero MaxSize, MaxPrice,
+// MinNotional or MaxNotional does not limit them. MakerFee and TakerFee are the
+// shares of what they receive the maker and the taker of a trade pay.
+type MarketConfig struct {
+	Symbol      Market
+	Base        Asset
+	Quote       Asset
+	TickSize    decimal.Decimal
+	LotSize     decimal.Decimal
+	MinSize     decimal.Decimal
+	MaxSize     decimal.Decimal
+	MaxPrice    decimal.Decimal
+	MinNotional decimal.Decimal
+	MaxNotional decimal.Decimal
+	MakerFee    decimal.Decimal
+	TakerFee    decimal.Decimal
+	Status      MarketStatus
+}
+
+// ETHMarket trades ETH for USD, quoted in cents with sizes down to 1e-8 ETH
+// and orders worth between 1 and 100,000,000 USD. USD is kept with 10
+// decimals in it, which leaves room for about 900,000,000 USD.
+func ETHMarket() MarketConfig {
+	return MarketConfig{
+		Symbol:      MarketETH,
+		Base:        AssetETH,
+		Quote:       AssetUSD,
+		TickSize:    decimal.New(1, ethPriceScale),
+		LotSize:     decimal.New(1, ethSizeScale),
+		MinSize:     decimal.New(1, ethSizeScale),
+		MaxSize:     decimal.NewFromInt(1_000_000),
+		MaxPrice:    decimal.NewFromInt(10_000_000),
+		MinNotional: decimal.NewFromInt(1),
+		MaxNotional: decimal.NewFromInt(100_000_000),
+		Status:      MarketTrading,
+	}
+}
+
+func (m MarketConfig) PriceScale() uint8 { return m.TickSize.Scale() }
+func (m MarketConfig) SizeScale() uint8  { return m.LotSize.Scale() }
+
+// NotionalScale is the decimals of price times size, which the quote asset
+// is kept with.
+func (m MarketConfig) NotionalScale() uint8 { return m.PriceScale() + m.SizeScale() }
+
+func (m MarketConfig) Assets() MarketAssets {
+	return MarketAssets{Base: m.Base, Quote: m.Quote}
+}
+
+// Validate checks the market can be traded, a missing status is TRADING.
+func (m MarketConfig) Validate() error {
+	switch {
+	case !marketSymbol.MatchString(string(m.Symbol)):
+		return fmt.Errorf("invalid market symbol %q: use 1 to 16 upper case letters and digits", m.Symbol)
+	case m.Base == "" || m.Quote == "" || m.Base == m.Quote:
+		return fmt.Errorf("a market needs two different assets")
+	case !m.TickSize.IsPositive() || !m.LotSize.IsPositive():
+		return fmt.Errorf("tick size and lot size must be positive")
+	case int(m.PriceScale())+int(m.SizeScale()) > decimal.MaxScale:
+		return fmt.Errorf("tick size and lot size have more than %d decimals together", decimal.MaxScale)
+	case m.MinSize.IsNegative() || m.MaxSize.IsNegative() || m.MaxPrice.IsNegative() || m.MinNotional.IsNegative() || m.MaxNotional.IsNegative():
+		return fmt.Errorf("min size, max size, max price, min notional and max notional cannot be negative")
+	case !m.MaxSize.IsZero() && m.MaxSize.LessThan(m.MinSize):
+		return fmt.Errorf("max size is below min size")
+	case !m.MaxNotional.IsZero() && m.MaxNotional.LessThan(m.MinNotional):
+		return fmt.Errorf("max notional is below min notional")
+	case m.MakerFee.IsNegative() || m.TakerFee.IsNegative():
+		return fmt.Errorf("fees cannot be negative")
+	case !m.MakerFee.LessThan(decimal.NewFromInt(1)) || !m.TakerFee.LessThan(decimal.NewFromInt(1)):
+		return fmt.Errorf("fees must be below 1")
+	case int(m.NotionalScale())+int(m.MakerFee.Scale()) > decimal.MaxScale || int(m.NotionalScale())+int(m.TakerFee.Scale()) > decimal.MaxScale:
+		return fmt.Errorf("fees have more than %d decimals together with a notional", decimal.MaxScale)
+	}
+
+	if _, err := m.MinSize.Rescale(m.SizeScale()); err != nil {
+		return fmt.Errorf("min size: %w", err)
+	}
+	if _, err := m.MaxSize.Rescale(m.SizeScale()); err != nil {
+		return fmt.Errorf("max size: %w", err)
+	}
+
+	switch m.Status {
+	case "", MarketTrading, MarketHalted:
+	default:
+		return fmt.Errorf("invalid market status: %q", m.Status)
+	}
+
+	return nil
+}
+
+// market is a trading pair of the exchange with the book of its orders, the
+// engine that is the only writer of the book and every order placed in it.
+type market struct {
+	config  MarketConfig
+	ob      *orderbook.Orderbook
+	engine  *engine
+	history *orderHistory
+}
+
+type SetMarketStatusRequest struct {
+	Status MarketStatus
+}
+
+// AddMarket opens a market and journals it like a command.
+func (ex *Exchange) AddMarket(cfg MarketConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if _, ok := ex.market(cfg.Symbol); ok {
+		return fmt.Errorf("%w: %s", ErrMarketExists, cfg.Symbol)
+	}
+
+	ex.commandsMu.Lock()
+	defer ex.commandsMu.Unlock()
+
+	if ex.journal != nil {
+		cmd := Command{Type: AddMarketCommand, Market: cfg.Symbol, Timestamp: time.Now().UnixNano(), MarketConfig: &cfg}
+		if err := ex.journal.Append(&cmd); err != nil {
+			return fmt.Errorf("journal: %w", err)
+		}
+	}
+
+	return ex.addMarket(cfg)
+}
+
+func (ex *Exchange) addMarket(cfg MarketConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Status == "" {
+		cfg.Status = MarketTrading
+	}
+
+	ex.marketsMu.Lock()
+	defer ex.marketsMu.Unlock()
+
+	if _, ok := ex.markets[cfg.Symbol]; ok {
+		return fmt.Errorf("%w: %s", ErrMarketExists, cfg.Symbol)
+	}
+
+	// The ledger keeps an asset with the most decimals any market needs.
+	ex.ledger.AddAsset(cfg.Base, cfg.SizeScale())
+	ex.ledger.AddAsset(cfg.Quote, cfg.NotionalScale())
+
+	symbol := cfg.Symbol
+	ob := orderbook.NewOrderbook(cfg.PriceScale(), cfg.SizeScale())
+	history := newOrderHistory(ob)
+	ob.OnCancel = func(event orderbook.CancelEvent) {
+		history.cancelled(event)
+		ex.handleCancelEvent(symbol, event)
+	}
+	ob.OnTrigger = func(s *orderbook.StopOrder, cost decimal.Decimal) error {
+		return ex.holdTriggered(symbol, s, cost)
+	}
+	ex.markets[symbol] = &market{
+		config:  cfg,
+		ob:      ob,
+		engine:  newEngine(symbol, ob, ex.apply),
+		history: history,
+	}
+
+	return nil
+}
+
+func (ex *Exchange) market(symbol Market) (*market, bool) {
+	ex.marketsMu.RLock()
+	defer ex.marketsMu.RUnlock()
+
+	m, ok := ex.markets[symbol]
+	return m, ok
+}
+
+// orderbook returns the book of the market, nil when there is no such market.
+func (ex *Exchange) orderbook(symbol Market) *orderbook.Orderbook {
+	if m, ok := ex.market(symbol); ok {
+		return m.ob
+	}
+	return nil
+}
+
+// engine returns the engine of the market, nil when there is no such market.
+func (ex *Exchange) engine(symbol Market) *engine {
+	if m, ok := ex.market(symbol); ok {
+		return m.engine
+	}
+	return nil
+}
+
+// marketList returns the markets by symbol.
+func (ex *Exchange) marketList() []*market {
+	ex.marketsMu.RLock()
+	defer ex.marketsMu.RUnlock()
+
+	list := make([]*market, 0, len(ex.markets))
+	for _, m := range ex.markets {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].config.Symbol < list[j].config.Symbol })
+	return list
+}
+
+// MarketConfig returns the config of the market with its current status.
+func (ex *Exchange) MarketConfig(symbol Market) (MarketConfig, bool) {
+	ex.marketsMu.RLock()
+	defer ex.marketsMu.RUnlock()
+
+	m, ok := ex.markets[symbol]
+	if !ok {
+		return MarketConfig{}, false
+	}
+	return m.config, true
+}
+
+// Markets returns the config of every market, by symbol.
+func (ex *Exchange) Markets() []MarketConfig {
+	ex.marketsMu.RLock()
+	defer ex.marketsMu.RUnlock()
+
+	configs := make([]MarketConfig, 0, len(ex.markets))
+	for _, m := range ex.markets {
+		configs = append(configs, m.config)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Symbol < configs[j].Symbol })
+	return configs
+}
+
+// marketAssets returns the assets the market trades.
+func (ex *Exchange) marketAssets(symbol Market) MarketAssets {
+	cfg, _ := ex.MarketConfig(symbol)
+	return cfg.Assets()
+}
+
+// trading reports whether the market takes new orders.
+func (ex *Exchange) trading(symbol Market) bool {
+	cfg, ok := ex.MarketConfig(symbol)
+	return ok && cfg.Status == MarketTrading
+}
+
+// setMarketStatus changes the status of the market of the command. Stop
+// orders that were reached while it was halted trigger once it trades again.
+func (ex *Exchange) setMarketStatus(cmd Command) CommandResult {
+	ex.restoreMarketStatus(cmd.Market, cmd.Status)
+
+	log.Printf("market status => %s | status [%s]", cmd.Market, cmd.Status)
+
+	return CommandResult{Matches: ex.triggerStops(cmd.Market)}
+}
+
+func (ex *Exchange) restoreMarketStatus(symbol Market, status MarketStatus) {
+	ex.marketsMu.Lock()
+	defer ex.marketsMu.Unlock()
+
+	if m, ok := ex.markets[symbol]; ok {
+		m.config.Status = status
+	}
+}
+
+func (ex *Exchange) handleGetMarkets(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.Markets())
+}
+
+func (ex *Exchange) handleGetMarket(c echo.Context) error {
+	symbol := Market(c.Param("market"))
+	cfg, ok := ex.MarketConfig(symbol)
+	if !ok {
+		return marketNotFound(symbol)
+	}
+
+	return c.JSON(http.StatusOK, cfg)
+}
+
+// handleAddMarket opens the market of the request for trading.
+func (ex *Exchange) handleAddMarket(c echo.Context) error {
+	var cfg MarketConfig
+	if err := bind(c, &cfg); err != nil {
+		return err
+	}
+	if cfg.Status == "" {
+		cfg.Status = MarketTrading
+	}
+
+	if err := ex.AddMarket(cfg); err != nil {
+		return invalid(err)
+	}
+
+	log.Printf("market added => %s | base [%s] | quote [%s] | tick [%s] | lot [%s]", cfg.Symbol, cfg.Base, cfg.Quote, cfg.TickSize, cfg.LotSize)
+
+	return c.JSON(http.StatusOK, cfg)
+}
+
+// handleSetMarketStatus halts the market or lets it trade again.
+func (ex *Exchange) handleSetMarketStatus(c echo.Context) error {
+	symbol := Market(c.Param("market"))
+	if _, ok := ex.market(symbol); !ok {
+		return marketNotFound(symbol)
+	}
+
+	var req SetMarketStatusRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+	if req.Status != MarketTrading && req.Status != MarketHalted {
+		return newError(http.StatusBadRequest, CodeInvalidRequest, "invalid market status: %q", req.Status)
+	}
+
+	res := ex.submit(Command{Type: SetMarketStatusCommand, Market: symbol, Status: req.Status})
+	if res.Err != nil {
+		return invalid(res.Err)
+	}
+
+	if err := ex.handleMatches(symbol, res); err != nil {
+		return err
+	}
+
+	cfg, _ := ex.MarketConfig(symbol)
+	return c.JSON(http.StatusOK, cfg)
+}
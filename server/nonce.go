@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// gasBumpPercent is how much more a replacement pays for gas than the
+	// transaction it replaces, nodes refuse replacements below 10%.
+	gasBumpPercent = 10
+
+	// stuckAfter is how long a transaction may stay unmined before it is
+	// replaced, stuckCheckInterval how often that is checked.
+	stuckAfter         = 2 * time.Minute
+	stuckCheckInterval = 30 * time.Second
+)
+
+// nonceBackend is the part of the chain backend nonces are managed with.
+type nonceBackend interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+}
+
+// PendingTransaction is a transaction that was sent but is not mined yet.
+type PendingTransaction struct {
+	From   common.Address
+	Tx     *types.Transaction
+	SentAt time.Time
+	key    *ecdsa.PrivateKey
+}
+
+// NonceManager hands out the nonces of the accounts transfers are sent from.
+// Nonces are allocated locally, so concurrent transfers of one account never
+// share a nonce, and are synced with the node again after a send fails.
+// Sending holds the account, so its transactions reach the node in nonce
+// order.
+type NonceManager struct {
+	mu       sync.Mutex
+	backend  nonceBackend
+	signer   types.Signer
+	accounts map[common.Address]*nonceAccount
+}
+
+type nonceAccount struct {
+	mu      sync.Mutex
+	next    uint64
+	synced  bool
+	pending map[uint64]*PendingTransaction
+}
+
+func NewNonceManager(backend nonceBackend, chainID *big.Int) *NonceManager {
+	return &NonceManager{
+		backend:  backend,
+		signer:   types.NewEIP155Signer(chainID),
+		accounts: make(map[common.Address]*nonceAccount),
+	}
+}
+
+func (m *NonceManager) account(address common.Address) *nonceAccount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.accounts[address]
+	if !ok {
+		a = &nonceAccount{pending: make(map[uint64]*PendingTransaction)}
+		m.accounts[address] = a
+	}
+	return a
+}
+
+// Send signs the transaction build returns for the next nonce of the account
+// of from and sends it. record, if given, gets the signed transaction before
+// it is sent, and nothing is sent when it fails. When the send fails the
+// next nonce is synced with the node.
+func (m *NonceManager) Send(ctx context.Context, from *ecdsa.PrivateKey, build func(nonce uint64) *types.Transaction, record func(tx *types.Transaction) error) (*types.Transaction, error) {
+	address := crypto.PubkeyToAddress(from.PublicKey)
+	a := m.account(address)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.synced {
+		nonce, err := m.backend.PendingNonceAt(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		a.next, a.synced = nonce, true
+	}
+
+	tx, err := types.SignTx(build(a.next), m.signer, from)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		if err := record(tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.backend.SendTransaction(ctx, tx); err != nil {
+		a.synced = false
+		return nil, err
+	}
+
+	a.pending[tx.Nonce()] = &PendingTransaction{From: address, Tx: tx, SentAt: time.Now(), key: from}
+	a.next++
+
+	return tx, nil
+}
+
+// Resend sends a transaction that was signed before again as it is and
+// tracks it as pending, so it is replaced when it gets stuck.
+func (m *NonceManager) Resend(ctx context.Context, from *ecdsa.PrivateKey, tx *types.Transaction) error {
+	address := crypto.PubkeyToAddress(from.PublicKey)
+	a := m.account(address)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := m.backend.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+
+	a.pending[tx.Nonce()] = &PendingTransaction{From: address, Tx: tx, SentAt: time.Now(), key: from}
+	if a.synced && a.next <= tx.Nonce() {
+		a.next = tx.Nonce() + 1
+	}
+
+	return nil
+}
+
+// Stuck forgets the pending transactions that were mined and returns the
+// ones that were sent longer than olderThan ago, by account and nonce.
+func (m *NonceManager) Stuck(ctx context.Context, olderThan time.Duration) ([]*PendingTransaction, error) {
+	m.mu.Lock()
+	addresses := make([]common.Address, 0, len(m.accounts))
+	for address := range m.accounts {
+		addresses = append(addresses, address)
+	}
+	m.mu.Unlock()
+
+	var stuck []*PendingTransaction
+	for _, address := range addresses {
+		mined, err := m.backend.NonceAt(ctx, address, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		a := m.account(address)
+		a.mu.Lock()
+		for nonce, p := range a.pending {
+			if nonce < mined {
+				delete(a.pending, nonce)
+				continue
+			}
+			if time.Since(p.SentAt) >= olderThan {
+				stuck = append(stuck, p)
+			}
+		}
+		a.mu.Unlock()
+	}
+
+	sort.SliceStable(stuck, func(i, j int) bool {
+		if stuck[i].From != stuck[j].From {
+			return stuck[i].From.Hex() < stuck[j].From.Hex()
+		}
+		return stuck[i].Tx.Nonce() < stuck[j].Tx.Nonce()
+	})
+
+	return stuck, nil
+}
+
+// Replace sends the pending transaction again with the same nonce and a gas
+// price at least gasBumpPercent above it, or the suggested one when that is
+// higher. record, if given, gets the replacement and the transaction it
+// replaces before it is sent, and nothing is sent when it fails.
+func (m *NonceManager) Replace(ctx context.Context, p *PendingTransaction, record func(old common.Hash, tx *types.Transaction) error) (*types.Transaction, error) {
+	a := m.account(p.From)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current, ok := a.pending[p.Tx.Nonce()]
+	if !ok {
+		return nil, nil
+	}
+
+	gasPrice := new(big.Int).Mul(current.Tx.GasPrice(), big.NewInt(100+gasBumpPercent))
+	gasPrice.Div(gasPrice, big.NewInt(100)).Add(gasPrice, big.NewInt(1))
+	suggested, err := m.backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if suggested.Cmp(gasPrice) > 0 {
+		gasPrice = suggested
+	}
+
+	old := current.Tx
+	tx, err := types.SignTx(types.NewTransaction(old.Nonce(), *old.To(), old.Value(), old.Gas(), gasPrice, old.Data()), m.signer, current.key)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		if err := record(old.Hash(), tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.backend.SendTransaction(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	a.pending[tx.Nonce()] = &PendingTransaction{From: p.From, Tx: tx, SentAt: time.Now(), key: current.key}
+
+	return tx, nil
+}
+
+// ReplaceStuck replaces every transaction that is stuck for olderThan and
+// returns the replacements. record gets every replacement before it is sent.
+func (m *NonceManager) ReplaceStuck(ctx context.Context, olderThan time.Duration, record func(old common.Hash, tx *types.Transaction) error) ([]*types.Transaction, error) {
+	stuck, err := m.Stuck(ctx, olderThan)
+	if err != nil {
+		return nil, err
+	}
+
+	var replaced []*types.Transaction
+	for _, p := range stuck {
+		tx, err := m.Replace(ctx, p, record)
+		if err != nil {
+			return replaced, err
+		}
+		if tx != nil {
+			replaced = append(replaced, tx)
+		}
+	}
+	return replaced, nil
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+const (
+	// A settlement is PENDING until the settler took its transfer,
+	// SUBMITTING while its transaction is recorded but may not have reached
+	// the node, SUBMITTED until the transfer is deep enough in the chain to
+	// be CONFIRMED and FAILED once it ran out of attempts.
+	SettlementPending    SettlementStatus = "PENDING"
+	SettlementSubmitting SettlementStatus = "SUBMITTING"
+	SettlementSubmitted  SettlementStatus = "SUBMITTED"
+	SettlementConfirmed  SettlementStatus = "CONFIRMED"
+	SettlementFailed     SettlementStatus = "FAILED"
+)
+
+var (
+	ErrSettlementNotFound  = errors.New("settlement not found")
+	ErrSettlementNotFailed = errors.New("only failed settlements can be re-driven")
+)
+
+type SettlementStatus string
+
+// Settlement is one transfer of a match: the base asset from the seller to
+// the buyer or the quote asset from the buyer to the seller, less the fee of
+// the receiver. A Fee settlement transfers that fee to the exchange, its
+// ToUserID is 0. Seq and Match are the journal sequence number of the
+// command that made the match and its position among the matches of the
+// command, Seq is 0 without a journal. The settlements of a match share the
+// TradeID, the ID of its trade in the trade store.
+type Settlement struct {
+	ID         int64
+	TradeID    int64
+	Seq        uint64
+	Match      int
+	Market     Market
+	AskOrderID int64
+	BidOrderID int64
+	Asset      Asset
+	Fee        bool
+	FromUserID int64
+	ToUserID   int64
+	Amount     decimal.Decimal
+	Status     SettlementStatus
+	// TxHash is the transaction of the transfer and Confirmations how deep
+	// it was in the chain when last checked. Reorgs counts how often a
+	// confirmed transfer was dropped from the chain and sent again.
+	TxHash        common.Hash
+	Confirmations uint64
+	Reorgs        int
+	// Nonce is the nonce of the transaction. Replacements are the
+	// transactions that replaced it, in the order they were sent, any of
+	// them can be the one that gets mined. RawTx is the last one signed, so
+	// it can be sent again as it is.
+	Nonce        uint64
+	Replacements []common.Hash `json:",omitempty"`
+	RawTx        hexutil.Bytes `json:",omitempty"`
+	// Attempts is how many transfers of the settlement failed, LastError
+	// the reason of the last one.
+	Attempts  int
+	LastError string `json:",omitempty"`
+	// SubmittedAt is when the transaction was last sent. It, NextAttempt,
+	// CreatedAt and UpdatedAt are unix times in nanoseconds.
+	SubmittedAt int64
+	NextAttempt int64
+	CreatedAt   int64
+	UpdatedAt   int64
+}
+
+// clearTransfer forgets the transaction of the settlement, so its transfer is
+// sent anew.
+func (s *Settlement) clearTransfer() {
+	s.TxHash = common.Hash{}
+	s.Confirmations = 0
+	s.Nonce = 0
+	s.Replacements = nil
+	s.RawTx = nil
+	s.SubmittedAt = 0
+}
+
+// sent returns every transaction sent for the transfer, the last one is
+// RawTx.
+func (s *Settlement) sent() []common.Hash {
+	return append([]common.Hash{s.TxHash}, s.Replacements...)
+}
+
+// settlementKey identifies the transfer of an asset or of its fee for a
+// journaled match, so it is never queued twice.
+type settlementKey struct {
+	seq   uint64
+	match int
+	asset Asset
+	fee   bool
+}
+
+// Outbox holds the settlements of the exchange. With a file, every change to
+// a settlement is written to it as one JSON line before it takes effect, so
+// the settlements survive a restart.
+type Outbox struct {
+	mu          sync.Mutex
+	f           *os.File
+	lastID      int64
+	settlements map[int64]*Settlement
+	keys        map[settlementKey]int64
+	// running are the settlements handed to a worker.
+	running map[int64]bool
+	// notify wakes the dispatcher when a settlement becomes due.
+	notify chan struct{}
+}
+
+// NewOutbox returns an outbox that only keeps its settlements in memory.
+func NewOutbox() *Outbox {
+	return &Outbox{
+		settlements: make(map[int64]*Settlement),
+		keys:        make(map[settlementKey]int64),
+		running:     make(map[int64]bool),
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// OpenFile loads the settlements of the outbox file at path, creating it when
+// it does not exist, and writes every change to it from then on. It must be
+// called before settlements are added.
+func (o *Outbox) OpenFile(path string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.load(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	o.f = f
+	o.wake()
+
+	return nil
+}
+
+func (o *Outbox) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var s Settlement
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return fmt.Errorf("outbox %s line %d: %w", path, line, err)
+		}
+		o.set(&s)
+	}
+
+	return scanner.Err()
+}
+
+// Durable reports whether the outbox keeps its settlements in a file.
+func (o *Outbox) Durable() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.f != nil
+}
+
+// Add queues the settlements as pending and gives them their IDs.
+// Settlements of a journaled match that are already queued are skipped.
+func (o *Outbox) Add(settlements ...*Settlement) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for _, s := range settlements {
+		key := settlementKey{seq: s.Seq, match: s.Match, asset: s.Asset, fee: s.Fee}
+		if _, ok := o.keys[key]; ok && s.Seq != 0 {
+			continue
+		}
+
+		s.ID = o.lastID + 1
+		s.Status = SettlementPending
+		s.CreatedAt, s.UpdatedAt = now, now
+		if err := o.write(s); err != nil {
+			return err
+		}
+	}
+	o.wake()
+
+	return nil
+}
+
+// Get returns a copy of the settlement.
+func (o *Outbox) Get(id int64) (*Settlement, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s, ok := o.settlements[id]
+	if !ok {
+		return nil, ErrSettlementNotFound
+	}
+	c := *s
+	return &c, nil
+}
+
+// List returns copies of the settlements with the status, by ID.
+func (o *Outbox) List(status SettlementStatus) []*Settlement {
+	return o.list(func(s *Settlement) bool { return s.Status == status })
+}
+
+// OfUser returns copies of the settlements of every trade the user sends or
+// receives in, by ID.
+func (o *Outbox) OfUser(userID int64) []*Settlement {
+	o.mu.Lock()
+	trades := make(map[int64]bool)
+	for _, s := range o.settlements {
+		if s.FromUserID == userID || s.ToUserID == userID {
+			trades[s.TradeID] = true
+		}
+	}
+	o.mu.Unlock()
+
+	return o.list(func(s *Settlement) bool { return trades[s.TradeID] })
+}
+
+// submitting returns copies of the submitting settlements no worker has.
+func (o *Outbox) submitting() []*Settlement {
+	return o.list(func(s *Settlement) bool { return s.Status == SettlementSubmitting && !o.running[s.ID] })
+}
+
+func (o *Outbox) list(keep func(*Settlement) bool) []*Settlement {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	list := []*Settlement{}
+	for _, s := range o.settlements {
+		if keep(s) {
+			c := *s
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Redrive queues a failed settlement again with all its attempts.
+func (o *Outbox) Redrive(id int64) (*Settlement, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	s, ok := o.settlements[id]
+	if !ok {
+		return nil, ErrSettlementNotFound
+	}
+	if s.Status != SettlementFailed {
+		return nil, fmt.Errorf("%w: settlement %d is %s", ErrSettlementNotFailed, id, s.Status)
+	}
+
+	c := *s
+	c.Status = SettlementPending
+	c.Attempts = 0
+	c.NextAttempt = 0
+	c.clearTransfer()
+	c.UpdatedAt = time.Now().UnixNano()
+	if err := o.write(&c); err != nil {
+		return nil, err
+	}
+	o.wake()
+
+	return &c, nil
+}
+
+// claimDue hands out copies of the pending settlements that are due at now
+// and not with a worker yet. They stay claimed until they are updated.
+func (o *Outbox) claimDue(now time.Time) []*Settlement {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var due []*Settlement
+	for id, s := range o.settlements {
+		if s.Status != SettlementPending || o.running[id] || s.NextAttempt > now.UnixNano() {
+			continue
+		}
+		o.running[id] = true
+		c := *s
+		due = append(due, &c)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	return due
+}
+
+// nextDue returns how long until the next pending settlement is due, at most
+// max.
+func (o *Outbox) nextDue(now time.Time, max time.Duration) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	wait := max
+	for id, s := range o.settlements {
+		if s.Status != SettlementPending || o.running[id] {
+			continue
+		}
+		if d := time.Duration(s.NextAttempt - now.UnixNano()); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// update writes the claimed settlement back. done releases the claim.
+func (o *Outbox) update(s *Settlement, done bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if done {
+		delete(o.running, s.ID)
+		o.wake()
+	}
+	s.UpdatedAt = time.Now().UnixNano()
+	c := *s
+	return o.write(&c)
+}
+
+// write keeps the settlement, synced to the file first when there is one.
+func (o *Outbox) write(s *Settlement) error {
+	if o.f != nil {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if _, err := o.f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		// A SUBMITTING settlement is only recorded once it is on disk, or
+		// its transfer could be sent again after the machine crashed.
+		if err := o.f.Sync(); err != nil {
+			return err
+		}
+	}
+	o.set(s)
+	return nil
+}
+
+func (o *Outbox) set(s *Settlement) {
+	o.settlements[s.ID] = s
+	o.keys[settlementKey{seq: s.Seq, match: s.Match, asset: s.Asset, fee: s.Fee}] = s.ID
+	if s.ID > o.lastID {
+		o.lastID = s.ID
+	}
+}
+
+func (o *Outbox) wake() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.f == nil {
+		return nil
+	}
+	return o.f.Close()
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+// position returns the net position of the user in the market: positive when
+// the user bought more than they sold, negative otherwise.
+func (ex *Exchange) position(market Market, userID int64) decimal.Decimal {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	return ex.positions[market][userID]
+}
+
+// updatePositions applies the matches to the positions of both sides and
+// cancels the resting reduce-only orders that would no longer reduce them.
+func (ex *Exchange) updatePositions(market Market, matches []orderbook.Match) {
+	if len(matches) == 0 {
+		return
+	}
+
+	ex.mu.Lock()
+	positions, ok := ex.positions[market]
+	if !ok {
+		positions = make(map[int64]decimal.Decimal)
+		ex.positions[market] = positions
+	}
+
+	changed := make(map[int64]bool)
+	for _, match := range matches {
+		positions[match.Bid.UserID] = positions[match.Bid.UserID].Add(match.SizeFilled)
+		positions[match.Ask.UserID] = positions[match.Ask.UserID].Sub(match.SizeFilled)
+		changed[match.Bid.UserID] = true
+		changed[match.Ask.UserID] = true
+	}
+
+	ob := ex.orderbook(market)
+	var stale []*orderbook.Order
+	for userID := range changed {
+		stale = append(stale, staleReduceOnlyOrders(positions[userID], ex.Orders[market][userID])...)
+	}
+	ex.mu.Unlock()
+
+	// Cancelling calls back into handleCancelEvent, which takes the lock.
+	for _, order := range stale {
+		log.Printf("cancel REDUCE-ONLY order => %d | size [%s]", order.ID, order.Size)
+		ob.CancelOrderWithReason(order, orderbook.CancelReasonReduceOnly)
+	}
+}
+
+// staleReduceOnlyOrders returns the resting reduce-only orders of a user that
+// no longer fit in the given position. Older orders are kept first.
+func staleReduceOnlyOrders(position decimal.Decimal, userOrders []*orderbook.Order) []*orderbook.Order {
+	var (
+		stale     []*orderbook.Order
+		remaining = position.Abs()
+	)
+
+	for _, order := range userOrders {
+		if !order.ReduceOnly || order.Limit == nil {
+			continue
+		}
+		if reducesPosition(position, order.Bid) && order.Size.LessThanOrEqual(remaining) {
+			remaining = remaining.Sub(order.Size)
+			continue
+		}
+		stale = append(stale, order)
+	}
+
+	return stale
+}
+
+// checkReduceOnly makes sure the order, together with the resting reduce-only
+// orders of the user on the same side, does not exceed the net position of
+// the user in the market and trades against it.
+func (ex *Exchange) checkReduceOnly(market Market, order *orderbook.Order) error {
+	position := ex.position(market, order.UserID)
+	if !reducesPosition(position, order.Bid) {
+		return fmt.Errorf("reduce-only order would increase the position [%s]", position)
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	resting := decimal.Zero
+	for _, userOrder := range ex.Orders[market][order.UserID] {
+		if userOrder.ReduceOnly && userOrder.Bid == order.Bid && userOrder.Limit != nil {
+			resting = resting.Add(userOrder.Size)
+		}
+	}
+
+	if resting.Add(order.Size).GreaterThan(position.Abs()) {
+		return fmt.Errorf("reduce-only orders [size: %s] would exceed the position [%s]", resting.Add(order.Size), position)
+	}
+
+	return nil
+}
+
+func reducesPosition(position decimal.Decimal, bid bool) bool {
+	if bid {
+		return position.IsNegative()
+	}
+	return position.IsPositive()
+}
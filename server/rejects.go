@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+// The codes of orders that break a rule of their market.
+const (
+	RejectNegativePrice    ErrorCode = "NEGATIVE_PRICE"
+	RejectZeroPrice        ErrorCode = "ZERO_PRICE"
+	RejectInvalidTick      ErrorCode = "INVALID_TICK"
+	RejectNegativeSize     ErrorCode = "NEGATIVE_SIZE"
+	RejectZeroSize         ErrorCode = "ZERO_SIZE"
+	RejectInvalidLot       ErrorCode = "INVALID_LOT"
+	RejectBelowMinSize     ErrorCode = "BELOW_MIN_SIZE"
+	RejectAboveMaxSize     ErrorCode = "ABOVE_MAX_SIZE"
+	RejectBelowMinNotional ErrorCode = "BELOW_MIN_NOTIONAL"
+	RejectAboveMaxPrice    ErrorCode = "ABOVE_MAX_PRICE"
+	RejectAboveMaxNotional ErrorCode = "ABOVE_MAX_NOTIONAL"
+	RejectInvalidOrderType ErrorCode = "INVALID_ORDER_TYPE"
+)
+
+// reject returns the reply to an order that broke a rule of its market.
+func reject(code ErrorCode, format string, args ...any) *Error {
+	return newError(http.StatusBadRequest, code, format, args...)
+}
+
+// onStep reports whether d is a whole multiple of step.
+func onStep(d, step decimal.Decimal) bool {
+	v, err := d.Rescale(step.Scale())
+	return err == nil && v.Value()%step.Value() == 0
+}
+
+// checkPrice returns why the price, named name, is no price of the market.
+func (m MarketConfig) checkPrice(name string, price decimal.Decimal) error {
+	switch {
+	case price.IsNegative():
+		return reject(RejectNegativePrice, "%s %s is negative", name, price)
+	case price.IsZero():
+		return reject(RejectZeroPrice, "%s is zero", name)
+	case !onStep(price, m.TickSize):
+		return reject(RejectInvalidTick, "%s %s is not a multiple of the tick size %s of %s", name, price, m.TickSize, m.Symbol)
+	case !m.MaxPrice.IsZero() && price.GreaterThan(m.MaxPrice):
+		return reject(RejectAboveMaxPrice, "%s %s is above the max price %s of %s", name, price, m.MaxPrice, m.Symbol)
+	}
+	return nil
+}
+
+// checkSize returns why the size, named name, is no size of the market.
+// Only whole orders have to be between the min and max size.
+func (m MarketConfig) checkSize(name string, size decimal.Decimal) error {
+	switch {
+	case size.IsNegative():
+		return reject(RejectNegativeSize, "%s %s is negative", name, size)
+	case size.IsZero():
+		return reject(RejectZeroSize, "%s is zero", name)
+	case !onStep(size, m.LotSize):
+		return reject(RejectInvalidLot, "%s %s is not a multiple of the lot size %s of %s", name, size, m.LotSize, m.Symbol)
+	case name != "size":
+		return nil
+	case size.LessThan(m.MinSize):
+		return reject(RejectBelowMinSize, "size %s is below the min size %s of %s", size, m.MinSize, m.Symbol)
+	case !m.MaxSize.IsZero() && size.GreaterThan(m.MaxSize):
+		return reject(RejectAboveMaxSize, "size %s is above the max size %s of %s", size, m.MaxSize, m.Symbol)
+	}
+	return nil
+}
+
+// checkNotional returns why an order of the size at the price is too small
+// or too large for the market. Price and size must be valid already. A
+// notional too large to be kept is always above the max.
+func (m MarketConfig) checkNotional(price, size decimal.Decimal) error {
+	notional, err := price.CheckedMul(size)
+	switch {
+	case err != nil:
+		return reject(RejectAboveMaxNotional, "notional of size %s at price %s is too large", size, price)
+	case notional.LessThan(m.MinNotional):
+		return reject(RejectBelowMinNotional, "notional %s is below the min notional %s %s of %s", notional, m.MinNotional, m.Quote, m.Symbol)
+	case !m.MaxNotional.IsZero() && notional.GreaterThan(m.MaxNotional):
+		return reject(RejectAboveMaxNotional, "notional %s is above the max notional %s %s of %s", notional, m.MaxNotional, m.Quote, m.Symbol)
+	}
+	return nil
+}
+
+// checkLimit returns why a limit order, or an amendment of one, of the size
+// at the price does not fit the market.
+func (m MarketConfig) checkLimit(price, size decimal.Decimal) error {
+	if err := m.checkPrice("price", price); err != nil {
+		return err
+	}
+	if err := m.checkSize("size", size); err != nil {
+		return err
+	}
+	return m.checkNotional(price, size)
+}
+
+// checkOrder returns why the order does not fit the market. Market orders
+// have no price to check the notional with, stop market orders are checked
+// at their stop price.
+func (m MarketConfig) checkOrder(req *PlaceOrderRequest) error {
+	switch req.Type {
+	case LimitOrder, MarketOrder, StopMarketOrder, StopLimitOrder:
+	default:
+		return reject(RejectInvalidOrderType, "order type %q is not one of %s, %s, %s or %s", req.Type, LimitOrder, MarketOrder, StopMarketOrder, StopLimitOrder)
+	}
+	if err := m.checkSize("size", req.Size); err != nil {
+		return err
+	}
+	if !req.DisplaySize.IsZero() {
+		if err := m.checkSize("display size", req.DisplaySize); err != nil {
+			return err
+		}
+	}
+
+	price := req.Price
+	switch req.Type {
+	case MarketOrder:
+		return nil
+	case StopMarketOrder:
+		price = req.StopPrice
+		if err := m.checkPrice("stop price", req.StopPrice); err != nil {
+			return err
+		}
+	case StopLimitOrder:
+		if err := m.checkPrice("stop price", req.StopPrice); err != nil {
+			return err
+		}
+		fallthrough
+	case LimitOrder:
+		if err := m.checkPrice("price", req.Price); err != nil {
+			return err
+		}
+	}
+
+	return m.checkNotional(price, req.Size)
+}
+
+// checkStopAmendment returns why the amendment of a stop order does not fit
+// the market. A Price is only set for stop limit orders.
+func (m MarketConfig) checkStopAmendment(req AmendStopOrderRequest) error {
+	if err := m.checkPrice("stop price", req.StopPrice); err != nil {
+		return err
+	}
+	price := req.StopPrice
+	if !req.Price.IsZero() {
+		if err := m.checkPrice("price", req.Price); err != nil {
+			return err
+		}
+		price = req.Price
+	}
+	if err := m.checkSize("size", req.Size); err != nil {
+		return err
+	}
+	return m.checkNotional(price, req.Size)
+}
@@ -3,28 +3,46 @@ package server
 import (
 	"context"
 	"crypto/ecdsa"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/labstack/echo/v4"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/jeffersonsong/crypto-exchange/decimal"
 	"github.com/jeffersonsong/crypto-exchange/orderbook"
 )
 
 const (
 	MarketETH Market = "ETH"
 
-	MarketOrder OrderType = "MARKET"
-	LimitOrder  OrderType = "LIMIT"
+	MarketOrder     OrderType = "MARKET"
+	LimitOrder      OrderType = "LIMIT"
+	StopMarketOrder OrderType = "STOP_MARKET"
+	StopLimitOrder  OrderType = "STOP_LIMIT"
+
+	// ETH prices are quoted with 2 decimals and sizes with 8.
+	ethPriceScale = 2
+	ethSizeScale  = 8
+
+	// expiryInterval is how often good-til-date orders are checked for expiry.
+	expiryInterval = time.Second
+
+	// journalPath is where the exchange journals the commands it accepts and
+	// snapshotDir where it keeps the snapshots of its markets.
+	journalPath = "exchange.journal"
+	snapshotDir = "snapshots"
+
+	// outboxPath is where the exchange keeps the settlements of its matches
+	// and tradesPath where it keeps its trades.
+	outboxPath = "settlements.outbox"
+	tradesPath = "exchange.trades"
 
 	exchangePrivateKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
 )
@@ -35,84 +53,175 @@ type (
 
 	PlaceOrderRequest struct {
 		UserID int64
-		Type   OrderType // limit or market
+		Type   OrderType // limit, market, stop market or stop limit
 		Bid    bool
-		Size   float64
-		Price  float64
+		Size   decimal.Decimal
+		Price  decimal.Decimal
 		Market Market
+		// TimeInForce defaults to GTC for limit orders. Market orders only
+		// accept IOC and FOK.
+		TimeInForce orderbook.TimeInForce
+		// ExpiresAt is the unix time in nanoseconds at which a GTD order
+		// expires.
+		ExpiresAt int64
+		// PostOnly makes a limit order either get rejected or slide one
+		// tick away when it would cross the book.
+		PostOnly orderbook.PostOnly
+		// ReduceOnly orders are rejected unless they reduce the net
+		// position of the user in the market.
+		ReduceOnly bool
+		// StopPrice and Trigger only apply to stop orders. Trigger defaults
+		// to the last trade price.
+		StopPrice decimal.Decimal
+		Trigger   orderbook.TriggerType
+		// DisplaySize turns a limit order into an iceberg order that only
+		// shows that much of its size in the book at a time.
+		DisplaySize decimal.Decimal
+		// SelfTradePrevention overrides the default of the user for what
+		// happens when the order would match one of their own orders.
+		SelfTradePrevention orderbook.SelfTradePrevention
+		// ClientOrderID is an optional ID of the user's own choosing, unique
+		// per user. Placing an order with a ClientOrderID that was used
+		// before places nothing and returns the reply to the first one.
+		ClientOrderID string
 	}
 
 	Order struct {
-		UserID    int64
-		ID        int64
-		Price     float64
-		Size      float64
-		Bid       bool
-		Timestamp int64
+		UserID        int64
+		ID            int64
+		ClientOrderID string
+		Price         decimal.Decimal
+		Size          decimal.Decimal
+		Bid           bool
+		Timestamp     int64
 	}
 
+	// OrderbookData only shows the displayed size of iceberg orders. The
+	// total volumes include their hidden reserve, the visible ones do not.
 	OrderbookData struct {
-		TotalBidVolume float64
-		TotalAskVolume float64
-		Asks           []*Order
-		Bids           []*Order
-	}
-
-	MatchedOrder struct {
-		UserID int64
-		Price  float64
-		Size   float64
-		ID     int64
+		TotalBidVolume   decimal.Decimal
+		TotalAskVolume   decimal.Decimal
+		VisibleBidVolume decimal.Decimal
+		VisibleAskVolume decimal.Decimal
+		Asks             []*Order
+		Bids             []*Order
 	}
 
 	UserData struct {
 		ID         int64
 		PrivateKey string
+		// SelfTradePrevention is applied to the orders of the user that do
+		// not set a mode of their own.
+		SelfTradePrevention orderbook.SelfTradePrevention
+		// Deposits are credited to the user when they are added.
+		Deposits map[Asset]decimal.Decimal
 	}
 )
 
-func StartServer() {
-	e := echo.New()
-	e.HTTPErrorHandler = httpErrorHandler
+func StartServer(cfg Config) {
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", SelfTradePrevention: orderbook.CancelOldest},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3"},
+		{ID: 666, PrivateKey: "e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52"},
+	}
+
+	// Without a chain of their own, the users start with cfg.Funds.
+	var accounts []common.Address
+	for _, userData := range append(userDataList, UserData{PrivateKey: exchangePrivateKey}) {
+		pk, err := crypto.HexToECDSA(userData.PrivateKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		accounts = append(accounts, crypto.PubkeyToAddress(pk.PublicKey))
+	}
 
-	client, err := ethclient.Dial("http://localhost:8545")
+	settler, err := NewSettler(cfg, accounts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ex, err := NewExchange(exchangePrivateKey, client)
+	ex, err := NewExchange(exchangePrivateKey, settler, cfg.Markets)
 	if err != nil {
 		log.Fatal(err)
 	}
+	ex.testDeposits = cfg.TestDeposits
 
-	userDataList := []UserData{
-		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4"},
-		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3"},
-		{ID: 666, PrivateKey: "e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52"},
+	// The outbox and the trades go first, so recovery can tell which matches
+	// of the journal were queued for settlement and traded.
+	if err := ex.outbox.OpenFile(outboxPath); err != nil {
+		log.Fatal(err)
+	}
+	if err := ex.trades.OpenFile(tradesPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ex.Recover(journalPath, snapshotDir); err != nil {
+		log.Fatal(err)
 	}
 
+	// Users restored from the journal already exist. The ledger credits
+	// them with what they hold with the settler.
 	for _, userData := range userDataList {
+		userData.Deposits = cfg.Funds
 		ex.AddUser(userData)
 	}
 
+	go ex.runExpiryScheduler(expiryInterval)
+
+	newRouter(ex).Start(":3000")
+}
+
+func newRouter(ex *Exchange) *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+
 	e.POST("/order", ex.handlePlaceOrder)
-	e.GET("/order/:userID", ex.handleGetOrders)
+	e.GET("/orders/:userID/history", ex.handleGetOrderHistory)
+	e.GET("/fills/:userID", ex.handleGetFills)
+	e.GET("/trades/:market", ex.handleGetTrades)
 
 	e.GET("/book/:market", ex.handleGetBook)
 	e.GET("/book/:market/bid", ex.handleGetBestBid)
 	e.GET("/book/:market/ask", ex.handleGetBestAsk)
 
-	e.DELETE("/order/:id", ex.cancelOrder)
+	e.GET("/book/:market/orders/:userID", ex.handleGetOrders)
+	e.DELETE("/book/:market/order/:id", ex.handleCancelOrder)
+	e.GET("/book/:market/orders/:userID/client/:clientOrderID", ex.handleGetClientOrder)
+	e.DELETE("/book/:market/orders/:userID/client/:clientOrderID", ex.handleCancelClientOrder)
+	e.PUT("/book/:market/order/:id", ex.handleAmendOrder)
+
+	e.GET("/book/:market/orders/:userID/stops", ex.handleGetStopOrders)
+	e.PUT("/book/:market/stop/:id", ex.handleAmendStopOrder)
+	e.DELETE("/book/:market/stop/:id", ex.handleCancelStopOrder)
+	e.PUT("/book/:market/mark", ex.handleSetMarkPrice)
 
 	e.GET("/balance/:userID", ex.handleGetBalance)
 	e.GET("/balances", ex.handleGetBalances)
 
-	e.Start(":3000")
+	e.GET("/account/:userID", ex.handleGetAccount)
+	if ex.testDeposits {
+		e.POST("/deposit", ex.handleDeposit)
+	}
+
+	e.GET("/markets", ex.handleGetMarkets)
+	e.GET("/markets/:market", ex.handleGetMarket)
+
+	e.GET("/settlements/:userID", ex.handleGetSettlements)
+
+	e.GET("/admin/settlements/failed", ex.handleGetFailedSettlements)
+	e.GET("/admin/settlements/:id", ex.handleGetSettlement)
+	e.POST("/admin/settlements/:id/redrive", ex.handleRedriveSettlement)
+
+	e.POST("/admin/markets", ex.handleAddMarket)
+	e.PUT("/admin/markets/:market/status", ex.handleSetMarketStatus)
+
+	return e
 }
 
 type User struct {
-	ID         int64
-	PrivateKey *ecdsa.PrivateKey
+	ID                  int64
+	PrivateKey          *ecdsa.PrivateKey
+	SelfTradePrevention orderbook.SelfTradePrevention
 }
 
 func NewUser(privateKey string, id int64) *User {
@@ -127,55 +236,179 @@ func NewUser(privateKey string, id int64) *User {
 	}
 }
 
-func httpErrorHandler(err error, c echo.Context) {
-	fmt.Println(err)
-}
-
 type Exchange struct {
-	Client *ethclient.Client
-	mu     sync.RWMutex
-	Users  map[int64]*User
-	// Orders map a user to his orders.
-	Orders     map[int64][]*orderbook.Order
+	// Settler settles the matches, a nil one settles nothing.
+	Settler Settler
+	mu      sync.RWMutex
+	Users   map[int64]*User
+	// Orders map a market to the orders every user has resting in it.
+	Orders     map[Market]map[int64][]*orderbook.Order
 	PrivateKey *ecdsa.PrivateKey
-	orderbooks map[Market]*orderbook.Orderbook
+	// markets are the trading pairs of the exchange, markets can be added
+	// while it runs.
+	marketsMu sync.RWMutex
+	markets   map[Market]*market
+	journal   *Journal
+	// commandsMu is held by every journaled command from the moment it gets
+	// its seq until it ran, and by snapshots. The engines, deposits, users and
+	// markets share the ledger, so commands run one at a time in the order of
+	// their seqs, as they are replayed, and snapshots see no command half done.
+	commandsMu sync.Mutex
+	// snapshotDir is where a snapshot of all markets is written every
+	// snapshotEvery commands the engines applied, counted by applied. None
+	// are written when it is empty.
+	snapshotDir   string
+	snapshotEvery int
+	applied       atomic.Int64
+	// lastOrderID is the last order ID handed out. clientOrders maps a user
+	// to the orders they placed with a ClientOrderID.
+	lastOrderID  atomic.Int64
+	clientOrders map[int64]map[string]*ClientOrder
+	// positions map a market to the net position of every user in it.
+	positions map[Market]map[int64]decimal.Decimal
+	// ledger holds the balances of the users and what their orders reserve.
+	ledger *Ledger
+	// outbox holds the settlements of the matches until the settler
+	// transferred them. Failed transfers are retried after settlementBackoff,
+	// doubling every time, up to maxSettlementAttempts times. Submitted
+	// transfers that are not mined after submitTimeout are reconciled.
+	outbox                *Outbox
+	settlementBackoff     time.Duration
+	maxSettlementAttempts int
+	submitTimeout         time.Duration
+	// trades keeps the trades of the matches and the fills of the users.
+	trades *TradeStore
+	// testDeposits routes POST /deposit, see Config.TestDeposits.
+	testDeposits bool
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
-	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketETH] = orderbook.NewOrderbook()
-
+// NewExchange returns an exchange that trades the given markets.
+func NewExchange(privateKey string, settler Settler, markets []MarketConfig) (*Exchange, error) {
 	pk, err := crypto.HexToECDSA(privateKey)
 	if err != nil {
 		return nil, err
 	}
-	return &Exchange{
-		Client:     client,
-		Users:      make(map[int64]*User),
-		Orders:     make(map[int64][]*orderbook.Order),
-		PrivateKey: pk,
-		orderbooks: orderbooks,
-	}, nil
+	ex := &Exchange{
+		Settler:       settler,
+		Users:         make(map[int64]*User),
+		Orders:        make(map[Market]map[int64][]*orderbook.Order),
+		PrivateKey:    pk,
+		markets:       make(map[Market]*market),
+		snapshotEvery: snapshotEvery,
+		clientOrders:  make(map[int64]map[string]*ClientOrder),
+		positions:     make(map[Market]map[int64]decimal.Decimal),
+		ledger:        NewLedger(),
+		outbox:        NewOutbox(),
+
+		settlementBackoff:     settlementBackoff,
+		maxSettlementAttempts: maxSettlementAttempts,
+		submitTimeout:         submitTimeout,
+		trades:                NewTradeStore(),
+	}
+
+	for _, cfg := range markets {
+		if err := ex.addMarket(cfg); err != nil {
+			return nil, fmt.Errorf("market %s: %w", cfg.Symbol, err)
+		}
+	}
+
+	if settler != nil {
+		go ex.runSettlement(settlementWorkers)
+	}
+	if c, ok := settler.(Confirmer); ok {
+		go ex.runConfirmationWatcher(c, confirmationInterval)
+	}
+
+	return ex, nil
+}
+
+// handleCancelEvent drops orders that left the book without being filled from
+// the orders kept per user and releases what they held.
+func (ex *Exchange) handleCancelEvent(market Market, event orderbook.CancelEvent) {
+	ex.syncHold(market, event.Order)
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	userOrders := ex.Orders[market][event.Order.UserID]
+	for i, order := range userOrders {
+		// Self trade prevention may only have decremented a resting order.
+		if order == event.Order && order.Limit == nil {
+			ex.Orders[market][event.Order.UserID] = DeleteOrderChanged(userOrders, i)
+			break
+		}
+	}
+
+	log.Printf("order cancelled => %d | reason [%s] | size [%s]", event.Order.ID, event.Reason, event.Size)
 }
 
-func NewOrder(price float64, order *orderbook.Order) *Order {
+// runExpiryScheduler removes expired good-til-date orders from every book at
+// the given interval.
+func (ex *Exchange) runExpiryScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, m := range ex.marketList() {
+			// Keep the journal free of expiry commands that do nothing.
+			if m.ob.HasExpiredOrders(now) {
+				ex.submit(Command{Type: ExpireOrdersCommand, Market: m.config.Symbol})
+			}
+		}
+	}
+}
+
+// NewOrder returns the public view of a resting order, which only shows the
+// displayed size of iceberg orders.
+func NewOrder(price decimal.Decimal, order *orderbook.Order) *Order {
 	return &Order{
-		UserID:    order.UserID,
-		ID:        order.ID,
-		Price:     price,
-		Size:      order.Size,
-		Bid:       order.Bid,
-		Timestamp: order.Timestamp,
+		UserID:        order.UserID,
+		ID:            order.ID,
+		ClientOrderID: order.ClientOrderID,
+		Price:         price,
+		Size:          order.VisibleSize(),
+		Bid:           order.Bid,
+		Timestamp:     order.Timestamp,
 	}
 }
 
 func (ex *Exchange) AddUser(userData UserData) (*User, error) {
+	if _, ok := ex.Users[userData.ID]; ok {
+		return nil, fmt.Errorf("USer %d already exists", userData.ID)
+	}
+
+	ex.commandsMu.Lock()
+	defer ex.commandsMu.Unlock()
+
+	if ex.journal != nil {
+		cmd := Command{Type: AddUserCommand, Timestamp: time.Now().UnixNano(), User: &userData}
+		if err := ex.journal.Append(&cmd); err != nil {
+			return nil, fmt.Errorf("journal: %w", err)
+		}
+	}
+
+	return ex.addUser(userData)
+}
+
+func (ex *Exchange) addUser(userData UserData) (*User, error) {
 	_, ok := ex.Users[userData.ID]
 	if ok {
 		return nil, fmt.Errorf("USer %d already exists", userData.ID)
 	}
 	user := NewUser(userData.PrivateKey, userData.ID)
+	user.SelfTradePrevention = userData.SelfTradePrevention
+
+	// The settlement workers look users up at any time.
+	ex.mu.Lock()
 	ex.Users[user.ID] = user
+	ex.mu.Unlock()
+
+	for asset, amount := range userData.Deposits {
+		if err := ex.ledger.Deposit(user.ID, asset, amount); err != nil {
+			return nil, fmt.Errorf("deposit %s: %w", asset, err)
+		}
+	}
+
 	return user, nil
 }
 
@@ -184,33 +417,23 @@ type GetOrdersResponse struct {
 	Bids []Order
 }
 
+// handleGetOrders returns the orders the user has resting in the market.
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
-	userIDStr := c.Param("userID")
-	userID, err := strconv.Atoi(userIDStr)
+	symbol := Market(c.Param("market"))
+	e := ex.engine(symbol)
+	if e == nil {
+		return marketNotFound(symbol)
+	}
+	userID, err := intParam(c, "userID")
 	if err != nil {
 		return err
 	}
-	ex.mu.RLock()
-	defer ex.mu.RUnlock()
-	orderbookOrders := ex.Orders[int64(userID)]
-
 	orderResp := &GetOrdersResponse{
 		Asks: []Order{},
 		Bids: []Order{},
 	}
 
-	for _, orderbookOrder := range orderbookOrders {
-		if orderbookOrder.Limit == nil {
-			continue
-		}
-		order := Order{
-			UserID:    orderbookOrder.UserID,
-			ID:        orderbookOrder.ID,
-			Price:     orderbookOrder.Limit.Price,
-			Size:      orderbookOrder.Size,
-			Bid:       orderbookOrder.Bid,
-			Timestamp: orderbookOrder.Timestamp,
-		}
+	for _, order := range e.Snapshot().Orders[userID] {
 		if order.Bid {
 			orderResp.Bids = append(orderResp.Bids, order)
 		} else {
@@ -222,50 +445,29 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 }
 
 func (ex *Exchange) handleGetBook(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
-	}
-
-	orderbookData := OrderbookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
-		Asks:           []*Order{},
-		Bids:           []*Order{},
+	symbol := Market(c.Param("market"))
+	e := ex.engine(symbol)
+	if e == nil {
+		return marketNotFound(symbol)
 	}
 
-	for _, limit := range ob.Asks() {
-		for _, order := range limit.Orders {
-			o := NewOrder(limit.Price, order)
-			orderbookData.Asks = append(orderbookData.Asks, o)
-		}
-	}
-
-	for _, limit := range ob.Bids() {
-		for _, order := range limit.Orders {
-			o := NewOrder(limit.Price, order)
-			orderbookData.Bids = append(orderbookData.Bids, o)
-		}
-	}
-
-	return c.JSON(http.StatusOK, orderbookData)
+	return c.JSON(http.StatusOK, e.Snapshot().Book)
 }
 
 type PriceResponse struct {
-	Price float64
+	Price decimal.Decimal
 }
 
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+	symbol := Market(c.Param("market"))
+	e := ex.engine(symbol)
+	if e == nil {
+		return marketNotFound(symbol)
 	}
-	if len(ob.Bids()) == 0 {
-		return fmt.Errorf("The bids are empty")
+	bestBidPrice, ok := e.Snapshot().BestBid()
+	if !ok {
+		return newError(http.StatusNotFound, CodeNoPrice, "the bids are empty")
 	}
-	bestBidPrice := ob.Bids()[0].Price
 
 	pr := PriceResponse{
 		Price: bestBidPrice,
@@ -275,15 +477,15 @@ func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 }
 
 func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+	symbol := Market(c.Param("market"))
+	e := ex.engine(symbol)
+	if e == nil {
+		return marketNotFound(symbol)
 	}
-	if len(ob.Asks()) == 0 {
-		return fmt.Errorf("The asks are empty")
+	bestAskPrice, ok := e.Snapshot().BestAsk()
+	if !ok {
+		return newError(http.StatusNotFound, CodeNoPrice, "the asks are empty")
 	}
-	bestAskPrice := ob.Asks()[0].Price
 
 	pr := PriceResponse{
 		Price: bestAskPrice,
@@ -292,81 +494,194 @@ func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 	return c.JSON(http.StatusOK, pr)
 }
 
-func (ex *Exchange) cancelOrder(c echo.Context) error {
-	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
+func (ex *Exchange) handleCancelOrder(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.market(market); !ok {
+		return marketNotFound(market)
+	}
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	res := ex.submit(Command{Type: CancelOrderCommand, Market: market, OrderID: id})
+	if res.Err != nil {
+		return invalid(res.Err)
+	}
 
-	ob := ex.orderbooks[MarketETH]
-	order, ok := ob.Orders[int64(id)]
+	log.Println("order canceled id => ", id)
+	return c.JSON(http.StatusOK, map[string]any{"msg": "Order deleted"})
+}
 
+func (ex *Exchange) cancelOrder(cmd Command) CommandResult {
+	ob := ex.orderbook(cmd.Market)
+	order, ok := ob.Orders[cmd.OrderID]
 	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "Order not found"})
+		return CommandResult{Err: orderbook.ErrOrderNotFound}
 	}
 	ob.CancelOrder(order)
 
-	log.Println("order canceled id => ", id)
-	return c.JSON(http.StatusOK, map[string]any{"msg": "Order deleted"})
+	return CommandResult{Order: order}
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
-	ob := ex.orderbooks[market]
+type AmendOrderRequest struct {
+	Price decimal.Decimal
+	Size  decimal.Decimal
+}
 
-	matches := ob.PlaceMarketOrder(order)
-	matchedOrders := make([]*MatchedOrder, len(matches))
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	market := Market(c.Param("market"))
+	cfg, ok := ex.MarketConfig(market)
+	if !ok {
+		return marketNotFound(market)
+	}
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
 
-	totalSizeFilled := 0.0
-	totalAmount := 0.0
-	for i, match := range matches {
-		var limitOrder *orderbook.Order
-		if match.Ask.Bid != order.Bid {
-			limitOrder = match.Ask
-		} else {
-			limitOrder = match.Bid
-		}
-		matchedOrders[i] = &MatchedOrder{
-			UserID: limitOrder.UserID,
-			ID:     limitOrder.ID,
-			Size:   match.SizeFilled,
-			Price:  match.Price,
-		}
-		totalSizeFilled += match.SizeFilled
-		totalAmount += match.Price * match.SizeFilled
+	var amendOrderData AmendOrderRequest
+	if err := bind(c, &amendOrderData); err != nil {
+		return err
+	}
+	if err := cfg.checkLimit(amendOrderData.Price, amendOrderData.Size); err != nil {
+		return err
 	}
 
-	avgPrice := totalAmount / totalSizeFilled
+	price, err := amendOrderData.Price.Rescale(cfg.PriceScale())
+	if err != nil {
+		return invalid(fmt.Errorf("invalid price: %w", err))
+	}
+	size, err := amendOrderData.Size.Rescale(cfg.SizeScale())
+	if err != nil {
+		return invalid(fmt.Errorf("invalid size: %w", err))
+	}
 
-	log.Printf("filled MARKET order => %d | size [%.2f] | avgPrice [%2f]", order.ID, totalSizeFilled, avgPrice)
+	res := ex.submit(Command{
+		Type:    AmendOrderCommand,
+		Market:  market,
+		OrderID: id,
+		Price:   price,
+		Size:    size,
+	})
+	if res.Err != nil {
+		return invalid(res.Err)
+	}
 
-	newOrderMap := make(map[int64][]*orderbook.Order)
-	ex.mu.RLock()
+	if err := ex.handleMatches(market, res); err != nil {
+		return err
+	}
 
-	for userID, orderbookOrders := range ex.Orders {
-		newOrderMap[userID] = []*orderbook.Order{}
-		for _, orderbookOrder := range orderbookOrders {
-			if !orderbookOrder.IsFilled() {
-				newOrderMap[userID] = append(newOrderMap[userID], orderbookOrder)
-			}
+	return c.JSON(http.StatusOK, &PlaceOrderResponse{OrderID: res.Order.ID})
+}
+
+func (ex *Exchange) amendOrder(cmd Command) CommandResult {
+	ob := ex.orderbook(cmd.Market)
+	order, ok := ob.Orders[cmd.OrderID]
+	if !ok {
+		return CommandResult{Err: orderbook.ErrOrderNotFound}
+	}
+	if !ex.trading(cmd.Market) {
+		return CommandResult{Order: order, Err: fmt.Errorf("%w: %s", ErrMarketHalted, cmd.Market)}
+	}
+	if order.ReduceOnly && cmd.Size.GreaterThan(order.Size) {
+		return CommandResult{Order: order, Err: fmt.Errorf("reduce-only orders cannot be increased")}
+	}
+
+	// An amended order must be affordable before it is put back in the book.
+	asset, required, err := holdFor(ex.marketAssets(cmd.Market), order.Bid, cmd.Price, cmd.Size)
+	if err != nil {
+		return CommandResult{Order: order, Err: err}
+	}
+	if extra := required.Sub(ex.ledger.HoldOf(order.ID)); extra.IsPositive() {
+		if err := ex.ledger.Hold(cmd.Market, order.ID, order.UserID, asset, extra); err != nil {
+			return CommandResult{Order: order, Err: err}
 		}
 	}
 
-	ex.Orders = newOrderMap
-	ex.mu.RUnlock()
+	matches, err := ob.AmendOrder(order, cmd.Price, cmd.Size, cmd.Timestamp)
+	if err != nil {
+		ex.syncHold(cmd.Market, order)
+		return CommandResult{Order: order, Err: err}
+	}
+
+	log.Printf("amended LIMIT order => %d | price [%s] | size [%s] | matches [%d]", order.ID, cmd.Price, cmd.Size, len(matches))
 
-	return matches, matchedOrders
+	ex.removeFilledOrders(cmd.Market, matches)
+	ex.updatePositions(cmd.Market, matches)
+	settleErr := ex.settleMatches(cmd.Market, matches)
+	ex.syncHold(cmd.Market, order)
+
+	return CommandResult{
+		Order:   order,
+		Matches: append(matches, ex.triggerStops(cmd.Market)...),
+		Err:     settleErr,
+	}
 }
 
-func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
-	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
+func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, error) {
+	ob := ex.orderbook(market)
 
-	// keep track of user orders
+	matches, err := ob.PlaceMarketOrder(order)
+
+	totalSizeFilled, avgPrice := orderbook.FillSummary(matches, ob.PriceScale)
+
+	log.Printf("filled MARKET order => %d | size [%s] | avgPrice [%s]", order.ID, totalSizeFilled, avgPrice)
+
+	ex.removeFilledOrders(market, matches)
+
+	return matches, err
+}
+
+func (ex *Exchange) handlePlaceLimitOrder(market Market, price decimal.Decimal, order *orderbook.Order) ([]orderbook.Match, error) {
+	ob := ex.orderbook(market)
+	matches, err := ob.PlaceLimitOrder(price, order)
+
+	// keep track of user orders that rest in the book
 	ex.mu.Lock()
-	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	if order.Limit != nil {
+		ex.addUserOrder(market, order)
+	}
 	ex.mu.Unlock()
 
-	log.Printf("new LIMIT order => type: [%t] | price [%.2f] | size [%.2f]", order.Bid, order.Limit.Price, order.Size)
+	ex.removeFilledOrders(market, matches)
 
-	return nil
+	log.Printf("new LIMIT order => type: [%t] | price [%s] | size [%s] | matches [%d]", order.Bid, price, order.Size, len(matches))
+
+	return matches, err
+}
+
+// addUserOrder keeps the order that rests in the book of the market with the
+// other orders of its user there. The caller holds ex.mu.
+func (ex *Exchange) addUserOrder(market Market, order *orderbook.Order) {
+	orders, ok := ex.Orders[market]
+	if !ok {
+		orders = make(map[int64][]*orderbook.Order)
+		ex.Orders[market] = orders
+	}
+	orders[order.UserID] = append(orders[order.UserID], order)
+}
+
+// removeFilledOrders drops the orders the matches filled completely from the
+// orders kept per user in the market. Their history has them as FILLED.
+func (ex *Exchange) removeFilledOrders(market Market, matches []orderbook.Match) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	for _, match := range matches {
+		for _, order := range []*orderbook.Order{match.Ask, match.Bid} {
+			if !order.IsFilled() {
+				continue
+			}
+			userOrders := ex.Orders[market][order.UserID]
+			for i, userOrder := range userOrders {
+				if userOrder == order {
+					ex.Orders[market][order.UserID] = orderbook.DeleteKeepOrder(userOrders, i)
+					break
+				}
+			}
+		}
+	}
 }
 
 type PlaceOrderResponse struct {
@@ -375,98 +690,249 @@ type PlaceOrderResponse struct {
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	var placeOrderData PlaceOrderRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&placeOrderData); err != nil {
+	if err := bind(c, &placeOrderData); err != nil {
+		return err
+	}
+
+	cfg, ok := ex.MarketConfig(placeOrderData.Market)
+	if !ok {
+		return marketNotFound(placeOrderData.Market)
+	}
+
+	if err := prepareOrder(cfg, &placeOrderData); err != nil {
+		ex.rejectOrder(placeOrderData, err)
 		return err
 	}
 
-	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	res := ex.submit(Command{Type: PlaceOrderCommand, Market: placeOrderData.Market, Order: &placeOrderData})
+	if res.Duplicate != nil {
+		return c.JSONBlob(res.Duplicate.Status, res.Duplicate.Response)
+	}
 
-	if placeOrderData.Type == LimitOrder { // limit orders
-		if err := ex.handlePlaceLimitOrder(placeOrderData.Market, placeOrderData.Price, order); err != nil {
-			return err
+	if err := ex.handleMatches(placeOrderData.Market, res); err != nil {
+		return err
+	}
+
+	status, reply := placeOrderReply(res)
+	return c.JSON(status, reply)
+}
+
+// prepareOrder checks the order against the rules of the market and
+// rescales its prices and sizes to the scales of the book.
+func prepareOrder(cfg MarketConfig, req *PlaceOrderRequest) error {
+	// Prices and sizes are on the tick and lot of the market from here on,
+	// rescaling them only fails when they are out of range.
+	if err := cfg.checkOrder(req); err != nil {
+		return err
+	}
+
+	size, err := req.Size.Rescale(cfg.SizeScale())
+	if err != nil {
+		return invalid(fmt.Errorf("invalid size: %w", err))
+	}
+
+	price := req.Price
+	if req.Type == LimitOrder || req.Type == StopLimitOrder {
+		if price, err = price.Rescale(cfg.PriceScale()); err != nil {
+			return invalid(fmt.Errorf("invalid price: %w", err))
 		}
+	}
 
-	} else if placeOrderData.Type == MarketOrder { // market orders
-		matches, matchedOrders := ex.handlePlaceMarketOrder(placeOrderData.Market, order)
+	if err := validateTimeInForce(*req, time.Now()); err != nil {
+		return invalid(err)
+	}
+	if err := validateOrderFlags(*req); err != nil {
+		return invalid(err)
+	}
 
-		if err := ex.handleMatches(matches); err != nil {
-			return err
+	displaySize, err := req.DisplaySize.Rescale(cfg.SizeScale())
+	if err != nil {
+		return invalid(fmt.Errorf("invalid display size: %w", err))
+	}
+	stopPrice := req.StopPrice
+	if req.Type == StopMarketOrder || req.Type == StopLimitOrder {
+		if stopPrice, err = stopPrice.Rescale(cfg.PriceScale()); err != nil {
+			return invalid(fmt.Errorf("invalid stop price: %w", err))
 		}
-		_ = matchedOrders
-
-		// Delete the users of the user when filled
-		// for _, matchedOrder := range matchedOrders {
-		// 	// if the size if 0 we can delete this order
-		// 	index := -1
-		// 	userOrders := ex.Orders[matchedOrder.UserID]
-		// 	for i := 0; i < len(userOrders); i++ {
-		// 		if userOrders[i].IsFilled() && userOrders[i].ID == matchedOrder.ID {
-		// 			index = i
-		// 			break
-		// 		}
-		// 	}
-		// 	if index != -1 {
-		// 		ex.Orders[matchedOrder.UserID] = DeleteOrderChanged(userOrders, index)
-		// 	}
-		// }
-		// return c.JSON(http.StatusOK, map[string]any{"matches": matchedOrders})
-
-		// } else {
-		// 	return c.JSON(http.StatusBadRequest, map[string]any{"msg": "invalid order type"})
-	}
-
-	resp := &PlaceOrderResponse{OrderID: order.ID}
-	return c.JSON(http.StatusOK, resp)
-}
-
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
-	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
-			return fmt.Errorf("User not found: %d", match.Ask.UserID)
+	}
+
+	req.Size = size
+	req.Price = price
+	req.DisplaySize = displaySize
+	req.StopPrice = stopPrice
+
+	return nil
+}
+
+// rejectOrder records the order the exchange refused before it reached the
+// engine in the order history of its market.
+func (ex *Exchange) rejectOrder(req PlaceOrderRequest, err error) {
+	res := ex.submit(Command{Type: RejectOrderCommand, Market: req.Market, Order: &req, Reason: err.Error()})
+	if res.Err != nil {
+		log.Printf("reject order => user [%d] | err [%v]", req.UserID, res.Err)
+	}
+}
+
+// placeOrderReply is the status and the body of the reply to placing an
+// order.
+func placeOrderReply(res CommandResult) (int, any) {
+	if res.Err != nil {
+		e := invalid(res.Err)
+		return e.Status, e
+	}
+
+	return http.StatusOK, &PlaceOrderResponse{OrderID: res.Order.ID}
+}
+
+// placeOrder builds the order of the command and places it in the book of
+// its market.
+func (ex *Exchange) placeOrder(cmd Command) CommandResult {
+	req := cmd.Order
+
+	order := orderbook.NewOrder(req.Bid, req.Size, req.UserID)
+	order.ID = cmd.OrderID
+	order.Timestamp = cmd.Timestamp
+	order.TimeInForce = req.TimeInForce
+	order.ExpiresAt = req.ExpiresAt
+	order.PostOnly = req.PostOnly
+	order.ReduceOnly = req.ReduceOnly
+	order.DisplaySize = req.DisplaySize
+	order.SelfTradePrevention = req.SelfTradePrevention
+	order.ClientOrderID = req.ClientOrderID
+	if user, ok := ex.Users[order.UserID]; ok && order.SelfTradePrevention == "" {
+		order.SelfTradePrevention = user.SelfTradePrevention
+	}
+
+	if !ex.trading(cmd.Market) {
+		return CommandResult{Order: order, Err: fmt.Errorf("%w: %s", ErrMarketHalted, cmd.Market)}
+	}
+
+	if req.Type == StopMarketOrder || req.Type == StopLimitOrder {
+		return ex.placeStopOrder(cmd, order)
+	}
+
+	if order.ReduceOnly {
+		if err := ex.checkReduceOnly(cmd.Market, order); err != nil {
+			return CommandResult{Order: order, Err: err}
 		}
+	}
+
+	if err := ex.holdOrder(cmd.Market, req, order); err != nil {
+		return CommandResult{Order: order, Err: err}
+	}
+
+	var (
+		matches  []orderbook.Match
+		placeErr error
+	)
+
+	if req.Type == LimitOrder { // limit orders
+		matches, placeErr = ex.handlePlaceLimitOrder(cmd.Market, req.Price, order)
+
+	} else if req.Type == MarketOrder { // market orders
+		matches, placeErr = ex.handlePlaceMarketOrder(cmd.Market, order)
+	}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
-			return fmt.Errorf("User not found: %d", match.Bid.UserID)
+	ex.updatePositions(cmd.Market, matches)
+	if err := ex.settleMatches(cmd.Market, matches); err != nil {
+		placeErr = err
+	}
+	ex.syncHold(cmd.Market, order)
+
+	return CommandResult{
+		Order:   order,
+		Matches: append(matches, ex.triggerStops(cmd.Market)...),
+		Err:     placeErr,
+	}
+}
+
+func validateOrderFlags(req PlaceOrderRequest) error {
+	if len(req.ClientOrderID) > maxClientOrderIDLength {
+		return fmt.Errorf("client order id is longer than %d characters", maxClientOrderIDLength)
+	}
+
+	if !req.DisplaySize.IsZero() {
+		if req.Type != LimitOrder {
+			return fmt.Errorf("only limit orders can be iceberg orders")
 		}
-		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
-
-		// this is only used for the fees
-		// exchangePubKey := ex.PrivateKey.Public()
-		// publicKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
-		// if !ok {
-		// 	return fmt.Errorf("error casting public key to ECDSA")
-		// }
-		//toAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-		amount := big.NewInt(int64(match.SizeFilled))
-
-		err := transferETH(ex.Client, fromUser.PrivateKey, toAddress, amount)
-		if err != nil {
-			log.Fatal(err)
+		if req.DisplaySize.IsNegative() || req.DisplaySize.GreaterThan(req.Size) {
+			return fmt.Errorf("display size must be positive and not larger than the size")
+		}
+	}
+
+	switch req.SelfTradePrevention {
+	case "", orderbook.CancelNewest, orderbook.CancelOldest, orderbook.CancelBoth, orderbook.DecrementAndCancel:
+	default:
+		return fmt.Errorf("invalid self trade prevention mode: %q", req.SelfTradePrevention)
+	}
+
+	switch req.PostOnly {
+	case "":
+		return nil
+	case orderbook.PostOnlyReject, orderbook.PostOnlySlide:
+	default:
+		return fmt.Errorf("invalid post-only mode: %q", req.PostOnly)
+	}
+
+	if req.Type != LimitOrder {
+		return fmt.Errorf("only limit orders can be post-only")
+	}
+	if req.TimeInForce == orderbook.ImmediateOrCancel || req.TimeInForce == orderbook.FillOrKill {
+		return fmt.Errorf("post-only orders cannot be %s", req.TimeInForce)
+	}
+
+	return nil
+}
+
+func validateTimeInForce(req PlaceOrderRequest, now time.Time) error {
+	switch req.TimeInForce {
+	case "", orderbook.ImmediateOrCancel, orderbook.FillOrKill:
+	case orderbook.GoodTilCancelled, orderbook.GoodTilDate:
+		if req.Type == MarketOrder || req.Type == StopMarketOrder {
+			return fmt.Errorf("market orders must be %s or %s", orderbook.ImmediateOrCancel, orderbook.FillOrKill)
 		}
-		// TODO - how to handle error
+	default:
+		return fmt.Errorf("invalid time in force: %q", req.TimeInForce)
 	}
+
+	if req.TimeInForce == orderbook.GoodTilDate && req.ExpiresAt <= now.UnixNano() {
+		return fmt.Errorf("GTD orders need an expiry in the future")
+	}
+	if req.TimeInForce != orderbook.GoodTilDate && req.ExpiresAt != 0 {
+		return fmt.Errorf("only GTD orders can have an expiry")
+	}
+
 	return nil
 }
 
-func (ex *Exchange) balance(userID int64) (*big.Int, error) {
+// balance returns what the user holds of the asset with the settler, in the
+// smallest unit of the asset.
+func (ex *Exchange) balance(userID int64, asset Asset) (*big.Int, error) {
 	user, ok := ex.Users[userID]
 	if !ok {
-		return nil, fmt.Errorf("User not found: %d", userID)
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+	}
+	if ex.Settler == nil {
+		return nil, fmt.Errorf("no settler")
 	}
 	address := crypto.PubkeyToAddress(user.PrivateKey.PublicKey)
-	return ex.Client.BalanceAt(context.Background(), address, nil)
+	return ex.Settler.BalanceAt(context.Background(), asset, address)
 }
 
+// handleGetBalance returns the balance of the user in the asset of the asset
+// query parameter, ETH when it is not set.
 func (ex *Exchange) handleGetBalance(c echo.Context) error {
-	userIDStr := c.Param("userID")
-	userID, err := strconv.Atoi(userIDStr)
+	userID, err := intParam(c, "userID")
 	if err != nil {
 		return err
 	}
 
-	balance, err := ex.balance(int64(userID))
+	asset := Asset(c.QueryParam("asset"))
+	if asset == "" {
+		asset = AssetETH
+	}
+
+	balance, err := ex.balance(userID, asset)
 	if err != nil {
 		return err
 	}
@@ -477,7 +943,7 @@ func (ex *Exchange) handleGetBalance(c echo.Context) error {
 func (ex *Exchange) handleGetBalances(c echo.Context) error {
 	balances := make(map[int64]*big.Int)
 	for _, user := range ex.Users {
-		balance, err := ex.balance(user.ID)
+		balance, err := ex.balance(user.ID, AssetETH)
 		if err != nil {
 			return err
 		}
@@ -487,41 +953,6 @@ func (ex *Exchange) handleGetBalances(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]any{"balances": balances})
 }
 
-func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
-	ctx := context.Background()
-
-	publicKey := fromPrivKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("error casting public key to ECDSA")
-	}
-
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
-	if err != nil {
-		return err
-	}
-
-	gasLimit := uint64(21000) // in units
-
-	gasPrice, err := client.SuggestGasPrice(ctx)
-	if err != nil {
-		return err
-	}
-
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
-
-	chainID := big.NewInt(1337)
-
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
-	if err != nil {
-		return err
-	}
-
-	return client.SendTransaction(ctx, signedTx)
-}
-
 func DeleteOrderChanged[T any](s []*T, i int) []*T {
 	s[i] = s[len(s)-1]
 	return s[:len(s)-1]
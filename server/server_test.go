@@ -0,0 +1,2562 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+// testDeposits is what every user starts with in the ledger of the exchange.
+var testDeposits = map[Asset]decimal.Decimal{
+	AssetETH: decimal.NewFromInt(1_000),
+	AssetUSD: decimal.NewFromInt(10_000_000),
+}
+
+// testConfig settles the assets of the default config with the settler and
+// gives every user testDeposits with it as well. Transfers on chain are
+// confirmed once mined.
+func testConfig(settler SettlerType) Config {
+	return Config{Settler: settler, Assets: DefaultConfig().Assets, Funds: testDeposits, Confirmations: 1}
+}
+
+func newTestExchange(t *testing.T) (*Exchange, *httptest.Server) {
+	t.Helper()
+
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	settler, err := NewSettler(testConfig(MemorySettler), testAccounts(t, userDataList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExchange(exchangePrivateKey, settler, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.testDeposits = true
+
+	for _, userData := range userDataList {
+		if _, err := ex.AddUser(userData); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(newRouter(ex))
+	t.Cleanup(srv.Close)
+
+	return ex, srv
+}
+
+// testAccounts returns the addresses of the users.
+func testAccounts(t *testing.T, userDataList []UserData) []common.Address {
+	t.Helper()
+
+	var accounts []common.Address
+	for _, userData := range userDataList {
+		pk, err := crypto.HexToECDSA(userData.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts = append(accounts, crypto.PubkeyToAddress(pk.PublicKey))
+	}
+	return accounts
+}
+
+func doRequest(srv *httptest.Server, method, path string, body, v any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &Error{}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil {
+			return fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+		}
+		apiErr.Status = resp.StatusCode
+		return apiErr
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// TestConcurrentRequests drives the exchange with concurrent writers and
+// readers. Bids and asks never cross, so nothing is settled on chain. Run it
+// with -race.
+func TestConcurrentRequests(t *testing.T) {
+	ex, srv := newTestExchange(t)
+	go ex.runExpiryScheduler(time.Millisecond)
+
+	const (
+		writers = 8
+		orders  = 25
+	)
+
+	var (
+		writersWG sync.WaitGroup
+		readersWG sync.WaitGroup
+		done      = make(chan struct{})
+	)
+
+	for w := 0; w < writers; w++ {
+		writersWG.Add(1)
+		go func(w int) {
+			defer writersWG.Done()
+
+			bid := w%2 == 0
+			userID, price := int64(7), int64(9_000)
+			if !bid {
+				userID, price = 8, 11_000
+			}
+
+			for i := 0; i < orders; i++ {
+				var resp PlaceOrderResponse
+				err := doRequest(srv, http.MethodPost, "/order", &PlaceOrderRequest{
+					UserID: userID,
+					Type:   LimitOrder,
+					Bid:    bid,
+					Size:   decimal.NewFromInt(2),
+					Price:  decimal.NewFromInt(price + int64(i)),
+					Market: MarketETH,
+				}, &resp)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				path := fmt.Sprintf("/book/ETH/order/%d", resp.OrderID)
+				switch i % 3 {
+				case 0:
+					err = doRequest(srv, http.MethodDelete, path, nil, nil)
+				case 1:
+					err = doRequest(srv, http.MethodPut, path, &AmendOrderRequest{
+						Price: decimal.NewFromInt(price + int64(i)),
+						Size:  decimal.NewFromInt(1),
+					}, nil)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for _, path := range []string{"/book/ETH", "/book/ETH/bid", "/book/ETH/orders/7", "/book/ETH/orders/8/stops"} {
+		readersWG.Add(1)
+		go func(path string) {
+			defer readersWG.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				doRequest(srv, http.MethodGet, path, nil, nil)
+			}
+		}(path)
+	}
+
+	writersWG.Wait()
+	close(done)
+	readersWG.Wait()
+
+	var book OrderbookData
+	if err := doRequest(srv, http.MethodGet, "/book/ETH", nil, &book); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every writer cancels a third of its orders and halves another third.
+	resting := writers / 2 * (orders - (orders+2)/3)
+	volume := decimal.NewFromInt(writers / 2 * (orders/3*2 + orders/3))
+	if len(book.Bids) != resting || len(book.Asks) != resting {
+		t.Fatalf("expected %d orders on both sides, got %d bids and %d asks", resting, len(book.Bids), len(book.Asks))
+	}
+	if !book.TotalBidVolume.Equal(volume) || !book.TotalAskVolume.Equal(volume) {
+		t.Fatalf("expected volume %s on both sides, got %s bids and %s asks", volume, book.TotalBidVolume, book.TotalAskVolume)
+	}
+	for _, side := range []struct {
+		orders []*Order
+		volume decimal.Decimal
+	}{
+		{book.Bids, book.TotalBidVolume},
+		{book.Asks, book.TotalAskVolume},
+	} {
+		total := decimal.Zero
+		for _, order := range side.orders {
+			total = total.Add(order.Size)
+		}
+		if !total.Equal(side.volume) {
+			t.Fatalf("expected volume %s, got %s", total, side.volume)
+		}
+	}
+
+	var userOrders GetOrdersResponse
+	if err := doRequest(srv, http.MethodGet, "/book/ETH/orders/7", nil, &userOrders); err != nil {
+		t.Fatal(err)
+	}
+	if len(userOrders.Bids) != len(book.Bids) || len(userOrders.Asks) != 0 {
+		t.Fatalf("expected %d bids for user 7, got %d bids and %d asks", len(book.Bids), len(userOrders.Bids), len(userOrders.Asks))
+	}
+}
+
+func TestSnapshotPublishedBeforeReply(t *testing.T) {
+	ex, srv := newTestExchange(t)
+
+	var resp PlaceOrderResponse
+	err := doRequest(srv, http.MethodPost, "/order", &PlaceOrderRequest{
+		UserID: 7,
+		Type:   LimitOrder,
+		Bid:    true,
+		Size:   decimal.NewFromInt(3),
+		Price:  decimal.NewFromInt(9_000),
+		Market: MarketETH,
+	}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := ex.engine(MarketETH).Snapshot()
+	price, ok := snap.BestBid()
+	if !ok || !price.Equal(decimal.NewFromInt(9_000)) {
+		t.Fatalf("expected best bid 9000, got %s", price)
+	}
+	if orders := snap.Orders[7]; len(orders) != 1 || orders[0].ID != resp.OrderID {
+		t.Fatalf("expected order %d for user 7, got %v", resp.OrderID, orders)
+	}
+}
+
+// TestSettlement runs a match through the HTTP exchange on every settler
+// that needs no network. The seller gets the notional in USD, the buyer the
+// size in ETH, both to the last unit.
+func TestSettlement(t *testing.T) {
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	units := func(asset Asset, amount string) *big.Int {
+		n, err := DefaultConfig().Assets[asset].ToUnits(decimal.RequireFromString(amount))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, settlerType := range []SettlerType{MemorySettler, SimulatedSettler} {
+		t.Run(string(settlerType), func(t *testing.T) {
+			settler, err := NewSettler(testConfig(settlerType), testAccounts(t, userDataList))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex, err := NewExchange(exchangePrivateKey, settler, DefaultConfig().Markets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, userData := range userDataList {
+				if _, err := ex.AddUser(userData); err != nil {
+					t.Fatal(err)
+				}
+			}
+			srv := httptest.NewServer(newRouter(ex))
+			defer srv.Close()
+
+			for _, req := range []*PlaceOrderRequest{
+				{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.RequireFromString("1.5"), Price: decimal.RequireFromString("10000.25"), Market: MarketETH},
+				{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.RequireFromString("1.5"), Market: MarketETH},
+			} {
+				if err := doRequest(srv, http.MethodPost, "/order", req, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			waitSettled(t, ex)
+
+			balance := func(userID int64, asset Asset) *big.Int {
+				var resp struct{ Balance *big.Int }
+				if err := doRequest(srv, http.MethodGet, fmt.Sprintf("/balance/%d?asset=%s", userID, asset), nil, &resp); err != nil {
+					t.Fatal(err)
+				}
+				return resp.Balance
+			}
+
+			// 1.5 ETH at 10000.25 is 15000.375 USD.
+			funds := units(AssetUSD, "10000000")
+			if got, want := balance(8, AssetUSD), new(big.Int).Add(funds, units(AssetUSD, "15000.375")); got.Cmp(want) != 0 {
+				t.Fatalf("expected seller USD balance %s, got %s", want, got)
+			}
+			if got, want := balance(7, AssetUSD), new(big.Int).Sub(funds, units(AssetUSD, "15000.375")); got.Cmp(want) != 0 {
+				t.Fatalf("expected buyer USD balance %s, got %s", want, got)
+			}
+
+			funds = units(AssetETH, "1000")
+			if got, want := balance(8, AssetETH), new(big.Int).Sub(funds, units(AssetETH, "1.5")); got.Cmp(want) > 0 {
+				t.Fatalf("expected seller ETH balance at most %s, got %s", want, got)
+			}
+			// On chain the buyer pays the gas of the USD transfer.
+			want := new(big.Int).Add(funds, units(AssetETH, "1.5"))
+			if settlerType == SimulatedSettler {
+				want.Sub(want, units(AssetETH, "0.01"))
+			}
+			if got := balance(7, AssetETH); got.Cmp(want) < 0 || got.Cmp(new(big.Int).Add(funds, units(AssetETH, "1.5"))) > 0 {
+				t.Fatalf("expected buyer ETH balance about %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+// waitSettled waits until the exchange is done with everything it queued for
+// settlement.
+func waitSettled(t *testing.T, ex *Exchange) {
+	t.Helper()
+
+	eventually(t, "settlements still pending", func() bool {
+		return len(ex.outbox.List(SettlementPending))+len(ex.outbox.List(SettlementSubmitting))+len(ex.outbox.List(SettlementSubmitted)) == 0
+	})
+}
+
+// eventually waits a few seconds for cond to hold and fails with msg when it
+// does not.
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// failingSettler fails every transfer while failing is set.
+type failingSettler struct {
+	Settler
+	failing atomic.Bool
+}
+
+func (s *failingSettler) Transfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal) (common.Hash, error) {
+	if s.failing.Load() {
+		return common.Hash{}, errors.New("node unavailable")
+	}
+	return s.Settler.Transfer(ctx, asset, from, to, amount)
+}
+
+// TestSettlementDeadLetters retries failing settlements until they go to the
+// dead letters and re-drives them once the settler works again.
+func TestSettlementDeadLetters(t *testing.T) {
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	inner, err := NewSettler(testConfig(MemorySettler), testAccounts(t, userDataList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settler := &failingSettler{Settler: inner}
+	settler.failing.Store(true)
+
+	ex, err := NewExchange(exchangePrivateKey, settler, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.settlementBackoff = time.Millisecond
+	ex.maxSettlementAttempts = 3
+	for _, userData := range userDataList {
+		if _, err := ex.AddUser(userData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(newRouter(ex))
+	defer srv.Close()
+
+	for _, req := range []*PlaceOrderRequest{
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.NewFromInt(2), Price: decimal.NewFromInt(10_000), Market: MarketETH},
+		{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(2), Market: MarketETH},
+	} {
+		if err := doRequest(srv, http.MethodPost, "/order", req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSettled(t, ex)
+
+	var failed []*Settlement
+	if err := doRequest(srv, http.MethodGet, "/admin/settlements/failed", nil, &failed); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("expected both legs in the dead letters, got %d", len(failed))
+	}
+	for _, s := range failed {
+		if s.Status != SettlementFailed || s.Attempts != 3 || s.LastError != "node unavailable" {
+			t.Fatalf("expected a failed settlement after 3 attempts, got %+v", s)
+		}
+	}
+	if err := doRequest(srv, http.MethodPost, fmt.Sprintf("/admin/settlements/%d/redrive", 99), nil, nil); !errors.Is(err, ErrSettlementNotFound) {
+		t.Fatal("expected an unknown settlement to be refused")
+	}
+
+	settler.failing.Store(false)
+	for _, s := range failed {
+		if err := doRequest(srv, http.MethodPost, fmt.Sprintf("/admin/settlements/%d/redrive", s.ID), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSettled(t, ex)
+
+	for _, s := range failed {
+		var got Settlement
+		if err := doRequest(srv, http.MethodGet, fmt.Sprintf("/admin/settlements/%d", s.ID), nil, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != SettlementConfirmed {
+			t.Fatalf("expected settlement %d confirmed, got %s", s.ID, got.Status)
+		}
+		// Only failed settlements can be re-driven.
+		if err := doRequest(srv, http.MethodPost, fmt.Sprintf("/admin/settlements/%d/redrive", s.ID), nil, nil); !errors.Is(err, ErrSettlementNotFailed) {
+			t.Fatalf("expected confirmed settlement %d not to be re-driven", s.ID)
+		}
+	}
+
+	balance, err := inner.BalanceAt(context.Background(), AssetUSD, crypto.PubkeyToAddress(ex.Users[8].PrivateKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := DefaultConfig().Assets[AssetUSD].ToUnits(decimal.NewFromInt(10_000_000 + 20_000))
+	if balance.Cmp(want) != 0 {
+		t.Fatalf("expected seller USD balance %s, got %s", want, balance)
+	}
+}
+
+// TestSettlementFees settles trades net of their fees and sends the fees to
+// the exchange, so the balances with the settler end up where those of the
+// ledger are. The settlements of a trade carry the ID of its fills.
+func TestSettlementFees(t *testing.T) {
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+	cfg := ETHMarket()
+	cfg.MakerFee = decimal.RequireFromString("0.001")
+	cfg.TakerFee = decimal.RequireFromString("0.002")
+
+	settler, err := NewSettler(testConfig(MemorySettler), testAccounts(t, userDataList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExchange(exchangePrivateKey, settler, []MarketConfig{cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userData := range userDataList {
+		if _, err := ex.AddUser(userData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(newRouter(ex))
+	defer srv.Close()
+
+	for _, req := range []*PlaceOrderRequest{
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(10_000), Market: MarketETH},
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(10_100), Market: MarketETH},
+		{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(2), Market: MarketETH},
+	} {
+		if err := doRequest(srv, http.MethodPost, "/order", req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSettled(t, ex)
+
+	var trades []*TradeSettlement
+	if err := doRequest(srv, http.MethodGet, "/settlements/7", nil, &trades); err != nil {
+		t.Fatal(err)
+	}
+	var fills FillsResponse
+	if err := doRequest(srv, http.MethodGet, "/fills/7", nil, &fills); err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 || len(fills.Fills) != 2 {
+		t.Fatalf("expected 2 trades and 2 fills, got %d and %d", len(trades), len(fills.Fills))
+	}
+	for i, trade := range trades {
+		// Fills come newest first.
+		fill := fills.Fills[len(fills.Fills)-1-i]
+		if trade.TradeID != fill.TradeID || trade.BidOrderID != fill.OrderID || trade.Status != SettlementConfirmed {
+			t.Fatalf("expected trade %d confirmed for fill %+v, got %+v", trade.TradeID, fill, trade)
+		}
+		if len(trade.Settlements) != 4 {
+			t.Fatalf("expected 2 transfers and 2 fees in trade %d, got %d", trade.TradeID, len(trade.Settlements))
+		}
+		for _, s := range trade.Settlements {
+			if s.Fee && (s.ToUserID != 0 || !s.Amount.IsPositive()) {
+				t.Fatalf("expected a fee to the exchange, got %+v", s)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	units := func(asset Asset, amount decimal.Decimal) *big.Int {
+		n, err := DefaultConfig().Assets[asset].ToUnits(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, asset := range []Asset{AssetETH, AssetUSD} {
+		for _, userID := range []int64{7, 8} {
+			balance, err := settler.BalanceAt(ctx, asset, crypto.PubkeyToAddress(ex.Users[userID].PrivateKey.PublicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := ex.ledger.Balances(userID)[asset]
+			if want := units(asset, b.Available.Add(b.Held)); balance.Cmp(want) != 0 {
+				t.Fatalf("expected user %d to hold %s %s like the ledger, got %s", userID, want, asset, balance)
+			}
+		}
+
+		balance, err := settler.BalanceAt(ctx, asset, crypto.PubkeyToAddress(ex.PrivateKey.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fee := ex.ledger.Balance(Account{Asset: asset, Type: FeeAccount})
+		if want := units(asset, fee); !fee.IsPositive() || balance.Cmp(want) != 0 {
+			t.Fatalf("expected the exchange to hold %s %s of fees, got %s", want, asset, balance)
+		}
+	}
+}
+
+// TestOutboxRecovery queues the settlements of matches that were journaled
+// but never made it to the outbox, and only those.
+func TestOutboxRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	start := func() *Exchange {
+		settler, err := NewSettler(testConfig(MemorySettler), testAccounts(t, userDataList))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := NewExchange(exchangePrivateKey, settler, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.outbox.OpenFile(filepath.Join(dir, "settlements.outbox")); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ex.outbox.Close() })
+		if err := ex.Recover(path, dir); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+
+	ex := start()
+	for _, userData := range userDataList {
+		if _, err := ex.AddUser(userData); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	place := func(userID int64, typ OrderType, bid bool) CommandResult {
+		return ex.submit(Command{
+			Type:   PlaceOrderCommand,
+			Market: MarketETH,
+			Order: &PlaceOrderRequest{
+				UserID: userID,
+				Type:   typ,
+				Bid:    bid,
+				Size:   decimal.New(1, ethSizeScale),
+				Price:  decimal.New(10_000, ethPriceScale),
+				Market: MarketETH,
+			},
+		})
+	}
+
+	// The first match is queued, the second one is lost with a crash.
+	place(8, LimitOrder, false)
+	if err := ex.handleMatches(MarketETH, place(7, MarketOrder, true)); err != nil {
+		t.Fatal(err)
+	}
+	place(8, LimitOrder, false)
+	place(7, MarketOrder, true)
+	waitSettled(t, ex)
+	if got := len(ex.outbox.List(SettlementConfirmed)); got != 2 {
+		t.Fatalf("expected 2 confirmed settlements, got %d", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		restarted := start()
+		waitSettled(t, restarted)
+		if got := len(restarted.outbox.List(SettlementConfirmed)); got != 4 {
+			t.Fatalf("expected 4 confirmed settlements after restart %d, got %d", i+1, got)
+		}
+	}
+}
+
+// crashingSubmitter records the transactions of its transfers and crashes
+// before the exchange learns whether they were sent: ETH transfers are sent,
+// the others are not.
+type crashingSubmitter struct {
+	Settler
+	chain *ChainSettler
+}
+
+var errCrashed = errors.New("crashed")
+
+func (s *crashingSubmitter) SubmitTransfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal, record func(tx *types.Transaction) error) (common.Hash, error) {
+	if _, err := s.chain.SubmitTransfer(ctx, asset, from, to, amount, func(tx *types.Transaction) error {
+		if err := record(tx); err != nil {
+			return err
+		}
+		if asset != AssetETH {
+			return errCrashed
+		}
+		return nil
+	}); err != nil {
+		return common.Hash{}, err
+	}
+	return common.Hash{}, errCrashed
+}
+
+func (s *crashingSubmitter) Resubmit(ctx context.Context, from *ecdsa.PrivateKey, tx *types.Transaction, sent []common.Hash) error {
+	return s.chain.Resubmit(ctx, from, tx, sent)
+}
+
+// TestSubmittingRecovery restarts the exchange after it recorded the
+// transactions of a trade but crashed while it sent them. The transaction
+// that was sent is not sent again, the other one is sent as it was recorded.
+func TestSubmittingRecovery(t *testing.T) {
+	dir := t.TempDir()
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	settler, err := NewSettler(testConfig(SimulatedSettler), testAccounts(t, userDataList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	simulated := settler.(*SimulatedBackendSettler)
+	backend := simulated.backend
+
+	start := func(settler Settler) *Exchange {
+		ex, err := NewExchange(exchangePrivateKey, settler, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.settlementBackoff = time.Millisecond
+		if err := ex.outbox.OpenFile(filepath.Join(dir, "settlements.outbox")); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ex.outbox.Close() })
+		for _, userData := range userDataList {
+			if _, err := ex.AddUser(userData); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ex
+	}
+
+	ex := start(&crashingSubmitter{Settler: &simulated.ChainSettler, chain: &simulated.ChainSettler})
+	srv := httptest.NewServer(newRouter(ex))
+	defer srv.Close()
+
+	for _, req := range []*PlaceOrderRequest{
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.NewFromInt(2), Price: decimal.NewFromInt(10_000), Market: MarketETH},
+		{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(2), Market: MarketETH},
+	} {
+		if err := doRequest(srv, http.MethodPost, "/order", req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "expected both transfers submitting", func() bool { return len(ex.outbox.submitting()) == 2 })
+	backend.Commit()
+
+	// The restarted exchange starts over with the nonces.
+	chain := newChainSettler(backend, simulated.assets, 1)
+	restarted := start(&chain)
+	eventually(t, "expected both transfers reconciled", func() bool {
+		return len(restarted.outbox.List(SettlementSubmitting)) == 0
+	})
+	backend.Commit()
+	waitSettled(t, restarted)
+
+	for _, s := range restarted.outbox.List(SettlementConfirmed) {
+		if s.Attempts != 0 {
+			t.Fatalf("expected settlement %d confirmed without another attempt, got %+v", s.ID, s)
+		}
+	}
+
+	ctx := context.Background()
+	units := func(asset Asset, amount int64) *big.Int {
+		n, _ := DefaultConfig().Assets[asset].ToUnits(decimal.NewFromInt(amount))
+		return n
+	}
+	balance := func(userID int64, asset Asset) *big.Int {
+		b, err := chain.BalanceAt(ctx, asset, crypto.PubkeyToAddress(restarted.Users[userID].PrivateKey.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if got, want := balance(8, AssetUSD), units(AssetUSD, 10_000_000+20_000); got.Cmp(want) != 0 {
+		t.Fatalf("expected seller USD balance %s, got %s", want, got)
+	}
+	// The buyer pays the gas of the USD transfer.
+	want := units(AssetETH, 1000+2)
+	if got := balance(7, AssetETH); got.Cmp(want) > 0 || got.Cmp(new(big.Int).Sub(want, units(AssetETH, 1))) < 0 {
+		t.Fatalf("expected buyer ETH balance about %s, got %s", want, got)
+	}
+}
+
+// TestReplacementRecovery replaces the stuck transfers of a trade and
+// confirms them after a restart by the replacements kept with the
+// settlements.
+func TestReplacementRecovery(t *testing.T) {
+	dir := t.TempDir()
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	settler, err := NewSettler(testConfig(SimulatedSettler), testAccounts(t, userDataList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	simulated := settler.(*SimulatedBackendSettler)
+	backend := simulated.backend
+
+	start := func(settler Settler) *Exchange {
+		ex, err := NewExchange(exchangePrivateKey, settler, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.outbox.OpenFile(filepath.Join(dir, "settlements.outbox")); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ex.outbox.Close() })
+		for _, userData := range userDataList {
+			if _, err := ex.AddUser(userData); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ex
+	}
+
+	// Nothing is mined until the test commits.
+	ex := start(&simulated.ChainSettler)
+	srv := httptest.NewServer(newRouter(ex))
+	defer srv.Close()
+
+	for _, req := range []*PlaceOrderRequest{
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.NewFromInt(2), Price: decimal.NewFromInt(10_000), Market: MarketETH},
+		{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(2), Market: MarketETH},
+	} {
+		if err := doRequest(srv, http.MethodPost, "/order", req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "expected both transfers submitted", func() bool { return len(ex.outbox.List(SettlementSubmitted)) == 2 })
+
+	// The node drops both transfers, they are stuck and replaced.
+	backend.Rollback()
+	ex.replaceStuck(&simulated.ChainSettler, 0)
+	submitted := ex.outbox.List(SettlementSubmitted)
+	if len(submitted) != 2 {
+		t.Fatalf("expected both transfers still submitted, got %d", len(submitted))
+	}
+	for _, s := range submitted {
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(s.RawTx); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Replacements) != 1 || s.Replacements[0] != tx.Hash() || s.TxHash == tx.Hash() || tx.Nonce() != s.Nonce {
+			t.Fatalf("expected settlement %d with its replacement, got %+v", s.ID, s)
+		}
+	}
+	if err := ex.outbox.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restarted exchange only knows the replacements from the outbox.
+	chain := newChainSettler(backend, simulated.assets, 1)
+	restarted := start(&chain)
+	backend.Commit()
+	waitSettled(t, restarted)
+
+	for _, s := range restarted.outbox.List(SettlementConfirmed) {
+		if s.Attempts != 0 || len(s.Replacements) != 1 {
+			t.Fatalf("expected settlement %d confirmed by its replacement, got %+v", s.ID, s)
+		}
+	}
+	balance, err := chain.BalanceAt(context.Background(), AssetUSD, crypto.PubkeyToAddress(restarted.Users[8].PrivateKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := DefaultConfig().Assets[AssetUSD].ToUnits(decimal.NewFromInt(10_000_000 + 20_000)); balance.Cmp(want) != 0 {
+		t.Fatalf("expected seller USD balance %s, got %s", want, balance)
+	}
+}
+
+// TestUnminedTransfers reconciles the transfers of a trade the node dropped:
+// the one whose nonce went to another transaction is queued again, the other
+// one is sent again as it was.
+func TestUnminedTransfers(t *testing.T) {
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	settler, err := NewSettler(testConfig(SimulatedSettler), testAccounts(t, userDataList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	simulated := settler.(*SimulatedBackendSettler)
+	backend := simulated.backend
+
+	// Nothing is mined until the test commits.
+	ex, err := NewExchange(exchangePrivateKey, &simulated.ChainSettler, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.settlementBackoff = time.Millisecond
+	ex.submitTimeout = 2 * time.Second
+	for _, userData := range userDataList {
+		if _, err := ex.AddUser(userData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(newRouter(ex))
+	defer srv.Close()
+
+	for _, req := range []*PlaceOrderRequest{
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.NewFromInt(2), Price: decimal.NewFromInt(10_000), Market: MarketETH},
+		{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(2), Market: MarketETH},
+	} {
+		if err := doRequest(srv, http.MethodPost, "/order", req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "expected both transfers submitted", func() bool { return len(ex.outbox.List(SettlementSubmitted)) == 2 })
+	submitted := ex.outbox.List(SettlementSubmitted)
+
+	// The node drops both transfers and the seller sends another transaction
+	// with the nonce of theirs.
+	backend.Rollback()
+	ctx := context.Background()
+	seller := ex.Users[8].PrivateKey
+	gasPrice, _ := backend.SuggestGasPrice(ctx)
+	tx, err := types.SignTx(types.NewTransaction(0, common.HexToAddress("0x1234"), big.NewInt(1), transferGasLimit, gasPrice, nil), types.NewEIP155Signer(big.NewInt(chainID)), seller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SendTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+
+	eventually(t, "expected both transfers reconciled", func() bool {
+		for _, s := range submitted {
+			got, _ := ex.outbox.Get(s.ID)
+			if got.Status != SettlementSubmitted || got.SubmittedAt == s.SubmittedAt {
+				return false
+			}
+		}
+		return true
+	})
+	backend.Commit()
+	waitSettled(t, ex)
+
+	for _, s := range submitted {
+		got, _ := ex.outbox.Get(s.ID)
+		dropped := s.FromUserID == 8
+		if dropped && (got.Attempts != 1 || got.TxHash == s.TxHash || got.Nonce != s.Nonce+1) {
+			t.Fatalf("expected settlement %d queued again with a new transaction, got %+v", s.ID, got)
+		}
+		if !dropped && (got.Attempts != 0 || got.TxHash != s.TxHash) {
+			t.Fatalf("expected settlement %d sent again as it was, got %+v", s.ID, got)
+		}
+	}
+	balance, err := simulated.BalanceAt(ctx, AssetUSD, crypto.PubkeyToAddress(seller.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := DefaultConfig().Assets[AssetUSD].ToUnits(decimal.NewFromInt(10_000_000 + 20_000)); balance.Cmp(want) != 0 {
+		t.Fatalf("expected seller USD balance %s, got %s", want, balance)
+	}
+	balance, err = simulated.BalanceAt(ctx, AssetETH, crypto.PubkeyToAddress(ex.Users[7].PrivateKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The buyer pays the gas of the USD transfer.
+	want, _ := DefaultConfig().Assets[AssetETH].ToUnits(decimal.NewFromInt(1_000 + 2))
+	if balance.Cmp(want) > 0 || balance.Cmp(new(big.Int).Sub(want, big.NewInt(1e16))) < 0 {
+		t.Fatalf("expected buyer ETH balance about %s, got %s", want, balance)
+	}
+}
+
+func TestInMemorySettlerInsufficientFunds(t *testing.T) {
+	pk, err := crypto.HexToECDSA(exchangePrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(pk.PublicKey)
+	to := common.HexToAddress("0x1")
+
+	ctx := context.Background()
+	settler := NewInMemorySettler(DefaultConfig().Assets, map[Asset]map[common.Address]*big.Int{
+		AssetETH: {from: big.NewInt(5)},
+	})
+	if _, err := settler.Transfer(ctx, AssetETH, pk, to, decimal.New(6, Ether)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if _, err := settler.Transfer(ctx, AssetUSD, pk, to, decimal.New(1, Ether)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if _, err := settler.Transfer(ctx, AssetETH, pk, to, decimal.New(5, Ether)); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := settler.BalanceAt(ctx, AssetETH, to); balance.Cmp(big.NewInt(5)) != 0 {
+		t.Fatalf("expected balance 5, got %s", balance)
+	}
+}
+
+// TestConfirmationWatcher confirms the settlements of a trade once their
+// transfers are deep enough and sends them again when a reorg drops them.
+func TestConfirmationWatcher(t *testing.T) {
+	userDataList := []UserData{
+		{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits},
+		{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits},
+	}
+
+	cfg := testConfig(SimulatedSettler)
+	cfg.Confirmations = 2
+	settler, err := NewSettler(cfg, testAccounts(t, userDataList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := settler.(*SimulatedBackendSettler).backend
+	ex, err := NewExchange(exchangePrivateKey, settler, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.settlementBackoff = time.Millisecond
+	for _, userData := range userDataList {
+		if _, err := ex.AddUser(userData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(newRouter(ex))
+	defer srv.Close()
+
+	ctx := context.Background()
+	genesis, err := backend.BlockByNumber(ctx, big.NewInt(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*PlaceOrderRequest{
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: decimal.NewFromInt(2), Price: decimal.NewFromInt(10_000), Market: MarketETH},
+		{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(2), Market: MarketETH},
+	} {
+		if err := doRequest(srv, http.MethodPost, "/order", req, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trade := func(userID int64) *TradeSettlement {
+		var trades []*TradeSettlement
+		if err := doRequest(srv, http.MethodGet, fmt.Sprintf("/settlements/%d", userID), nil, &trades); err != nil {
+			t.Fatal(err)
+		}
+		if len(trades) != 1 || len(trades[0].Settlements) != 2 {
+			t.Fatalf("expected 1 trade with 2 settlements, got %d", len(trades))
+		}
+		return trades[0]
+	}
+
+	// Each transfer is mined into a block of its own, the one mined last is
+	// only 1 block deep.
+	eventually(t, "expected the first transfer mined confirmed", func() bool {
+		tr := trade(7)
+		return tr.Settlements[0].Status != tr.Settlements[1].Status &&
+			tr.Settlements[0].Confirmations+tr.Settlements[1].Confirmations == 3
+	})
+	if tr := trade(8); tr.Status != SettlementSubmitted || tr.AskOrderID == 0 || tr.BidOrderID == 0 {
+		t.Fatalf("expected the trade submitted, got %+v", tr)
+	}
+	backend.Commit()
+	eventually(t, "expected the trade confirmed", func() bool { return trade(8).Status == SettlementConfirmed })
+
+	// A longer chain without the transfers replaces the one with them. Their
+	// transactions are sent again as they were, the nonces start over.
+	if err := backend.Fork(ctx, genesis.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		backend.Commit()
+	}
+	eventually(t, "expected the reorged transfers sent again", func() bool {
+		tr := trade(7)
+		return tr.Settlements[0].Reorgs == 1 && tr.Settlements[1].Reorgs == 1 && tr.Status == SettlementSubmitted
+	})
+	backend.Commit()
+	waitSettled(t, ex)
+
+	units := func(asset Asset, amount int64) *big.Int {
+		n, _ := cfg.Assets[asset].ToUnits(decimal.NewFromInt(amount))
+		return n
+	}
+	balance, err := settler.BalanceAt(ctx, AssetUSD, crypto.PubkeyToAddress(ex.Users[8].PrivateKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := units(AssetUSD, 10_000_000+20_000); balance.Cmp(want) != 0 {
+		t.Fatalf("expected seller USD balance %s, got %s", want, balance)
+	}
+}
+
+// TestNonceManager sends transfers of one account on the simulated chain
+// without mining in between.
+func TestNonceManager(t *testing.T) {
+	pk, err := crypto.HexToECDSA(exchangePrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(pk.PublicKey)
+	to := common.HexToAddress("0x1234")
+
+	backend := backends.NewSimulatedBackend(core.GenesisAlloc{from: {Balance: big.NewInt(1e18)}}, simulatedGasLimit)
+	defer backend.Close()
+	settler := newChainSettler(backend, DefaultConfig().Assets, 1)
+	ctx := context.Background()
+
+	expect := func(nonce uint64, balance int64) {
+		t.Helper()
+		if got, _ := backend.NonceAt(ctx, from, nil); got != nonce {
+			t.Fatalf("expected nonce %d, got %d", nonce, got)
+		}
+		if got, _ := backend.BalanceAt(ctx, to, nil); got.Cmp(big.NewInt(balance)) != 0 {
+			t.Fatalf("expected balance %d, got %s", balance, got)
+		}
+	}
+
+	// Concurrent transfers get a nonce each.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := settler.Transfer(ctx, AssetETH, pk, to, decimal.New(1, Ether)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	backend.Commit()
+	expect(10, 10)
+
+	// A nonce used behind the back of the manager fails one transfer, the
+	// next one is synced with the chain again.
+	gasPrice, _ := backend.SuggestGasPrice(ctx)
+	tx, err := types.SignTx(types.NewTransaction(10, to, big.NewInt(1), transferGasLimit, gasPrice, nil), types.NewEIP155Signer(big.NewInt(chainID)), pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SendTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settler.Transfer(ctx, AssetETH, pk, to, decimal.New(1, Ether)); err == nil {
+		t.Fatal("expected the used nonce to be refused")
+	}
+	if _, err := settler.Transfer(ctx, AssetETH, pk, to, decimal.New(1, Ether)); err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+	expect(12, 12)
+
+	// A transfer that is dropped before it is mined is stuck and replaced
+	// with a higher gas price.
+	if _, err := settler.Transfer(ctx, AssetETH, pk, to, decimal.New(1, Ether)); err != nil {
+		t.Fatal(err)
+	}
+	stuck, err := settler.nonces.Stuck(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stuck) != 1 || stuck[0].Tx.Nonce() != 12 {
+		t.Fatalf("expected the transfer with nonce 12 stuck, got %d", len(stuck))
+	}
+	backend.Rollback()
+
+	replaced, err := settler.nonces.ReplaceStuck(ctx, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 1 || replaced[0].Nonce() != 12 {
+		t.Fatalf("expected the transfer with nonce 12 replaced, got %d", len(replaced))
+	}
+	minPrice := new(big.Int).Mul(stuck[0].Tx.GasPrice(), big.NewInt(100+gasBumpPercent))
+	if replaced[0].GasPrice().Mul(replaced[0].GasPrice(), big.NewInt(100)).Cmp(minPrice) < 0 {
+		t.Fatalf("expected the gas price bumped by %d%%, got %s from %s", gasBumpPercent, replaced[0].GasPrice(), stuck[0].Tx.GasPrice())
+	}
+	backend.Commit()
+	expect(13, 13)
+
+	if stuck, _ := settler.nonces.Stuck(ctx, 0); len(stuck) != 0 {
+		t.Fatalf("expected nothing stuck once mined, got %d", len(stuck))
+	}
+}
+
+func TestChainAssetToUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		asset    ChainAsset
+		amount   string
+		expected string
+		err      bool
+	}{
+		{name: "ether in wei", asset: ChainAsset{Decimals: Ether}, amount: "1.5", expected: "1500000000000000000"},
+		{name: "one gwei", asset: ChainAsset{Decimals: Ether}, amount: "0.000000001", expected: "1000000000"},
+		{name: "gwei", asset: ChainAsset{Decimals: Gwei}, amount: "2.25", expected: "2250000000"},
+		{name: "wei", asset: ChainAsset{Decimals: Wei}, amount: "7", expected: "7"},
+		{name: "token", asset: ChainAsset{Decimals: 6}, amount: "15000.375", expected: "15000375000"},
+		{name: "too many decimals", asset: ChainAsset{Decimals: 6}, amount: "0.1234567", err: true},
+		{name: "negative", asset: ChainAsset{Decimals: Ether}, amount: "-1", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.asset.ToUnits(decimal.RequireFromString(tt.amount))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestLedgerHolds(t *testing.T) {
+	ex, srv := newTestExchange(t)
+
+	account := func(userID int64) map[Asset]AssetBalance {
+		var resp AccountResponse
+		if err := doRequest(srv, http.MethodGet, fmt.Sprintf("/account/%d", userID), nil, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Balances
+	}
+	expect := func(userID int64, asset Asset, available, held int64) {
+		t.Helper()
+		balance := account(userID)[asset]
+		if !balance.Available.Equal(decimal.NewFromInt(available)) || !balance.Held.Equal(decimal.NewFromInt(held)) {
+			t.Fatalf("expected %s of user %d to be %d available and %d held, got %s and %s", asset, userID, available, held, balance.Available, balance.Held)
+		}
+	}
+	place := func(userID int64, bid bool, size, price int64) (PlaceOrderResponse, error) {
+		var resp PlaceOrderResponse
+		req := &PlaceOrderRequest{UserID: userID, Type: LimitOrder, Bid: bid, Size: decimal.NewFromInt(size), Price: decimal.NewFromInt(price), Market: MarketETH}
+		if price == 0 {
+			req.Type = MarketOrder
+		}
+		return resp, doRequest(srv, http.MethodPost, "/order", req, &resp)
+	}
+
+	// Orders beyond the available balance never reach the book.
+	if _, err := place(7, true, 1_001, 10_000); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatal("expected a bid beyond the USD balance to be rejected")
+	}
+	if _, err := place(8, false, 1_001, 10_000); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatal("expected an ask beyond the ETH balance to be rejected")
+	}
+	if snap := ex.engine(MarketETH).Snapshot(); len(snap.Book.Bids) != 0 || len(snap.Book.Asks) != 0 {
+		t.Fatalf("expected an empty book, got %d bids and %d asks", len(snap.Book.Bids), len(snap.Book.Asks))
+	}
+
+	// Resting orders hold their size or notional, cancelling releases it.
+	bid, err := place(7, true, 100, 9_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(7, AssetUSD, 9_100_000, 900_000)
+	if err := doRequest(srv, http.MethodPut, fmt.Sprintf("/book/ETH/order/%d", bid.OrderID), &AmendOrderRequest{Price: decimal.NewFromInt(9_000), Size: decimal.NewFromInt(1_200)}, nil); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatal("expected an amend beyond the USD balance to be rejected")
+	}
+	expect(7, AssetUSD, 9_100_000, 900_000)
+	if err := doRequest(srv, http.MethodDelete, fmt.Sprintf("/book/ETH/order/%d", bid.OrderID), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(7, AssetUSD, 10_000_000, 0)
+
+	// Fills move the base to the buyer and the notional to the seller. The
+	// taker bid at 10,100 pays the resting ask price and gets the rest back.
+	if _, err := place(8, false, 10, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	expect(8, AssetETH, 990, 10)
+	if _, err := place(7, true, 4, 10_100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := place(7, true, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	expect(7, AssetETH, 1_006, 0)
+	expect(7, AssetUSD, 9_940_000, 0)
+	expect(8, AssetETH, 990, 4)
+	expect(8, AssetUSD, 10_060_000, 0)
+
+	// Every entry is balanced, so every asset adds up to zero with the
+	// deposits.
+	sums := make(map[Asset]decimal.Decimal)
+	for _, book := range ex.ledger.books {
+		for account, amount := range book {
+			sums[account.Asset] = sums[account.Asset].Add(amount)
+		}
+	}
+	for asset, sum := range sums {
+		if !sum.IsZero() {
+			t.Fatalf("expected %s to add up to zero, got %s", asset, sum)
+		}
+	}
+
+	// Deposits that would overflow a balance are refused without a trace.
+	huge := decimal.New(math.MaxInt64, ethSizeScale)
+	if err := ex.ledger.Deposit(7, AssetETH, huge); !errors.Is(err, decimal.ErrOverflow) {
+		t.Fatalf("expected a deposit of %s to overflow, got %v", huge, err)
+	}
+	expect(7, AssetETH, 1_006, 0)
+
+	// A stop market bid holds its notional at the stop price. When it
+	// triggers above it, the hold is extended to what filling it costs.
+	stop := func(userID int64, size, stopPrice int64) int64 {
+		t.Helper()
+		var resp PlaceOrderResponse
+		req := &PlaceOrderRequest{UserID: userID, Type: StopMarketOrder, Bid: true, Size: decimal.NewFromInt(size), StopPrice: decimal.NewFromInt(stopPrice), Market: MarketETH}
+		if err := doRequest(srv, http.MethodPost, "/order", req, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.OrderID
+	}
+	if _, err := place(7, true, 4, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	stop(7, 2, 11_000)
+	expect(7, AssetUSD, 9_878_000, 22_000)
+	if _, err := place(8, false, 1, 11_000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := place(8, false, 2, 12_000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := place(7, true, 1, 11_000); err != nil {
+		t.Fatal(err)
+	}
+	expect(7, AssetETH, 1_013, 0)
+	expect(7, AssetUSD, 9_865_000, 0)
+	expect(8, AssetETH, 987, 0)
+	expect(8, AssetUSD, 10_135_000, 0)
+
+	// One that cannot afford it is rejected and releases its hold.
+	rejected := stop(7, 780, 12_500)
+	expect(7, AssetUSD, 115_000, 9_750_000)
+	if _, err := place(8, false, 1, 12_500); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := place(8, false, 780, 13_000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := place(7, true, 1, 12_500); err != nil {
+		t.Fatal(err)
+	}
+	if ex.orderbook(MarketETH).HasStopOrder(rejected) {
+		t.Fatal("expected the stop order to have triggered")
+	}
+	expect(7, AssetETH, 1_014, 0)
+	expect(7, AssetUSD, 9_852_500, 0)
+	expect(8, AssetETH, 206, 780)
+	var orders OrderHistoryResponse
+	if err := doRequest(srv, http.MethodGet, "/orders/7/history?limit=2", nil, &orders); err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.Orders) != 2 || orders.Orders[1].ID != rejected || orders.Orders[1].Status != OrderRejected {
+		t.Fatalf("expected stop order %d to be rejected, got %+v", rejected, orders.Orders)
+	}
+
+	// Asks within the max notional can still add up to more than USD can
+	// be kept with. A market bid for all of them is refused, the engine
+	// goes on.
+	for i := 0; i < 10; i++ {
+		if _, err := place(8, false, 10, 10_000_000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var apiErr *Error
+	req := &PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(880), Market: MarketETH}
+	if err := doRequest(srv, http.MethodPost, "/order", req, nil); !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest || apiErr.Code != CodeInvalidRequest {
+		t.Fatalf("expected a market bid that overflows to be rejected with 400, got %v", err)
+	}
+	if _, err := place(7, true, 1, 13_000); err != nil {
+		t.Fatal(err)
+	}
+	expect(7, AssetETH, 1_015, 0)
+}
+
+func TestClientOrderID(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+
+	start := func() (*Exchange, *httptest.Server) {
+		ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.snapshotEvery = 1
+		if err := ex.Recover(path, dir); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(newRouter(ex))
+		t.Cleanup(srv.Close)
+		return ex, srv
+	}
+
+	ex, srv := start()
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+
+	place := func(srv *httptest.Server, price int64) int64 {
+		var resp PlaceOrderResponse
+		err := doRequest(srv, http.MethodPost, "/order", &PlaceOrderRequest{
+			UserID:        7,
+			Type:          LimitOrder,
+			Bid:           true,
+			Size:          decimal.NewFromInt(1),
+			Price:         decimal.NewFromInt(price),
+			Market:        MarketETH,
+			ClientOrderID: "my-order",
+		}, &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.OrderID
+	}
+
+	// A resubmission gets the first reply and places nothing.
+	id := place(srv, 9_000)
+	if dup := place(srv, 9_100); dup != id {
+		t.Fatalf("expected order %d again, got %d", id, dup)
+	}
+	if orders := ex.engine(MarketETH).Snapshot().Orders[7]; len(orders) != 1 || orders[0].ClientOrderID != "my-order" {
+		t.Fatalf("expected 1 order with the client order id, got %v", orders)
+	}
+
+	var resp ClientOrderResponse
+	if err := doRequest(srv, http.MethodGet, "/book/ETH/orders/7/client/my-order", nil, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.OrderID != id || resp.Order == nil || !resp.Order.Price.Equal(decimal.NewFromInt(9_000)) {
+		t.Fatalf("expected resting order %d at 9000, got %+v", id, resp)
+	}
+	if err := doRequest(srv, http.MethodGet, "/book/ETH/orders/8/client/my-order", nil, nil); !errors.Is(err, orderbook.ErrOrderNotFound) {
+		t.Fatal("expected client order ids to be per user")
+	}
+
+	// The client order id is still taken after a restart from the snapshot
+	// alone, and new order ids come after the old ones.
+	keepJournal(t, path, func(cmd Command) bool { return cmd.Type == AddUserCommand })
+	restarted, srv := start()
+	if dup := place(srv, 9_100); dup != id {
+		t.Fatalf("expected order %d after restart, got %d", id, dup)
+	}
+	if next := restarted.newOrderID(); next <= id {
+		t.Fatalf("expected an order id after %d, got %d", id, next)
+	}
+
+	if err := doRequest(srv, http.MethodDelete, "/book/ETH/orders/7/client/my-order", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp = ClientOrderResponse{}
+	if err := doRequest(srv, http.MethodGet, "/book/ETH/orders/7/client/my-order", nil, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.OrderID != id || resp.Order != nil {
+		t.Fatalf("expected order %d to be gone from the book, got %+v", id, resp)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+
+	ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.Recover(path, dir); err != nil {
+		t.Fatal(err)
+	}
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+
+	place := func(userID int64, typ OrderType, bid bool, size, price int64) CommandResult {
+		return ex.submit(Command{
+			Type:   PlaceOrderCommand,
+			Market: MarketETH,
+			Order: &PlaceOrderRequest{
+				UserID: userID,
+				Type:   typ,
+				Bid:    bid,
+				Size:   decimal.New(size, ethSizeScale),
+				Price:  decimal.New(price, ethPriceScale),
+				Market: MarketETH,
+			},
+		})
+	}
+
+	var want []string
+	record := func(seq uint64, matches []orderbook.Match) {
+		for _, m := range matches {
+			want = append(want, fmt.Sprintf("%d %d %d %s %s", seq, m.Ask.ID, m.Bid.ID, m.Price, m.SizeFilled))
+		}
+	}
+
+	ask := place(8, LimitOrder, false, 5, 10_000)
+	record(ask.Seq, ask.Matches)
+	res := place(7, LimitOrder, true, 2, 10_000)
+	record(res.Seq, res.Matches)
+	res = place(7, MarketOrder, true, 1, 0)
+	record(res.Seq, res.Matches)
+	bid := place(7, LimitOrder, true, 4, 9_900)
+	res = ex.submit(Command{Type: AmendOrderCommand, Market: MarketETH, OrderID: bid.Order.ID, Price: decimal.New(10_000, ethPriceScale), Size: decimal.New(3, ethSizeScale)})
+	record(res.Seq, res.Matches)
+	lastPlaced := place(8, LimitOrder, false, 1, 10_100)
+	last := ex.submit(Command{Type: CancelOrderCommand, Market: MarketETH, OrderID: bid.Order.ID})
+
+	if len(want) != 3 {
+		t.Fatalf("expected 3 matches, got %d", len(want))
+	}
+	// The two users were journaled first.
+	if last.Seq != 9 {
+		t.Fatalf("expected 9 journaled commands, got %d", last.Seq)
+	}
+
+	// A restart rebuilds the same book and keeps numbering the commands.
+	restarted, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Recover(path, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	before, after := ex.engine(MarketETH).Snapshot(), restarted.engine(MarketETH).Snapshot()
+	if after.Seq != before.Seq {
+		t.Fatalf("expected seq %d after replay, got %d", before.Seq, after.Seq)
+	}
+	gotBook, _ := json.Marshal(after.Book)
+	wantBook, _ := json.Marshal(before.Book)
+	if !bytes.Equal(gotBook, wantBook) {
+		t.Fatalf("expected book %s after replay, got %s", wantBook, gotBook)
+	}
+	if len(restarted.Users) != 2 || len(restarted.Orders[MarketETH][8]) != 1 {
+		t.Fatalf("expected 2 users and 1 order of user 8, got %d and %d", len(restarted.Users), len(restarted.Orders[MarketETH][8]))
+	}
+	if res := restarted.submit(Command{Type: CancelOrderCommand, Market: MarketETH, OrderID: ask.Order.ID}); res.Seq != 10 {
+		t.Fatalf("expected seq 10, got %d", res.Seq)
+	}
+	if id := restarted.newOrderID(); id != lastPlaced.Order.ID+1 {
+		t.Fatalf("expected order id %d after replay, got %d", lastPlaced.Order.ID+1, id)
+	}
+
+	// The matches of a range come out the same.
+	var got []string
+	err = ReplayJournal(path, DefaultConfig().Markets, 3, 5, func(cmd Command, matches []orderbook.Match) {
+		for _, m := range matches {
+			got = append(got, fmt.Sprintf("%d %d %d %s %s", cmd.Seq, m.Ask.ID, m.Bid.ID, m.Price, m.SizeFilled))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want[:2], "\n") {
+		t.Fatalf("expected matches\n%s\ngot\n%s", strings.Join(want[:2], "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+
+	start := func() *Exchange {
+		ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.snapshotEvery = 3
+		if err := ex.Recover(path, dir); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	bookJSON := func(ex *Exchange) string {
+		b, _ := json.Marshal(ex.engine(MarketETH).Snapshot())
+		return string(b)
+	}
+
+	ex := start()
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+
+	// Bids at 100.00 and asks from 100.00 up, so only the first ask matches.
+	for i := int64(0); i < 8; i++ {
+		price := int64(10_000)
+		if i%2 == 1 {
+			price += i - 1
+		}
+		res := ex.submit(Command{
+			Type:   PlaceOrderCommand,
+			Market: MarketETH,
+			Order: &PlaceOrderRequest{
+				UserID:      7 + i%2,
+				Type:        LimitOrder,
+				Bid:         i%2 == 0,
+				Size:        decimal.New(3, ethSizeScale),
+				Price:       decimal.New(price, ethPriceScale),
+				Market:      MarketETH,
+				DisplaySize: decimal.New(1, ethSizeScale),
+			},
+		})
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+
+	// Snapshots are taken after seq 5 and 8, the journal goes on to 10.
+	paths, err := snapshotPaths(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0] != snapshotPath(dir, 8) {
+		t.Fatalf("expected snapshots up to seq 8, got %v", paths)
+	}
+	want := bookJSON(ex)
+	if snap := ex.engine(MarketETH).Snapshot(); len(snap.Book.Bids) == 0 || len(snap.Book.Asks) == 0 || !ex.position(MarketETH, 7).IsPositive() {
+		t.Fatalf("expected orders on both sides and a position, got %s", want)
+	}
+
+	journal, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the journal tail is replayed on top of the latest snapshot, the
+	// commands before it are not even needed anymore.
+	keepJournal(t, path, func(cmd Command) bool { return cmd.Type == AddUserCommand || cmd.Seq > 8 })
+	restarted := start()
+	if got := bookJSON(restarted); got != want {
+		t.Fatalf("expected book\n%s\ngot\n%s", want, got)
+	}
+	if !restarted.position(MarketETH, 7).Equal(ex.position(MarketETH, 7)) {
+		t.Fatalf("expected position %s, got %s", ex.position(MarketETH, 7), restarted.position(MarketETH, 7))
+	}
+	if len(restarted.Orders[MarketETH][7]) != len(ex.Orders[MarketETH][7]) {
+		t.Fatalf("expected %d orders of user 7, got %d", len(ex.Orders[MarketETH][7]), len(restarted.Orders[MarketETH][7]))
+	}
+	for _, userID := range []int64{7, 8} {
+		want, _ := json.Marshal(ex.ledger.Balances(userID))
+		got, _ := json.Marshal(restarted.ledger.Balances(userID))
+		if !bytes.Equal(got, want) {
+			t.Fatalf("expected balances %s of user %d, got %s", want, userID, got)
+		}
+	}
+
+	// A corrupt snapshot is skipped for the one before it.
+	b, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(paths[0], bytes.Replace(b, []byte("100.00"), []byte("101.00"), 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSnapshot(paths[0]); !errors.Is(err, ErrSnapshotChecksum) {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	if err := os.WriteFile(path, journal, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keepJournal(t, path, func(cmd Command) bool { return cmd.Type == AddUserCommand || cmd.Seq > 5 })
+	restarted = start()
+	if got := bookJSON(restarted); got != want {
+		t.Fatalf("expected book\n%s\ngot\n%s", want, got)
+	}
+
+	// New commands are numbered after the journal.
+	bid := ex.engine(MarketETH).Snapshot().Book.Bids[0]
+	if res := restarted.submit(Command{Type: CancelOrderCommand, Market: MarketETH, OrderID: bid.ID}); res.Err != nil || res.Seq != 11 {
+		t.Fatalf("expected seq 11, got %d (%v)", res.Seq, res.Err)
+	}
+}
+
+// TestSnapshotAcrossMarkets checks a restart sees the balances every command
+// saw, even when one market applied many more commands than another since
+// the snapshot.
+func TestSnapshotAcrossMarkets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+
+	start := func() *Exchange {
+		ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.snapshotEvery = 3
+		if err := ex.Recover(path, dir); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	place := func(ex *Exchange, market Market, userID int64, bid bool, price string) CommandResult {
+		return ex.submit(Command{Type: PlaceOrderCommand, Market: market, Order: &PlaceOrderRequest{
+			UserID: userID,
+			Type:   LimitOrder,
+			Bid:    bid,
+			Size:   decimal.NewFromInt(1),
+			Price:  decimal.RequireFromString(price),
+			Market: market,
+		}})
+	}
+
+	ex := start()
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: map[Asset]decimal.Decimal{AssetUSD: decimal.NewFromInt(1_000)}})
+	btc := MarketConfig{Symbol: "BTC", Base: "BTC", Quote: AssetUSD, TickSize: decimal.RequireFromString("0.5"), LotSize: decimal.RequireFromString("0.001")}
+	if err := ex.AddMarket(btc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.Deposit(DepositRequest{UserID: 8, Asset: "BTC", Amount: decimal.NewFromInt(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ETH bid holds most of the USD of user 7, so their BTC bid is
+	// refused. The snapshot is taken after it, the ETH bid is cancelled
+	// after that.
+	bid := place(ex, MarketETH, 7, true, "900")
+	if bid.Err != nil {
+		t.Fatal(bid.Err)
+	}
+	if res := place(ex, "BTC", 8, false, "900"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if res := place(ex, "BTC", 7, true, "900"); !errors.Is(res.Err, ErrInsufficientBalance) {
+		t.Fatalf("expected the BTC bid to be refused, got %v", res.Err)
+	}
+	if snap, err := LatestSnapshot(dir); err != nil || snap == nil || snap.Seq != 7 || len(snap.Markets) != 2 {
+		t.Fatalf("expected a snapshot of both markets at seq 7, got %+v %v", snap, err)
+	}
+	if res := ex.submit(Command{Type: CancelOrderCommand, Market: MarketETH, OrderID: bid.Order.ID}); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if res := place(ex, MarketETH, 8, false, "2000"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	restarted := start()
+	if asks := restarted.engine("BTC").Snapshot().Book.Asks; len(asks) != 1 {
+		t.Fatalf("expected the BTC ask to still rest, got %d asks", len(asks))
+	}
+	for _, userID := range []int64{7, 8} {
+		want, _ := json.Marshal(ex.ledger.Balances(userID))
+		got, _ := json.Marshal(restarted.ledger.Balances(userID))
+		if !bytes.Equal(got, want) {
+			t.Fatalf("expected balances %s of user %d, got %s", want, userID, got)
+		}
+	}
+}
+
+// keepJournal rewrites the journal at path with only the commands keep
+// returns true for.
+func keepJournal(t *testing.T, path string, keep func(Command) bool) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := ReadJournal(path, func(cmd Command) error {
+		if keep(cmd) {
+			b, err := json.Marshal(cmd)
+			buf.Write(append(b, '\n'))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReduceOnlyAcrossMarkets checks the reduce-only orders of a user in one
+// market are held against their position in that market only.
+func TestReduceOnlyAcrossMarkets(t *testing.T) {
+	ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+	btc := MarketConfig{Symbol: "BTC", Base: "BTC", Quote: AssetUSD, TickSize: decimal.RequireFromString("0.5"), LotSize: decimal.RequireFromString("0.001")}
+	if err := ex.AddMarket(btc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.Deposit(DepositRequest{UserID: 8, Asset: "BTC", Amount: decimal.NewFromInt(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	place := func(market Market, userID int64, bid, reduceOnly bool, size, price string) CommandResult {
+		t.Helper()
+		res := ex.submit(Command{Type: PlaceOrderCommand, Market: market, Order: &PlaceOrderRequest{
+			UserID:     userID,
+			Type:       LimitOrder,
+			Bid:        bid,
+			Size:       decimal.RequireFromString(size),
+			Price:      decimal.RequireFromString(price),
+			Market:     market,
+			ReduceOnly: reduceOnly,
+		}})
+		if res.Err != nil {
+			t.Fatalf("%s order of user %d: %v", market, userID, res.Err)
+		}
+		return res
+	}
+
+	// User 7 is long 1 in both markets and asks to close both positions.
+	for _, market := range []Market{MarketETH, "BTC"} {
+		place(market, 8, false, false, "1", "1000")
+		place(market, 7, true, false, "1", "1000")
+	}
+	ethAsk := place(MarketETH, 7, false, true, "1", "2000")
+	btcAsk := place("BTC", 7, false, true, "1", "2000")
+
+	// Selling half of the ETH position leaves the ETH reduce-only ask too
+	// large, the BTC one still fits the BTC position.
+	place(MarketETH, 7, false, false, "0.5", "1000")
+	place(MarketETH, 8, true, false, "0.5", "1000")
+
+	if _, ok := ex.orderbook(MarketETH).Orders[ethAsk.Order.ID]; ok {
+		t.Fatal("expected the ETH reduce-only ask to be cancelled")
+	}
+	btcBook := ex.engine("BTC").Snapshot().Book
+	if len(btcBook.Asks) != 1 || btcBook.Asks[0].ID != btcAsk.Order.ID {
+		t.Fatalf("expected the BTC reduce-only ask to rest, got %+v", btcBook.Asks)
+	}
+	if orders := ex.Orders["BTC"][7]; len(orders) != 1 || orders[0].ID != btcAsk.Order.ID {
+		t.Fatalf("expected the BTC ask to be the only BTC order of user 7, got %+v", orders)
+	}
+	if orders := ex.Orders[MarketETH][7]; len(orders) != 0 {
+		t.Fatalf("expected no ETH orders of user 7, got %+v", orders)
+	}
+}
+
+// TestUnsettledMatch checks a match the ledger refuses halts its market.
+func TestUnsettledMatch(t *testing.T) {
+	ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+
+	place := func(userID int64, bid bool) CommandResult {
+		return ex.submit(Command{Type: PlaceOrderCommand, Market: MarketETH, Order: &PlaceOrderRequest{
+			UserID: userID,
+			Type:   LimitOrder,
+			Bid:    bid,
+			Size:   decimal.NewFromInt(1),
+			Price:  decimal.NewFromInt(1_000),
+			Market: MarketETH,
+		}})
+	}
+
+	// The ETH of the ask leaves the ledger behind the back of the book.
+	ask := place(8, false)
+	if ask.Err != nil {
+		t.Fatal(ask.Err)
+	}
+	if err := ex.ledger.Release(ask.Order.ID, ex.ledger.HoldOf(ask.Order.ID)); err != nil {
+		t.Fatal(err)
+	}
+	eth := ex.ledger.Balance(Account{UserID: 8, Asset: AssetETH, Type: AvailableAccount})
+	err = ex.ledger.Post(depositBook,
+		Posting{Account: Account{UserID: 8, Asset: AssetETH, Type: AvailableAccount}, Amount: eth.Neg()},
+		Posting{Account: Account{UserID: 8, Asset: AssetETH, Type: ExternalAccount}, Amount: eth},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bid := place(7, true)
+	if !errors.Is(bid.Err, ErrUnsettled) || len(bid.Matches) != 1 {
+		t.Fatalf("expected the match to be refused by the ledger, got %d matches and %v", len(bid.Matches), bid.Err)
+	}
+	if ex.trading(MarketETH) {
+		t.Fatal("expected the market to be halted")
+	}
+	if res := place(7, true); !errors.Is(res.Err, ErrMarketHalted) {
+		t.Fatalf("expected the market to refuse orders, got %v", res.Err)
+	}
+}
+
+func TestMarkets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+
+	start := func() (*Exchange, *httptest.Server) {
+		ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.snapshotEvery = 2
+		ex.testDeposits = true
+		if err := ex.Recover(path, dir); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(newRouter(ex))
+		t.Cleanup(srv.Close)
+		return ex, srv
+	}
+
+	ex, srv := start()
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+
+	btc := MarketConfig{
+		Symbol:   "BTC",
+		Base:     "BTC",
+		Quote:    AssetUSD,
+		TickSize: decimal.RequireFromString("0.5"),
+		LotSize:  decimal.RequireFromString("0.001"),
+		MinSize:  decimal.RequireFromString("0.01"),
+		MaxSize:  decimal.NewFromInt(10),
+	}
+	if err := doRequest(srv, http.MethodPost, "/admin/markets", &btc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := doRequest(srv, http.MethodPost, "/admin/markets", &btc, nil); !errors.Is(err, ErrMarketExists) {
+		t.Fatal("expected a second BTC market to be rejected")
+	}
+	invalid := btc
+	invalid.Symbol = "btc-usd"
+	if err := doRequest(srv, http.MethodPost, "/admin/markets", &invalid, nil); err == nil {
+		t.Fatal("expected an invalid symbol to be rejected")
+	}
+	invalid = btc
+	invalid.Symbol = "XBT"
+	invalid.TakerFee = decimal.NewFromInt(1)
+	if err := doRequest(srv, http.MethodPost, "/admin/markets", &invalid, nil); err == nil {
+		t.Fatal("expected a fee of 1 to be rejected")
+	}
+
+	var markets []MarketConfig
+	if err := doRequest(srv, http.MethodGet, "/markets", nil, &markets); err != nil {
+		t.Fatal(err)
+	}
+	if len(markets) != 2 || markets[0].Symbol != "BTC" || markets[0].Status != MarketTrading || markets[1].Symbol != MarketETH {
+		t.Fatalf("expected the BTC and ETH markets, got %+v", markets)
+	}
+
+	if err := doRequest(srv, http.MethodPost, "/deposit", &DepositRequest{UserID: 8, Asset: "BTC", Amount: decimal.NewFromInt(5)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	place := func(userID int64, typ OrderType, bid bool, size, price string) (PlaceOrderResponse, error) {
+		var resp PlaceOrderResponse
+		req := &PlaceOrderRequest{UserID: userID, Type: typ, Bid: bid, Size: decimal.RequireFromString(size), Price: decimal.RequireFromString(price), Market: "BTC"}
+		return resp, doRequest(srv, http.MethodPost, "/order", req, &resp)
+	}
+
+	first, err := place(8, LimitOrder, false, "1", "30000.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ size, price string }{
+		{"1", "30000.25"},
+		{"0.0005", "30000"},
+		{"0.005", "30000"},
+		{"11", "30000"},
+	} {
+		if _, err := place(8, LimitOrder, false, tc.size, tc.price); err == nil {
+			t.Fatalf("expected an ask of %s at %s to be rejected", tc.size, tc.price)
+		}
+	}
+	second, err := place(8, LimitOrder, false, "1", "30001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var book OrderbookData
+	if err := doRequest(srv, http.MethodGet, "/book/ETH", nil, &book); err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Asks) != 0 {
+		t.Fatalf("expected no asks in the ETH book, got %d", len(book.Asks))
+	}
+
+	// A halted market only takes cancels.
+	if err := doRequest(srv, http.MethodPut, "/admin/markets/BTC/status", &SetMarketStatusRequest{Status: MarketHalted}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := doRequest(srv, http.MethodDelete, fmt.Sprintf("/book/BTC/order/%d", second.OrderID), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := place(7, MarketOrder, true, "1", "0"); err == nil {
+		t.Fatal("expected an order in a halted market to be rejected")
+	}
+
+	// The added market comes back from its snapshot, halted.
+	if snap, err := LatestSnapshot(dir); err != nil || snap == nil || snap.market("BTC") == nil {
+		t.Fatalf("expected a snapshot of BTC, got %v", err)
+	}
+	restarted, srv := start()
+	cfg, ok := restarted.MarketConfig("BTC")
+	if !ok || cfg.Status != MarketHalted || !cfg.TickSize.Equal(btc.TickSize) {
+		t.Fatalf("expected the halted BTC market after a restart, got %+v", cfg)
+	}
+	if err := doRequest(srv, http.MethodGet, "/book/BTC", nil, &book); err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Asks) != 1 || book.Asks[0].ID != first.OrderID {
+		t.Fatalf("expected order %d to be the only ask, got %+v", first.OrderID, book.Asks)
+	}
+
+	if err := doRequest(srv, http.MethodPut, "/admin/markets/BTC/status", &SetMarketStatusRequest{Status: MarketTrading}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := place(7, MarketOrder, true, "1", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.ledger.Balances(7)["BTC"].Available; !got.Equal(decimal.NewFromInt(1)) {
+		t.Fatalf("expected user 7 to hold 1 BTC, got %s", got)
+	}
+}
+
+func TestOrderRules(t *testing.T) {
+	ex, srv := newTestExchange(t)
+	btc := MarketConfig{
+		Symbol:      "BTC",
+		Base:        "BTC",
+		Quote:       AssetUSD,
+		TickSize:    decimal.RequireFromString("0.5"),
+		LotSize:     decimal.RequireFromString("0.001"),
+		MinSize:     decimal.RequireFromString("0.01"),
+		MaxSize:     decimal.NewFromInt(10),
+		MaxPrice:    decimal.NewFromInt(1_000_000),
+		MinNotional: decimal.NewFromInt(100),
+		MaxNotional: decimal.NewFromInt(5_000_000),
+	}
+	if err := ex.AddMarket(btc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.Deposit(DepositRequest{UserID: 8, Asset: "BTC", Amount: decimal.NewFromInt(10)}); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(method, path, body string) (int, Error) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var reply Error
+		json.NewDecoder(resp.Body).Decode(&reply)
+		return resp.StatusCode, reply
+	}
+
+	order := func(typ OrderType, size, price, stopPrice, displaySize string) string {
+		return fmt.Sprintf(`{"UserID":8,"Market":"BTC","Type":%q,"Size":%q,"Price":%q,"StopPrice":%q,"DisplaySize":%q}`, typ, size, price, stopPrice, displaySize)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		reason ErrorCode
+	}{
+		{"limit", order(LimitOrder, "1", "30000.5", "0", "0"), ""},
+		{"market", `{"UserID":7,"Market":"BTC","Type":"MARKET","Bid":true,"Size":"0.01"}`, ""},
+		{"stop limit", order(StopLimitOrder, "1", "30000", "35000", "0"), ""},
+		{"iceberg", order(LimitOrder, "2", "30000", "0", "0.5"), ""},
+		{"not a number", `{"UserID":8,"Market":"BTC","Type":"LIMIT","Size":"1","Price":"NaN"}`, CodeMalformedRequest},
+		{"unknown type", order("LIMTI", "1", "30000", "0", "0"), RejectInvalidOrderType},
+		{"no type", `{"UserID":8,"Market":"BTC","Size":"1","Price":"30000"}`, RejectInvalidOrderType},
+		{"negative price", order(LimitOrder, "1", "-30000", "0", "0"), RejectNegativePrice},
+		{"zero price", order(LimitOrder, "1", "0", "0", "0"), RejectZeroPrice},
+		{"off tick", order(LimitOrder, "1", "30000.25", "0", "0"), RejectInvalidTick},
+		{"too many decimals", order(LimitOrder, "1", "30000.123456789", "0", "0"), RejectInvalidTick},
+		{"stop price off tick", order(StopMarketOrder, "1", "0", "30000.1", "0"), RejectInvalidTick},
+		{"zero stop price", order(StopLimitOrder, "1", "30000", "0", "0"), RejectZeroPrice},
+		{"negative size", order(LimitOrder, "-1", "30000", "0", "0"), RejectNegativeSize},
+		{"zero size", order(MarketOrder, "0", "0", "0", "0"), RejectZeroSize},
+		{"off lot", order(LimitOrder, "1.0005", "30000", "0", "0"), RejectInvalidLot},
+		{"display size off lot", order(LimitOrder, "2", "30000", "0", "0.0001"), RejectInvalidLot},
+		{"below min size", order(LimitOrder, "0.005", "30000", "0", "0"), RejectBelowMinSize},
+		{"above max size", order(MarketOrder, "10.001", "0", "0", "0"), RejectAboveMaxSize},
+		{"below min notional", order(LimitOrder, "0.01", "9999.5", "0", "0"), RejectBelowMinNotional},
+		{"stop below min notional", order(StopMarketOrder, "0.01", "0", "9999.5", "0"), RejectBelowMinNotional},
+		{"at min notional", order(LimitOrder, "0.01", "10000", "0", "0"), ""},
+		{"above max price", order(LimitOrder, "1", "1000000.5", "0", "0"), RejectAboveMaxPrice},
+		{"stop price above max", order(StopMarketOrder, "1", "0", "1000000.5", "0"), RejectAboveMaxPrice},
+		{"above max notional", order(LimitOrder, "10", "600000", "0", "0"), RejectAboveMaxNotional},
+		{"stop above max notional", order(StopLimitOrder, "10", "600000", "500000", "0"), RejectAboveMaxNotional},
+		{"eth above max price", `{"UserID":8,"Market":"ETH","Type":"LIMIT","Size":"999999.99999999","Price":"90000000000.01"}`, RejectAboveMaxPrice},
+		{"eth notional overflows", `{"UserID":8,"Market":"ETH","Type":"LIMIT","Size":"999999.99999999","Price":"9999999.99"}`, RejectAboveMaxNotional},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, reply := post(http.MethodPost, "/order", tc.body)
+			if tc.reason == "" {
+				if status != http.StatusOK {
+					t.Fatalf("expected the order to be placed, got status %d: %s", status, reply.Message)
+				}
+				return
+			}
+			if status != http.StatusBadRequest || reply.Code != tc.reason {
+				t.Fatalf("expected a %s reject, got status %d: %+v", tc.reason, status, reply)
+			}
+		})
+	}
+
+	var resp PlaceOrderResponse
+	req := &PlaceOrderRequest{UserID: 8, Type: LimitOrder, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(40_000), Market: "BTC"}
+	if err := doRequest(srv, http.MethodPost, "/order", req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var stop PlaceOrderResponse
+	req = &PlaceOrderRequest{UserID: 8, Type: StopMarketOrder, Size: decimal.NewFromInt(1), StopPrice: decimal.NewFromInt(20_000), Market: "BTC"}
+	if err := doRequest(srv, http.MethodPost, "/order", req, &stop); err != nil {
+		t.Fatal(err)
+	}
+
+	amendments := []struct {
+		name   string
+		path   string
+		body   string
+		reason ErrorCode
+	}{
+		{"amend off tick", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"40000.1","Size":"1"}`, RejectInvalidTick},
+		{"amend off lot", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"40000","Size":"0.0001"}`, RejectInvalidLot},
+		{"amend below min size", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"40000","Size":"0.002"}`, RejectBelowMinSize},
+		{"amend to zero size", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"40000","Size":"0"}`, RejectZeroSize},
+		{"amend below notional", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"500","Size":"0.1"}`, RejectBelowMinNotional},
+		{"amend above max price", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"1000000.5","Size":"0.1"}`, RejectAboveMaxPrice},
+		{"amend above max notional", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"600000","Size":"10"}`, RejectAboveMaxNotional},
+		{"amend", fmt.Sprintf("/book/BTC/order/%d", resp.OrderID), `{"Price":"41000","Size":"0.5"}`, ""},
+		{"amend stop to negative price", fmt.Sprintf("/book/BTC/stop/%d", stop.OrderID), `{"StopPrice":"-20000","Size":"1"}`, RejectNegativePrice},
+		{"amend stop above max size", fmt.Sprintf("/book/BTC/stop/%d", stop.OrderID), `{"StopPrice":"20000","Size":"11"}`, RejectAboveMaxSize},
+		{"amend stop above max notional", fmt.Sprintf("/book/BTC/stop/%d", stop.OrderID), `{"StopPrice":"600000","Size":"10"}`, RejectAboveMaxNotional},
+		{"amend stop", fmt.Sprintf("/book/BTC/stop/%d", stop.OrderID), `{"StopPrice":"19000","Size":"0.5"}`, ""},
+	}
+	for _, tc := range amendments {
+		t.Run(tc.name, func(t *testing.T) {
+			status, reply := post(http.MethodPut, tc.path, tc.body)
+			if tc.reason == "" {
+				if status != http.StatusOK {
+					t.Fatalf("expected the amendment to be accepted, got status %d: %s", status, reply.Message)
+				}
+				return
+			}
+			if status != http.StatusBadRequest || reply.Code != tc.reason {
+				t.Fatalf("expected a %s reject, got status %d: %+v", tc.reason, status, reply)
+			}
+		})
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	_, srv := newTestExchange(t)
+
+	request := func(method, path, body string) (int, Error) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Fatalf("expected a JSON reply, got %q", ct)
+		}
+		var reply Error
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, reply
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{"unknown market book", http.MethodGet, "/book/XYZ", "", http.StatusNotFound, CodeMarketNotFound},
+		{"unknown market", http.MethodGet, "/markets/XYZ", "", http.StatusNotFound, CodeMarketNotFound},
+		{"order in unknown market", http.MethodPost, "/order", `{"UserID":8,"Market":"XYZ","Type":"LIMIT","Size":"1","Price":"1"}`, http.StatusNotFound, CodeMarketNotFound},
+		{"cancel in unknown market", http.MethodDelete, "/book/XYZ/order/1", "", http.StatusNotFound, CodeMarketNotFound},
+		{"unknown order", http.MethodDelete, "/book/ETH/order/999", "", http.StatusNotFound, CodeOrderNotFound},
+		{"amend unknown order", http.MethodPut, "/book/ETH/order/999", `{"Price":"100","Size":"1"}`, http.StatusNotFound, CodeOrderNotFound},
+		{"unknown client order", http.MethodGet, "/book/ETH/orders/7/client/nope", "", http.StatusNotFound, CodeOrderNotFound},
+		{"unknown stop order", http.MethodDelete, "/book/ETH/stop/999", "", http.StatusNotFound, CodeStopOrderNotFound},
+		{"unknown settlement", http.MethodGet, "/admin/settlements/999", "", http.StatusNotFound, CodeSettlementNotFound},
+		{"deposit for unknown user", http.MethodPost, "/deposit", `{"UserID":99,"Asset":"ETH","Amount":"1"}`, http.StatusNotFound, CodeUserNotFound},
+		{"no bids", http.MethodGet, "/book/ETH/bid", "", http.StatusNotFound, CodeNoPrice},
+		{"order id not a number", http.MethodDelete, "/book/ETH/order/abc", "", http.StatusBadRequest, CodeInvalidRequest},
+		{"malformed body", http.MethodPost, "/order", `{"UserID":`, http.StatusBadRequest, CodeMalformedRequest},
+		{"invalid time in force", http.MethodPost, "/order", `{"UserID":8,"Market":"ETH","Type":"LIMIT","Size":"1","Price":"1","TimeInForce":"NEVER"}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"unknown asset", http.MethodPost, "/deposit", `{"UserID":8,"Asset":"XYZ","Amount":"1"}`, http.StatusBadRequest, CodeUnknownAsset},
+		{"market exists", http.MethodPost, "/admin/markets", `{"Symbol":"ETH","Base":"ETH","Quote":"USD","TickSize":"0.01","LotSize":"0.01"}`, http.StatusConflict, CodeMarketExists},
+		{"unknown route", http.MethodGet, "/nope", "", http.StatusNotFound, CodeRouteNotFound},
+		{"method not allowed", http.MethodDelete, "/markets", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, reply := request(tc.method, tc.path, tc.body)
+			if status != tc.status || reply.Code != tc.code || reply.Message == "" {
+				t.Fatalf("expected %d %s, got %d: %+v", tc.status, tc.code, status, reply)
+			}
+		})
+	}
+
+	// A market order that runs out of liquidity says how much was filled.
+	status, reply := request(http.MethodPost, "/order", `{"UserID":7,"Market":"ETH","Type":"MARKET","Bid":true,"Size":"1"}`)
+	if status != http.StatusUnprocessableEntity || reply.Code != CodeInsufficientLiquidity {
+		t.Fatalf("expected 422 %s, got %d: %+v", CodeInsufficientLiquidity, status, reply)
+	}
+	if reply.Details["OrderID"] == nil || reply.Details["Filled"] != "0" || reply.Details["Requested"] != "1.00000000" {
+		t.Fatalf("expected the fill in the details, got %+v", reply.Details)
+	}
+
+	// Only exchanges that test with deposits take them.
+	ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := httptest.NewServer(newRouter(ex))
+	defer closed.Close()
+	err = doRequest(closed, http.MethodPost, "/deposit", &DepositRequest{UserID: 8, Asset: AssetETH, Amount: decimal.NewFromInt(1)}, nil)
+	if apiErr := toError(err); apiErr == nil || apiErr.Code != CodeRouteNotFound {
+		t.Fatalf("expected no deposit route, got %v", err)
+	}
+
+	// Replies decode into errors that match the errors of the exchange.
+	err = doRequest(srv, http.MethodGet, "/markets/XYZ", nil, nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound || !errors.Is(err, ErrMarketNotFound) {
+		t.Fatalf("expected a market not found error, got %v", err)
+	}
+}
+
+func TestOrderHistory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+
+	start := func() (*Exchange, *httptest.Server) {
+		ex, err := NewExchange(exchangePrivateKey, nil, DefaultConfig().Markets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.snapshotEvery = 1
+		if err := ex.Recover(path, dir); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(newRouter(ex))
+		t.Cleanup(srv.Close)
+		return ex, srv
+	}
+
+	ex, srv := start()
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+
+	place := func(req *PlaceOrderRequest) int64 {
+		t.Helper()
+		req.Market = MarketETH
+		var resp PlaceOrderResponse
+		if err := doRequest(srv, http.MethodPost, "/order", req, &resp); err != nil {
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatal(err)
+			}
+			return int64(apiErr.Details["OrderID"].(float64))
+		}
+		return resp.OrderID
+	}
+	history := func(userID int64, query string) OrderHistoryResponse {
+		t.Helper()
+		var resp OrderHistoryResponse
+		if err := doRequest(srv, http.MethodGet, fmt.Sprintf("/orders/%d/history%s", userID, query), nil, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expect := func(rec *OrderRecord, id int64, status OrderStatus, filled, avgPrice string) {
+		t.Helper()
+		if rec.ID != id || rec.Status != status || !rec.FilledSize.Equal(decimal.RequireFromString(filled)) || !rec.AvgPrice.Equal(decimal.RequireFromString(avgPrice)) {
+			t.Fatalf("expected order %d %s with %s filled at %s, got %+v", id, status, filled, avgPrice, rec)
+		}
+	}
+
+	filled := place(&PlaceOrderRequest{UserID: 8, Type: LimitOrder, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(10_000)})
+	partial := place(&PlaceOrderRequest{UserID: 8, Type: LimitOrder, Size: decimal.NewFromInt(2), Price: decimal.NewFromInt(10_100)})
+	taker := place(&PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.RequireFromString("1.5")})
+
+	orders := history(8, "").Orders
+	if len(orders) != 2 {
+		t.Fatalf("expected 2 orders of user 8, got %d", len(orders))
+	}
+	expect(orders[0], partial, OrderPartiallyFilled, "0.5", "10100")
+	expect(orders[1], filled, OrderFilled, "1", "10000")
+	expect(history(7, "").Orders[0], taker, OrderFilled, "1.5", "10033.33")
+
+	if err := doRequest(srv, http.MethodDelete, fmt.Sprintf("/book/ETH/order/%d", partial), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	rejected := place(&PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.NewFromInt(1)})
+	expiring := place(&PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(9_000), TimeInForce: orderbook.GoodTilDate, ExpiresAt: time.Now().Add(100 * time.Millisecond).UnixNano()})
+	time.Sleep(150 * time.Millisecond)
+	ex.submit(Command{Type: ExpireOrdersCommand, Market: MarketETH})
+	stop := place(&PlaceOrderRequest{UserID: 8, Type: StopMarketOrder, Size: decimal.NewFromInt(1), StopPrice: decimal.NewFromInt(9_000)})
+	// Orders refused before they reach the engine are in the history too.
+	offTick := &PlaceOrderRequest{UserID: 7, Market: MarketETH, Type: LimitOrder, Bid: true, Size: decimal.NewFromInt(1), Price: decimal.RequireFromString("9000.001")}
+	if err := doRequest(srv, http.MethodPost, "/order", offTick, nil); err == nil {
+		t.Fatal("expected an order off the tick to be refused")
+	}
+
+	// The history is the same after a restart from the snapshot alone.
+	keepJournal(t, path, func(cmd Command) bool { return cmd.Type == AddUserCommand })
+	_, srv = start()
+
+	orders = history(8, "").Orders
+	if len(orders) != 3 {
+		t.Fatalf("expected 3 orders of user 8, got %d", len(orders))
+	}
+	if orders[0].ID != stop || orders[0].Status != OrderNew || orders[0].Type != StopMarketOrder {
+		t.Fatalf("expected pending stop order %d, got %+v", stop, orders[0])
+	}
+	expect(orders[1], partial, OrderCancelled, "0.5", "10100")
+	orders = history(7, "").Orders
+	if len(orders) != 4 {
+		t.Fatalf("expected 4 orders of user 7, got %d", len(orders))
+	}
+	if rec := orders[0]; rec.ID <= stop || rec.Status != OrderRejected || rec.Reason == "" || !rec.Price.Equal(offTick.Price) {
+		t.Fatalf("expected the order off the tick to be rejected, got %+v", rec)
+	}
+	expect(orders[1], expiring, OrderExpired, "0", "0")
+	expect(orders[2], rejected, OrderRejected, "0", "0")
+	if orders[2].Reason == "" || orders[1].UpdatedAt <= orders[1].CreatedAt {
+		t.Fatalf("expected a reason and an update time, got %+v", orders)
+	}
+
+	// Filters.
+	if orders := history(8, "?status=FILLED,CANCELLED").Orders; len(orders) != 2 || orders[0].ID != partial || orders[1].ID != filled {
+		t.Fatalf("expected the filled and cancelled orders, got %+v", orders)
+	}
+	if orders := history(8, "?market=ETH&status=NEW").Orders; len(orders) != 1 || orders[0].ID != stop {
+		t.Fatalf("expected the stop order, got %+v", orders)
+	}
+	from := history(8, "").Orders[1].CreatedAt
+	if orders := history(8, fmt.Sprintf("?from=%d&to=%d", from, from+1)).Orders; len(orders) != 1 || orders[0].ID != partial {
+		t.Fatalf("expected the order placed at %d, got %+v", from, orders)
+	}
+
+	// Pages go from the newest to the oldest order.
+	var ids []int64
+	for cursor := int64(-1); cursor != 0; {
+		query := "?limit=1"
+		if cursor > 0 {
+			query += fmt.Sprintf("&cursor=%d", cursor)
+		}
+		page := history(8, query)
+		if len(page.Orders) != 1 {
+			t.Fatalf("expected 1 order per page, got %d", len(page.Orders))
+		}
+		ids = append(ids, page.Orders[0].ID)
+		cursor = page.NextCursor
+	}
+	if len(ids) != 3 || ids[0] != stop || ids[1] != partial || ids[2] != filled {
+		t.Fatalf("expected orders %d, %d and %d, got %v", stop, partial, filled, ids)
+	}
+
+	for _, query := range []string{"?status=DONE", "?limit=1001", "?from=yesterday"} {
+		err := doRequest(srv, http.MethodGet, "/orders/8/history"+query, nil, nil)
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+			t.Fatalf("%s: expected a bad request, got %v", query, err)
+		}
+	}
+	if err := doRequest(srv, http.MethodGet, "/orders/8/history?market=XYZ", nil, nil); !errors.Is(err, ErrMarketNotFound) {
+		t.Fatalf("expected an unknown market, got %v", err)
+	}
+}
+
+func TestOrderHistoryCap(t *testing.T) {
+	ex, srv := newTestExchange(t)
+	m, _ := ex.market(MarketETH)
+	m.history.keep = 2
+
+	var resp PlaceOrderResponse
+	if err := doRequest(srv, http.MethodPost, "/order", &PlaceOrderRequest{UserID: 8, Market: MarketETH, Type: LimitOrder, Bid: true, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(9_000)}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	reject := func() {
+		t.Helper()
+		req := &PlaceOrderRequest{UserID: 8, Market: MarketETH, Type: LimitOrder, Bid: true, Size: decimal.NewFromInt(1), Price: decimal.RequireFromString("9000.001")}
+		if err := doRequest(srv, http.MethodPost, "/order", req, nil); err == nil {
+			t.Fatal("expected an order off the tick to be refused")
+		}
+	}
+	history := func() []*OrderRecord {
+		t.Helper()
+		var resp OrderHistoryResponse
+		if err := doRequest(srv, http.MethodGet, "/orders/8/history", nil, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Orders
+	}
+
+	// Open orders stay, the oldest final ones go.
+	for i := 0; i < 3; i++ {
+		reject()
+	}
+	orders := history()
+	if len(orders) != 3 || orders[0].Status != OrderRejected || orders[1].Status != OrderRejected || orders[2].ID != resp.OrderID {
+		t.Fatalf("expected the 2 latest rejected orders and the open one, got %+v", orders)
+	}
+	latest := orders[0].ID
+
+	snap := m.history.snapshot()
+	if len(snap) != 3 || snap[0].ID != resp.OrderID {
+		t.Fatalf("expected the open order and 2 final ones in the snapshot, got %+v", snap)
+	}
+	m.history.restore(snap)
+	reject()
+	if orders := history(); len(orders) != 3 || orders[1].ID != latest || orders[2].ID != resp.OrderID {
+		t.Fatalf("expected the order %d to be kept after a restore, got %+v", latest, orders)
+	}
+}
+
+func TestTrades(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "exchange.journal")
+	cfg := ETHMarket()
+	cfg.MakerFee = decimal.RequireFromString("0.001")
+	cfg.TakerFee = decimal.RequireFromString("0.002")
+
+	start := func() (*Exchange, *httptest.Server) {
+		ex, err := NewExchange(exchangePrivateKey, nil, []MarketConfig{cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ex.trades.OpenFile(filepath.Join(dir, "exchange.trades")); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ex.trades.Close() })
+		if err := ex.Recover(path, dir); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(newRouter(ex))
+		t.Cleanup(srv.Close)
+		return ex, srv
+	}
+
+	ex, srv := start()
+	ex.AddUser(UserData{ID: 8, PrivateKey: "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", Deposits: testDeposits})
+	ex.AddUser(UserData{ID: 7, PrivateKey: "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", Deposits: testDeposits})
+
+	place := func(req *PlaceOrderRequest) int64 {
+		t.Helper()
+		req.Market = MarketETH
+		var resp PlaceOrderResponse
+		if err := doRequest(srv, http.MethodPost, "/order", req, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.OrderID
+	}
+	trades := func(query string) []*Trade {
+		t.Helper()
+		var trades []*Trade
+		if err := doRequest(srv, http.MethodGet, "/trades/ETH"+query, nil, &trades); err != nil {
+			t.Fatal(err)
+		}
+		return trades
+	}
+	fills := func(userID int64, query string) FillsResponse {
+		t.Helper()
+		var resp FillsResponse
+		if err := doRequest(srv, http.MethodGet, fmt.Sprintf("/fills/%d%s", userID, query), nil, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectFill := func(f *Fill, tradeID, orderID int64, liquidity Liquidity, fee string, feeAsset Asset) {
+		t.Helper()
+		if f.TradeID != tradeID || f.OrderID != orderID || f.Liquidity != liquidity || !f.Fee.Equal(decimal.RequireFromString(fee)) || f.FeeAsset != feeAsset {
+			t.Fatalf("expected fill of order %d in trade %d as %s paying %s %s, got %+v", orderID, tradeID, liquidity, fee, feeAsset, f)
+		}
+	}
+
+	ask := place(&PlaceOrderRequest{UserID: 8, Type: LimitOrder, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(10_000)})
+	ask2 := place(&PlaceOrderRequest{UserID: 8, Type: LimitOrder, Size: decimal.NewFromInt(2), Price: decimal.NewFromInt(10_100)})
+	buy := place(&PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: decimal.RequireFromString("1.5")})
+	bid := place(&PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(9_000)})
+	sell := place(&PlaceOrderRequest{UserID: 8, Type: MarketOrder, Size: decimal.NewFromInt(1)})
+
+	check := func() {
+		t.Helper()
+
+		tape := trades("")
+		if len(tape) != 3 {
+			t.Fatalf("expected 3 trades, got %d", len(tape))
+		}
+		for i, want := range []Trade{
+			{ID: 3, Price: decimal.NewFromInt(9_000), Size: decimal.NewFromInt(1), MakerOrderID: bid, TakerOrderID: sell},
+			{ID: 2, Price: decimal.NewFromInt(10_100), Size: decimal.RequireFromString("0.5"), MakerOrderID: ask2, TakerOrderID: buy, TakerBid: true},
+			{ID: 1, Price: decimal.NewFromInt(10_000), Size: decimal.NewFromInt(1), MakerOrderID: ask, TakerOrderID: buy, TakerBid: true},
+		} {
+			got := tape[i]
+			if got.ID != want.ID || got.Market != MarketETH || !got.Price.Equal(want.Price) || !got.Size.Equal(want.Size) ||
+				got.MakerOrderID != want.MakerOrderID || got.TakerOrderID != want.TakerOrderID || got.TakerBid != want.TakerBid || got.Timestamp == 0 {
+				t.Fatalf("expected trade %+v, got %+v", want, got)
+			}
+		}
+		if tape := trades("?limit=1"); len(tape) != 1 || tape[0].ID != 3 {
+			t.Fatalf("expected the latest trade, got %+v", tape)
+		}
+
+		// Buyers pay in ETH, sellers in USD.
+		buyer := fills(7, "").Fills
+		if len(buyer) != 3 {
+			t.Fatalf("expected 3 fills of user 7, got %d", len(buyer))
+		}
+		expectFill(buyer[0], 3, bid, MakerLiquidity, "0.001", AssetETH)
+		expectFill(buyer[1], 2, buy, TakerLiquidity, "0.001", AssetETH)
+		expectFill(buyer[2], 1, buy, TakerLiquidity, "0.002", AssetETH)
+		seller := fills(8, "?market=ETH").Fills
+		if len(seller) != 3 {
+			t.Fatalf("expected 3 fills of user 8, got %d", len(seller))
+		}
+		expectFill(seller[0], 3, sell, TakerLiquidity, "18", AssetUSD)
+		expectFill(seller[1], 2, ask2, MakerLiquidity, "5.05", AssetUSD)
+		expectFill(seller[2], 1, ask, MakerLiquidity, "10", AssetUSD)
+
+		if fee := ex.ledger.Balance(Account{Asset: AssetETH, Type: FeeAccount}); !fee.Equal(decimal.RequireFromString("0.004")) {
+			t.Fatalf("expected 0.004 ETH of fees, got %s", fee)
+		}
+		if fee := ex.ledger.Balance(Account{Asset: AssetUSD, Type: FeeAccount}); !fee.Equal(decimal.RequireFromString("33.05")) {
+			t.Fatalf("expected 33.05 USD of fees, got %s", fee)
+		}
+		eth := ex.ledger.Balances(7)[AssetETH].Available
+		if !eth.Equal(decimal.RequireFromString("1002.496")) {
+			t.Fatalf("expected user 7 to have 1002.496 ETH after fees, got %s", eth)
+		}
+	}
+	check()
+
+	// Replaying the journal after a restart trades nothing twice.
+	ex, srv = start()
+	check()
+
+	// Pages go from the newest to the oldest fill.
+	var ids []int64
+	for cursor := int64(-1); cursor != 0; {
+		query := "?limit=1"
+		if cursor > 0 {
+			query += fmt.Sprintf("&cursor=%d", cursor)
+		}
+		page := fills(7, query)
+		if len(page.Fills) != 1 {
+			t.Fatalf("expected 1 fill per page, got %d", len(page.Fills))
+		}
+		ids = append(ids, page.Fills[0].TradeID)
+		cursor = page.NextCursor
+	}
+	if len(ids) != 3 || ids[0] != 3 || ids[1] != 2 || ids[2] != 1 {
+		t.Fatalf("expected trades 3, 2 and 1, got %v", ids)
+	}
+	from := fills(7, "").Fills[1].Timestamp
+	if page := fills(7, fmt.Sprintf("?from=%d&to=%d", from, from+1)).Fills; len(page) != 2 || page[0].TradeID != 2 || page[1].TradeID != 1 {
+		t.Fatalf("expected the fills of the market order, got %+v", page)
+	}
+
+	for _, path := range []string{"/trades/ETH?limit=1001", "/fills/7?limit=-1", "/fills/7?cursor=last"} {
+		err := doRequest(srv, http.MethodGet, path, nil, nil)
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+			t.Fatalf("%s: expected a bad request, got %v", path, err)
+		}
+	}
+	for _, path := range []string{"/trades/XYZ", "/fills/7?market=XYZ"} {
+		if err := doRequest(srv, http.MethodGet, path, nil, nil); !errors.Is(err, ErrMarketNotFound) {
+			t.Fatalf("%s: expected an unknown market, got %v", path, err)
+		}
+	}
+}
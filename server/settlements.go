@@ -0,0 +1,501 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+const (
+	// settlementWorkers is how many settlements are transferred at a time.
+	settlementWorkers = 4
+
+	// maxSettlementAttempts is how often a settlement is tried before it goes
+	// to the dead letters. Retries back off exponentially from
+	// settlementBackoff up to maxSettlementBackoff.
+	maxSettlementAttempts = 5
+	settlementBackoff     = 100 * time.Millisecond
+	maxSettlementBackoff  = 30 * time.Second
+
+	// settlementPollInterval is the longest the dispatcher sleeps.
+	settlementPollInterval = time.Second
+
+	// confirmationInterval is how often submitted transfers are checked for
+	// confirmations. Confirmed ones are watched for reorgs until they are
+	// reorgWatchFactor times as deep as it takes to confirm them.
+	confirmationInterval = time.Second
+	reorgWatchFactor     = 2
+
+	// submitTimeout is how long a submitted transfer may stay off chain
+	// before it is reconciled: sent again as it is, or queued again when its
+	// nonce went to another transaction.
+	submitTimeout = 5 * time.Minute
+)
+
+// TradeSettlement is how far the settlement of a trade got. Status is the
+// status of the settlement that is furthest behind, a failed one first.
+type TradeSettlement struct {
+	TradeID     int64
+	Market      Market
+	AskOrderID  int64
+	BidOrderID  int64
+	Status      SettlementStatus
+	Settlements []*Settlement
+}
+
+// handleMatches queues the settlements of the matches of the command in the
+// outbox, less the fees the ledger charged: the seller sends the size less
+// the fee of the buyer in the base asset to the buyer, the buyer sends the
+// notional less the fee of the seller in the quote asset to the seller, and
+// the fees go to the exchange, so the balances on chain end up where those
+// of the ledger are. The transfers happen in the background.
+// Positions were already updated by the engine of the market.
+func (ex *Exchange) handleMatches(market Market, res CommandResult) error {
+	if ex.Settler == nil || len(res.Matches) == 0 {
+		return nil
+	}
+	if len(res.TradeIDs) != len(res.Matches) {
+		return fmt.Errorf("trades of %s at seq %d were not kept", market, res.Seq)
+	}
+
+	cfg, ok := ex.MarketConfig(market)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMarketNotFound, market)
+	}
+	assets := cfg.Assets()
+
+	for i, match := range res.Matches {
+		// The ledger did not settle a match its fees overflow for either.
+		bidFee, askFee, err := cfg.fees(match)
+		if err != nil {
+			log.Printf("settlement fees => ask %d | bid %d | err [%v]", match.Ask.ID, match.Bid.ID, err)
+			continue
+		}
+
+		transfer := func(asset Asset, fee bool, from, to int64, amount decimal.Decimal) *Settlement {
+			return &Settlement{
+				TradeID:    res.TradeIDs[i],
+				Seq:        res.Seq,
+				Match:      i,
+				Market:     market,
+				AskOrderID: match.Ask.ID,
+				BidOrderID: match.Bid.ID,
+				Asset:      asset,
+				Fee:        fee,
+				FromUserID: from,
+				ToUserID:   to,
+				Amount:     amount,
+			}
+		}
+		notional := match.Price.Mul(match.SizeFilled)
+		settlements := []*Settlement{
+			transfer(assets.Base, false, match.Ask.UserID, match.Bid.UserID, match.SizeFilled.Sub(bidFee)),
+			transfer(assets.Quote, false, match.Bid.UserID, match.Ask.UserID, notional.Sub(askFee)),
+		}
+		if bidFee.IsPositive() {
+			settlements = append(settlements, transfer(assets.Base, true, match.Ask.UserID, 0, bidFee))
+		}
+		if askFee.IsPositive() {
+			settlements = append(settlements, transfer(assets.Quote, true, match.Bid.UserID, 0, askFee))
+		}
+		if err := ex.outbox.Add(settlements...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runSettlement hands the due settlements of the outbox to a pool of workers.
+func (ex *Exchange) runSettlement(workers int) {
+	jobs := make(chan *Settlement)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for s := range jobs {
+				ex.settle(s)
+			}
+		}()
+	}
+
+	for {
+		now := time.Now()
+		for _, s := range ex.outbox.claimDue(now) {
+			jobs <- s
+		}
+
+		timer := time.NewTimer(ex.outbox.nextDue(now, settlementPollInterval))
+		select {
+		case <-ex.outbox.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// settle transfers the claimed settlement. It is submitted until the
+// confirmation watcher confirms it, or confirmed at once when the settler
+// has no chain to confirm it on. The transaction of a Submitter is recorded
+// as SUBMITTING before it is sent: when the send fails or the exchange
+// crashes, it may have reached the node all the same, so the watcher
+// reconciles it rather than send the transfer again.
+func (ex *Exchange) settle(s *Settlement) {
+	hash, err := ex.transfer(s)
+	if err != nil && s.Status == SettlementSubmitting {
+		log.Printf("settlement submitting => %d | tx [%s] | err [%v]", s.ID, s.TxHash, err)
+		s.LastError = err.Error()
+		if err := ex.outbox.update(s, true); err != nil {
+			log.Printf("settlement => %d | err [%v]", s.ID, err)
+		}
+		return
+	}
+	if err != nil {
+		ex.retry(s, err)
+		return
+	}
+
+	s.Status = SettlementSubmitted
+	s.TxHash = hash
+	s.SubmittedAt = time.Now().UnixNano()
+	s.LastError = ""
+	if _, ok := ex.Settler.(Confirmer); !ok {
+		if err := ex.outbox.update(s, false); err != nil {
+			log.Printf("settlement => %d | err [%v]", s.ID, err)
+		}
+		s.Status = SettlementConfirmed
+	}
+	if err := ex.outbox.update(s, true); err != nil {
+		log.Printf("settlement => %d | err [%v]", s.ID, err)
+	}
+}
+
+// retry queues the settlement again after a backoff, or fails it when it ran
+// out of attempts.
+func (ex *Exchange) retry(s *Settlement, err error) {
+	s.Attempts++
+	s.LastError = err.Error()
+	s.clearTransfer()
+	if s.Attempts >= ex.maxSettlementAttempts {
+		s.Status = SettlementFailed
+		log.Printf("settlement failed => %d | attempts [%d] | err [%v]", s.ID, s.Attempts, err)
+	} else {
+		s.Status = SettlementPending
+		s.NextAttempt = time.Now().Add(backoff(ex.settlementBackoff, s.Attempts)).UnixNano()
+	}
+	if err := ex.outbox.update(s, true); err != nil {
+		log.Printf("settlement => %d | err [%v]", s.ID, err)
+	}
+}
+
+// runConfirmationWatcher checks the transfers of the settlements on chain at
+// the given interval. The submitting settlements of a Submitter are
+// reconciled first, after a restart that is the first thing it does. The
+// stuck transfers of a stuckReplacer are replaced every stuckCheckInterval.
+// Once submitted, settlements are only changed here.
+func (ex *Exchange) runConfirmationWatcher(c Confirmer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	stuck := time.NewTicker(stuckCheckInterval)
+	defer stuck.Stop()
+
+	sub, reconciles := c.(Submitter)
+	r, replaces := c.(stuckReplacer)
+	for {
+		select {
+		case <-ticker.C:
+			if reconciles {
+				for _, s := range ex.outbox.submitting() {
+					ex.reconcile(sub, s)
+				}
+			}
+			ex.checkConfirmations(c)
+		case <-stuck.C:
+			if replaces {
+				ex.replaceStuck(r, stuckAfter)
+			}
+		}
+	}
+}
+
+// reconcile sends the recorded transaction of the settlement again as it is.
+// The settlement is submitted once the node has the transaction or it was
+// mined, and queued again when the transfer can only happen if it is sent
+// anew.
+func (ex *Exchange) reconcile(sub Submitter, s *Settlement) {
+	err := ex.resubmit(sub, s)
+	switch {
+	case errors.Is(err, ErrTransferDropped), errors.Is(err, ErrTransferReverted):
+		ex.retry(s, err)
+		return
+	case err != nil:
+		log.Printf("reconcile settlement => %d | tx [%s] | err [%v]", s.ID, s.TxHash, err)
+		return
+	}
+
+	s.Status = SettlementSubmitted
+	s.SubmittedAt = time.Now().UnixNano()
+	s.LastError = ""
+	if err := ex.outbox.update(s, true); err != nil {
+		log.Printf("settlement => %d | err [%v]", s.ID, err)
+	}
+}
+
+func (ex *Exchange) resubmit(sub Submitter, s *Settlement) error {
+	from, err := ex.user(s.FromUserID)
+	if err != nil {
+		return err
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(s.RawTx); err != nil {
+		return err
+	}
+	return sub.Resubmit(context.Background(), from.PrivateKey, tx, s.sent())
+}
+
+// checkConfirmations confirms the submitted settlements that are deep enough
+// in the chain and retries the ones whose transfer reverted. Confirmed
+// settlements whose transfer was dropped by a reorg are queued again, or
+// reconciled with a Submitter. Submitted ones still off chain after
+// submitTimeout are reconciled as well, the node may have dropped them.
+func (ex *Exchange) checkConfirmations(c Confirmer) {
+	ctx := context.Background()
+	depth := c.ConfirmationDepth()
+	sub, reconciles := c.(Submitter)
+
+	watched := ex.outbox.list(func(s *Settlement) bool {
+		return s.Status == SettlementSubmitted ||
+			s.Status == SettlementConfirmed && s.TxHash != (common.Hash{}) && s.Confirmations < reorgWatchFactor*depth
+	})
+	for _, s := range watched {
+		n, err := c.Confirmations(ctx, s.sent())
+		if errors.Is(err, ErrTransferReverted) && s.Status == SettlementSubmitted {
+			ex.retry(s, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("confirmations => %d | tx [%s] | err [%v]", s.ID, s.TxHash, err)
+			continue
+		}
+
+		switch {
+		case s.Status == SettlementConfirmed && n == 0:
+			log.Printf("settlement reorged => %d | tx [%s]", s.ID, s.TxHash)
+			s.Reorgs++
+			if reconciles {
+				// The new chain may still take the transaction as it is.
+				s.Status = SettlementSubmitting
+			} else {
+				s.Status = SettlementPending
+				s.clearTransfer()
+				s.NextAttempt = 0
+			}
+		case s.Status == SettlementSubmitted && n >= depth:
+			s.Status = SettlementConfirmed
+		case s.Status == SettlementSubmitted && n == 0 && reconciles && time.Since(time.Unix(0, s.SubmittedAt)) >= ex.submitTimeout:
+			log.Printf("settlement not mined => %d | tx [%s]", s.ID, s.TxHash)
+			ex.reconcile(sub, s)
+			continue
+		case n == s.Confirmations:
+			continue
+		}
+		s.Confirmations = n
+
+		if err := ex.outbox.update(s, true); err != nil {
+			log.Printf("settlement => %d | err [%v]", s.ID, err)
+		}
+	}
+}
+
+// transfer sends the transfer of the settlement, fees to the account of the
+// exchange. With a Submitter the settlement is SUBMITTING with the signed
+// transaction before it is sent.
+func (ex *Exchange) transfer(s *Settlement) (common.Hash, error) {
+	from, err := ex.user(s.FromUserID)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	toAddress := crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+	if !s.Fee {
+		to, err := ex.user(s.ToUserID)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		toAddress = crypto.PubkeyToAddress(to.PrivateKey.PublicKey)
+	}
+
+	ctx := context.Background()
+	sub, ok := ex.Settler.(Submitter)
+	if !ok {
+		return ex.Settler.Transfer(ctx, s.Asset, from.PrivateKey, toAddress, s.Amount)
+	}
+
+	return sub.SubmitTransfer(ctx, s.Asset, from.PrivateKey, toAddress, s.Amount, func(tx *types.Transaction) error {
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		c := *s
+		c.Status = SettlementSubmitting
+		c.TxHash, c.Nonce, c.RawTx = tx.Hash(), tx.Nonce(), raw
+		if err := ex.outbox.update(&c, false); err != nil {
+			return err
+		}
+		*s = c
+		return nil
+	})
+}
+
+func (ex *Exchange) user(id int64) (*User, error) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	user, ok := ex.Users[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+	return user, nil
+}
+
+// stuckReplacer is a settler whose transfers can get stuck on chain.
+type stuckReplacer interface {
+	ReplaceStuck(ctx context.Context, olderThan time.Duration, record func(old common.Hash, tx *types.Transaction) error) (int, error)
+}
+
+// replaceStuck replaces the transfers of the settler that are stuck for
+// olderThan.
+func (ex *Exchange) replaceStuck(r stuckReplacer, olderThan time.Duration) {
+	n, err := r.ReplaceStuck(context.Background(), olderThan, ex.recordReplacement)
+	if err != nil {
+		log.Printf("replace stuck transfers | err [%v]", err)
+	}
+	if n > 0 {
+		log.Printf("stuck transfers replaced => %d", n)
+	}
+}
+
+// recordReplacement adds the replacement tx to the settlement whose last
+// transaction is old, before the replacement is sent.
+func (ex *Exchange) recordReplacement(old common.Hash, tx *types.Transaction) error {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	sent := ex.outbox.list(func(s *Settlement) bool {
+		hashes := s.sent()
+		return (s.Status == SettlementSubmitting || s.Status == SettlementSubmitted) && hashes[len(hashes)-1] == old
+	})
+	if len(sent) == 0 {
+		return fmt.Errorf("%w: no settlement sent %s", ErrSettlementNotFound, old)
+	}
+
+	s := sent[0]
+	s.Replacements = append(s.Replacements, tx.Hash())
+	s.RawTx = raw
+	s.SubmittedAt = time.Now().UnixNano()
+	return ex.outbox.update(s, false)
+}
+
+// backoff is how long to wait after the given number of failed attempts.
+func backoff(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < maxSettlementBackoff; i++ {
+		d *= 2
+	}
+	if d > maxSettlementBackoff {
+		return maxSettlementBackoff
+	}
+	return d
+}
+
+func (ex *Exchange) handleGetSettlement(c echo.Context) error {
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	s, err := ex.outbox.Get(id)
+	if err != nil {
+		return invalid(err)
+	}
+
+	return c.JSON(http.StatusOK, s)
+}
+
+// tradeSettlements groups the settlements by trade, in the order of the
+// trades.
+func tradeSettlements(settlements []*Settlement) []*TradeSettlement {
+	trades := []*TradeSettlement{}
+	byID := make(map[int64]*TradeSettlement)
+	for _, s := range settlements {
+		trade, ok := byID[s.TradeID]
+		if !ok {
+			trade = &TradeSettlement{
+				TradeID:    s.TradeID,
+				Market:     s.Market,
+				AskOrderID: s.AskOrderID,
+				BidOrderID: s.BidOrderID,
+				Status:     SettlementConfirmed,
+			}
+			byID[s.TradeID] = trade
+			trades = append(trades, trade)
+		}
+		trade.Settlements = append(trade.Settlements, s)
+		if settlementRank[s.Status] < settlementRank[trade.Status] {
+			trade.Status = s.Status
+		}
+	}
+	return trades
+}
+
+// settlementRank orders the statuses by how far behind a trade with a
+// settlement of the status is.
+var settlementRank = map[SettlementStatus]int{
+	SettlementFailed:     0,
+	SettlementPending:    1,
+	SettlementSubmitting: 2,
+	SettlementSubmitted:  3,
+	SettlementConfirmed:  4,
+}
+
+// handleGetSettlements returns the settlement of every trade of the user.
+func (ex *Exchange) handleGetSettlements(c echo.Context) error {
+	userID, err := intParam(c, "userID")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, tradeSettlements(ex.outbox.OfUser(userID)))
+}
+
+// handleGetFailedSettlements returns the dead letters: the settlements that
+// ran out of attempts.
+func (ex *Exchange) handleGetFailedSettlements(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.outbox.List(SettlementFailed))
+}
+
+// handleRedriveSettlement queues a failed settlement again.
+func (ex *Exchange) handleRedriveSettlement(c echo.Context) error {
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	s, err := ex.outbox.Redrive(id)
+	if err != nil {
+		return invalid(err)
+	}
+
+	log.Println("settlement re-driven id => ", id)
+
+	return c.JSON(http.StatusOK, s)
+}
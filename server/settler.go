@@ -0,0 +1,525 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+)
+
+const (
+	MemorySettler    SettlerType = "MEMORY"
+	SimulatedSettler SettlerType = "SIMULATED"
+	EthSettler       SettlerType = "ETH"
+
+	// Wei, Gwei and Ether are the decimals of the units of ether: an amount
+	// of ether has 18 decimals in wei.
+	Wei   uint8 = 0
+	Gwei  uint8 = 9
+	Ether uint8 = 18
+
+	// chainID is the chain of the local development node and of the
+	// simulated backend.
+	chainID = 1337
+
+	// transferGasLimit is the gas of a plain ETH transfer and
+	// tokenTransferGasLimit the most an ERC-20 transfer may use.
+	transferGasLimit      = 21000
+	tokenTransferGasLimit = 100_000
+
+	// simulatedGasLimit is the block gas limit of the simulated chain.
+	simulatedGasLimit = 10_000_000
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrUnknownAsset      = errors.New("asset is not settled on chain")
+	ErrTransferReverted  = errors.New("transfer reverted")
+	ErrTransferDropped   = errors.New("transfer dropped")
+)
+
+var (
+	// transferSelector and balanceOfSelector are the ERC-20 functions
+	// transfer(address,uint256) and balanceOf(address).
+	transferSelector  = []byte{0xa9, 0x05, 0x9c, 0xbb}
+	balanceOfSelector = []byte{0x70, 0xa0, 0x82, 0x31}
+
+	// simulatedTokenCode is the runtime code of the tokens of the simulated
+	// chain. It only knows transfer and balanceOf, and keeps the balance of
+	// an address in the storage slot of the address itself:
+	//
+	//	selector == balanceOf: return sload(arg0)
+	//	selector == transfer:  if sload(caller) < arg1 { revert }
+	//	                       sstore(caller, sload(caller) - arg1)
+	//	                       sstore(arg0, sload(arg0) + arg1)
+	//	                       return true
+	simulatedTokenCode = hexutil.MustDecode("0x60003560e01c806370a0823114601d5763a9059cbb14602a57600080fd5b6004355460005260206000f35b3354602435808210604f57900333556004358054602435019055600160005260206000f35b600080fd")
+)
+
+// SettlerType selects the Settler the exchange settles its matches with.
+type SettlerType string
+
+// Settler moves assets between the accounts of the users to settle matches
+// and reports their balances in the smallest unit of the asset. Transfer
+// returns the hash of the transaction of the transfer, if there is one.
+type Settler interface {
+	Transfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal) (common.Hash, error)
+	BalanceAt(ctx context.Context, asset Asset, address common.Address) (*big.Int, error)
+}
+
+// Confirmer is a settler whose transfers are only final once they are
+// ConfirmationDepth blocks deep. Confirmations returns how deep the transfer
+// sent as any of the transactions is in the canonical chain, 0 while none
+// of them is in it, and ErrTransferReverted when it was mined but failed.
+type Confirmer interface {
+	Confirmations(ctx context.Context, txs []common.Hash) (uint64, error)
+	ConfirmationDepth() uint64
+}
+
+// Submitter is a settler that signs the transaction of a transfer before it
+// sends it. SubmitTransfer hands the signed transaction to record first and
+// does not send it when record fails. Resubmit sends a recorded transaction
+// again as it is, so the transfer is never paid twice. sent are all the
+// transactions sent for the transfer, tx the last of them. It sends nothing
+// when one of them was mined already, and returns ErrTransferDropped when
+// their nonce went to another transaction, so the transfer can only happen
+// if it is sent anew.
+type Submitter interface {
+	SubmitTransfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal, record func(tx *types.Transaction) error) (common.Hash, error)
+	Resubmit(ctx context.Context, from *ecdsa.PrivateKey, tx *types.Transaction, sent []common.Hash) error
+}
+
+// ChainAsset is how an asset exists on chain. Decimals is the number of
+// decimals of its smallest unit, Ether for ether counted in wei or the
+// decimals of a token. Token is the ERC-20 contract of the asset and only
+// ETH, which is ether itself, goes without one.
+type ChainAsset struct {
+	Decimals uint8
+	Token    common.Address
+}
+
+// ToUnits converts an amount of the asset to its smallest unit. It fails
+// rather than round when the amount has more decimals than the asset.
+func (a ChainAsset) ToUnits(amount decimal.Decimal) (*big.Int, error) {
+	if amount.IsNegative() {
+		return nil, fmt.Errorf("negative amount: %s", amount)
+	}
+	return amount.BigInt(a.Decimals)
+}
+
+func (a ChainAsset) hasToken() bool {
+	return a.Token != common.Address{}
+}
+
+// Config configures the exchange. RPCURL is the node the ETH settler
+// connects to and Assets how every asset is settled. Funds is what every
+// user is credited with in the ledger, and starts with on the MEMORY and
+// SIMULATED settlers, which have no chain of their own. Transfers on chain
+// are final once Confirmations blocks deep.
+type Config struct {
+	Settler       SettlerType
+	RPCURL        string
+	Assets        map[Asset]ChainAsset
+	Funds         map[Asset]decimal.Decimal
+	Confirmations uint64
+	// Markets are opened at start, more can be added at runtime.
+	Markets []MarketConfig
+	// TestDeposits opens POST /deposit, which credits any user with any
+	// amount without a transfer behind it. It is only meant for testing.
+	TestDeposits bool
+}
+
+// DefaultConfig settles on the simulated chain, which needs nothing else to
+// run and only mines on transactions, so one confirmation is enough. USD is a
+// token with 18 decimals whose contract has to be set for the ETH settler on
+// the local development node, which wants more confirmations.
+func DefaultConfig() Config {
+	return Config{
+		Settler: SimulatedSettler,
+		RPCURL:  "http://localhost:8545",
+		Assets: map[Asset]ChainAsset{
+			AssetETH: {Decimals: Ether},
+			AssetUSD: {Decimals: 18},
+		},
+		Funds: map[Asset]decimal.Decimal{
+			AssetETH: decimal.NewFromInt(100_000),
+			AssetUSD: decimal.NewFromInt(100_000_000),
+		},
+		Confirmations: 1,
+		Markets:       []MarketConfig{ETHMarket()},
+	}
+}
+
+// NewSettler returns the settler the config selects. The accounts start with
+// cfg.Funds on the MEMORY and SIMULATED settlers.
+func NewSettler(cfg Config, accounts []common.Address) (Settler, error) {
+	if cfg.Settler == EthSettler {
+		return NewEthSettler(cfg.RPCURL, cfg.Assets, cfg.Confirmations)
+	}
+
+	alloc := make(map[Asset]map[common.Address]*big.Int)
+	for asset, amount := range cfg.Funds {
+		chainAsset, ok := cfg.Assets[asset]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownAsset, asset)
+		}
+		units, err := chainAsset.ToUnits(amount)
+		if err != nil {
+			return nil, fmt.Errorf("%s funds: %w", asset, err)
+		}
+
+		alloc[asset] = make(map[common.Address]*big.Int)
+		for _, account := range accounts {
+			alloc[asset][account] = units
+		}
+	}
+
+	switch cfg.Settler {
+	case MemorySettler:
+		return NewInMemorySettler(cfg.Assets, alloc), nil
+	case SimulatedSettler:
+		return NewSimulatedBackendSettler(cfg.Assets, alloc, cfg.Confirmations), nil
+	default:
+		return nil, fmt.Errorf("unknown settler: %s", cfg.Settler)
+	}
+}
+
+// InMemorySettler settles in memory, without any chain. Transfers never
+// overdraw an account.
+type InMemorySettler struct {
+	mu       sync.Mutex
+	assets   map[Asset]ChainAsset
+	balances map[Asset]map[common.Address]*big.Int
+}
+
+func NewInMemorySettler(assets map[Asset]ChainAsset, alloc map[Asset]map[common.Address]*big.Int) *InMemorySettler {
+	balances := make(map[Asset]map[common.Address]*big.Int)
+	for asset := range assets {
+		balances[asset] = make(map[common.Address]*big.Int)
+		for address, balance := range alloc[asset] {
+			balances[asset][address] = new(big.Int).Set(balance)
+		}
+	}
+
+	return &InMemorySettler{assets: assets, balances: balances}
+}
+
+// Transfer moves the amount at once, there is no transaction to it.
+func (l *InMemorySettler) Transfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal) (common.Hash, error) {
+	chainAsset, ok := l.assets[asset]
+	if !ok {
+		return common.Hash{}, fmt.Errorf("%w: %s", ErrUnknownAsset, asset)
+	}
+	units, err := chainAsset.ToUnits(amount)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	balances := l.balances[asset]
+	fromAddress := crypto.PubkeyToAddress(from.PublicKey)
+	balance := balanceOf(balances, fromAddress)
+	if balance.Cmp(units) < 0 {
+		return common.Hash{}, fmt.Errorf("%w: %s has %s %s, needs %s", ErrInsufficientFunds, fromAddress, balance, asset, units)
+	}
+
+	balances[fromAddress] = new(big.Int).Sub(balance, units)
+	balances[to] = new(big.Int).Add(balanceOf(balances, to), units)
+
+	return common.Hash{}, nil
+}
+
+func (l *InMemorySettler) BalanceAt(ctx context.Context, asset Asset, address common.Address) (*big.Int, error) {
+	if _, ok := l.assets[asset]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAsset, asset)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return new(big.Int).Set(balanceOf(l.balances[asset], address)), nil
+}
+
+func balanceOf(balances map[common.Address]*big.Int, address common.Address) *big.Int {
+	if balance, ok := balances[address]; ok {
+		return balance
+	}
+	return new(big.Int)
+}
+
+// chainBackend is the part of ethclient.Client and of the simulated backend
+// that transfers need.
+type chainBackend interface {
+	nonceBackend
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+}
+
+// ChainSettler settles with transfers on a chain: ETH transfers for ether
+// and ERC-20 transfers for tokens. Their nonces come from a NonceManager.
+type ChainSettler struct {
+	backend       chainBackend
+	assets        map[Asset]ChainAsset
+	nonces        *NonceManager
+	confirmations uint64
+}
+
+func newChainSettler(backend chainBackend, assets map[Asset]ChainAsset, confirmations uint64) ChainSettler {
+	if confirmations == 0 {
+		confirmations = 1
+	}
+	return ChainSettler{
+		backend:       backend,
+		assets:        assets,
+		nonces:        NewNonceManager(backend, big.NewInt(chainID)),
+		confirmations: confirmations,
+	}
+}
+
+// NewEthSettler connects to the node at url. Transfers are final once the
+// given number of blocks deep.
+func NewEthSettler(url string, assets map[Asset]ChainAsset, confirmations uint64) (*ChainSettler, error) {
+	for asset, chainAsset := range assets {
+		if asset != AssetETH && !chainAsset.hasToken() {
+			return nil, fmt.Errorf("no token contract for %s", asset)
+		}
+	}
+
+	client, err := ethclient.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	settler := newChainSettler(client, assets, confirmations)
+	return &settler, nil
+}
+
+func (s *ChainSettler) Transfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal) (common.Hash, error) {
+	return s.SubmitTransfer(ctx, asset, from, to, amount, nil)
+}
+
+func (s *ChainSettler) SubmitTransfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal, record func(tx *types.Transaction) error) (common.Hash, error) {
+	chainAsset, ok := s.assets[asset]
+	if !ok {
+		return common.Hash{}, fmt.Errorf("%w: %s", ErrUnknownAsset, asset)
+	}
+	units, err := chainAsset.ToUnits(amount)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	gasPrice, err := s.backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	tx, err := s.nonces.Send(ctx, from, func(nonce uint64) *types.Transaction {
+		if !chainAsset.hasToken() {
+			return types.NewTransaction(nonce, to, units, transferGasLimit, gasPrice, nil)
+		}
+		data := append(append([]byte{}, transferSelector...), common.LeftPadBytes(to.Bytes(), 32)...)
+		data = append(data, common.LeftPadBytes(units.Bytes(), 32)...)
+		return types.NewTransaction(nonce, chainAsset.Token, new(big.Int), tokenTransferGasLimit, gasPrice, data)
+	}, record)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+// Resubmit looks at the nonce of the account before the receipts, so a
+// transaction mined in between is found by its receipt.
+func (s *ChainSettler) Resubmit(ctx context.Context, from *ecdsa.PrivateKey, tx *types.Transaction, sent []common.Hash) error {
+	mined, err := s.backend.NonceAt(ctx, crypto.PubkeyToAddress(from.PublicKey), nil)
+	if err != nil {
+		return err
+	}
+	if mined <= tx.Nonce() {
+		return s.nonces.Resend(ctx, from, tx)
+	}
+
+	n, err := s.Confirmations(ctx, sent)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: nonce %d of %s went to another transaction", ErrTransferDropped, tx.Nonce(), tx.Hash())
+	}
+	return nil
+}
+
+// Confirmations looks for the receipt of every transaction, any replacement
+// can be the one that gets mined.
+func (s *ChainSettler) Confirmations(ctx context.Context, txs []common.Hash) (uint64, error) {
+	for _, hash := range txs {
+		receipt, err := s.backend.TransactionReceipt(ctx, hash)
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// The receipt may be of a block that was reorganized away.
+		header, err := s.backend.HeaderByNumber(ctx, receipt.BlockNumber)
+		if errors.Is(err, ethereum.NotFound) || (err == nil && (header == nil || header.Hash() != receipt.BlockHash)) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return 0, ErrTransferReverted
+		}
+
+		head, err := s.backend.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		return head.Number.Uint64() - receipt.BlockNumber.Uint64() + 1, nil
+	}
+
+	return 0, nil
+}
+
+func (s *ChainSettler) ConfirmationDepth() uint64 {
+	return s.confirmations
+}
+
+// ReplaceStuck replaces the transfers that were not mined for olderThan with
+// ones that pay more for gas and returns how many it replaced. record gets
+// every replacement and the transaction it replaces before it is sent.
+func (s *ChainSettler) ReplaceStuck(ctx context.Context, olderThan time.Duration, record func(old common.Hash, tx *types.Transaction) error) (int, error) {
+	replaced, err := s.nonces.ReplaceStuck(ctx, olderThan, record)
+	return len(replaced), err
+}
+
+func (s *ChainSettler) BalanceAt(ctx context.Context, asset Asset, address common.Address) (*big.Int, error) {
+	chainAsset, ok := s.assets[asset]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAsset, asset)
+	}
+	if !chainAsset.hasToken() {
+		return s.backend.BalanceAt(ctx, address, nil)
+	}
+
+	data := append(append([]byte{}, balanceOfSelector...), common.LeftPadBytes(address.Bytes(), 32)...)
+	out, err := s.backend.CallContract(ctx, ethereum.CallMsg{To: &chainAsset.Token, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(out), nil
+}
+
+// SimulatedBackendSettler settles on go-ethereum's simulated backend. Every
+// transfer is mined into a block of its own before Transfer returns.
+type SimulatedBackendSettler struct {
+	ChainSettler
+	mu      sync.Mutex
+	backend *backends.SimulatedBackend
+}
+
+// NewSimulatedBackendSettler starts a simulated chain on which the accounts
+// of alloc hold their balance. Tokens without a contract get one at the
+// address that spells their name.
+func NewSimulatedBackendSettler(assets map[Asset]ChainAsset, alloc map[Asset]map[common.Address]*big.Int, confirmations uint64) *SimulatedBackendSettler {
+	genesis := make(core.GenesisAlloc)
+	account := func(address common.Address) core.GenesisAccount {
+		if account, ok := genesis[address]; ok {
+			return account
+		}
+		return core.GenesisAccount{Balance: new(big.Int)}
+	}
+
+	chainAssets := make(map[Asset]ChainAsset, len(assets))
+	for asset, chainAsset := range assets {
+		if asset != AssetETH && !chainAsset.hasToken() {
+			chainAsset.Token = common.BytesToAddress([]byte(asset))
+		}
+		chainAssets[asset] = chainAsset
+
+		if !chainAsset.hasToken() {
+			for address, balance := range alloc[asset] {
+				a := account(address)
+				a.Balance = balance
+				genesis[address] = a
+			}
+			continue
+		}
+
+		token := account(chainAsset.Token)
+		token.Code = simulatedTokenCode
+		token.Storage = make(map[common.Hash]common.Hash)
+		for address, balance := range alloc[asset] {
+			token.Storage[common.BytesToHash(address.Bytes())] = common.BigToHash(balance)
+		}
+		genesis[chainAsset.Token] = token
+	}
+
+	backend := backends.NewSimulatedBackend(genesis, simulatedGasLimit)
+	return &SimulatedBackendSettler{
+		ChainSettler: newChainSettler(backend, chainAssets, confirmations),
+		backend:      backend,
+	}
+}
+
+func (s *SimulatedBackendSettler) Transfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal) (common.Hash, error) {
+	return s.SubmitTransfer(ctx, asset, from, to, amount, nil)
+}
+
+func (s *SimulatedBackendSettler) SubmitTransfer(ctx context.Context, asset Asset, from *ecdsa.PrivateKey, to common.Address, amount decimal.Decimal, record func(tx *types.Transaction) error) (common.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash, err := s.ChainSettler.SubmitTransfer(ctx, asset, from, to, amount, record)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	s.backend.Commit()
+
+	return hash, nil
+}
+
+func (s *SimulatedBackendSettler) Resubmit(ctx context.Context, from *ecdsa.PrivateKey, tx *types.Transaction, sent []common.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ChainSettler.Resubmit(ctx, from, tx, sent); err != nil {
+		return err
+	}
+	s.backend.Commit()
+
+	return nil
+}
+
+func (s *SimulatedBackendSettler) ReplaceStuck(ctx context.Context, olderThan time.Duration, record func(old common.Hash, tx *types.Transaction) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.ChainSettler.ReplaceStuck(ctx, olderThan, record)
+	if n > 0 {
+		s.backend.Commit()
+	}
+	return n, err
+}
+
+func (s *SimulatedBackendSettler) Close() error {
+	return s.backend.Close()
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+const (
+	// snapshotVersion is the format of the snapshot files. Files of another
+	// version are skipped on recovery.
+	snapshotVersion = 3
+
+	// snapshotEvery is how many commands the engines of all markets apply
+	// between two snapshots of the exchange.
+	snapshotEvery = 1000
+
+	// snapshotsKept is how many snapshots are kept on disk, so that recovery
+	// can fall back to an older one when the latest is bad.
+	snapshotsKept = 3
+)
+
+var (
+	ErrSnapshotVersion  = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// ExchangeSnapshot is the state of every market of the exchange after the command
+// with the sequence number Seq, taken while no command ran. Balances are
+// checked across markets, so they are only restored all at the same point.
+type ExchangeSnapshot struct {
+	Seq     uint64
+	Markets []*MarketSnapshot
+}
+
+// MarketSnapshot is the state of a market: its status, its book, the net
+// positions of the users in it, what it posted to the ledger, the orders placed in it
+// with a ClientOrderID and its order history: the open orders and the latest
+// maxFinalOrders final ones.
+// LastOrderID is the last order ID the exchange handed out in any market.
+type MarketSnapshot struct {
+	Market       Market
+	Status       MarketStatus
+	Book         *orderbook.Snapshot
+	Positions    map[int64]decimal.Decimal
+	Ledger       *LedgerSnapshot
+	ClientOrders []*ClientOrder
+	History      []*OrderRecord
+	LastOrderID  int64
+}
+
+// snapshotFile is how an ExchangeSnapshot is written to disk. Checksum is the
+// hex encoded SHA-256 of Data.
+type snapshotFile struct {
+	Version  int
+	Checksum string
+	Data     json.RawMessage
+}
+
+// WriteSnapshot writes the snapshot to path. The file is replaced at once,
+// readers never see it half written.
+func WriteSnapshot(path string, snap *ExchangeSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	b, err := json.Marshal(&snapshotFile{
+		Version:  snapshotVersion,
+		Checksum: hex.EncodeToString(sum[:]),
+		Data:     data,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadSnapshot reads the snapshot at path and checks its version and
+// checksum.
+func ReadSnapshot(path string) (*ExchangeSnapshot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	if file.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, file.Version)
+	}
+	sum := sha256.Sum256(file.Data)
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return nil, ErrSnapshotChecksum
+	}
+
+	var snap ExchangeSnapshot
+	if err := json.Unmarshal(file.Data, &snap); err != nil {
+		return nil, err
+	}
+	for _, m := range snap.Markets {
+		if m.Book == nil || m.Ledger == nil {
+			return nil, fmt.Errorf("snapshot of %s without a book or a ledger", m.Market)
+		}
+		if m.Book.Seq != snap.Seq {
+			return nil, fmt.Errorf("snapshot of %s at seq %d instead of %d", m.Market, m.Book.Seq, snap.Seq)
+		}
+	}
+
+	return &snap, nil
+}
+
+// market returns the snapshot of the market, nil when it is not in it.
+func (s *ExchangeSnapshot) market(symbol Market) *MarketSnapshot {
+	for _, m := range s.Markets {
+		if m.Market == symbol {
+			return m
+		}
+	}
+	return nil
+}
+
+// snapshotPath is where the snapshot at the sequence number seq goes.
+// Sequence numbers are padded so that names sort like them.
+func snapshotPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("exchange-%020d.snapshot", seq))
+}
+
+// snapshotPaths returns the snapshot files, the latest first.
+func snapshotPaths(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "exchange-*.snapshot"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	return paths, nil
+}
+
+// LatestSnapshot returns the latest snapshot that can be read, skipping
+// corrupt and incompatible ones, or nil when there is none.
+func LatestSnapshot(dir string) (*ExchangeSnapshot, error) {
+	paths, err := snapshotPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		snap, err := ReadSnapshot(path)
+		if err != nil {
+			log.Printf("skipping snapshot %s: %v", path, err)
+			continue
+		}
+		return snap, nil
+	}
+
+	return nil, nil
+}
+
+// snapshot waits for the commands that run to finish, writes a snapshot of
+// every market after the last command in the journal and removes the oldest
+// ones. No command runs until it is written.
+func (ex *Exchange) snapshot() error {
+	ex.commandsMu.Lock()
+	defer ex.commandsMu.Unlock()
+
+	snap := &ExchangeSnapshot{Seq: ex.journal.Seq()}
+	for _, m := range ex.marketList() {
+		ms, err := ex.snapshotMarket(m.config.Symbol, snap.Seq)
+		if err != nil {
+			return err
+		}
+		snap.Markets = append(snap.Markets, ms)
+	}
+	if err := WriteSnapshot(snapshotPath(ex.snapshotDir, snap.Seq), snap); err != nil {
+		return err
+	}
+
+	paths, err := snapshotPaths(ex.snapshotDir)
+	if err != nil {
+		return err
+	}
+	for i := snapshotsKept; i < len(paths); i++ {
+		os.Remove(paths[i])
+	}
+
+	return nil
+}
+
+// snapshotMarket returns the state of the market after the command with the
+// sequence number seq.
+func (ex *Exchange) snapshotMarket(market Market, seq uint64) (*MarketSnapshot, error) {
+	ex.mu.RLock()
+	positions := make(map[int64]decimal.Decimal, len(ex.positions[market]))
+	for userID, position := range ex.positions[market] {
+		positions[userID] = position
+	}
+	ex.mu.RUnlock()
+
+	m, ok := ex.market(market)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMarketNotFound, market)
+	}
+	cfg, _ := ex.MarketConfig(market)
+
+	return &MarketSnapshot{
+		Market:       market,
+		Status:       cfg.Status,
+		Book:         m.ob.Snapshot(seq),
+		Positions:    positions,
+		Ledger:       ex.ledger.Snapshot(market),
+		ClientOrders: ex.clientOrdersOf(market),
+		History:      m.history.snapshot(),
+		LastOrderID:  ex.lastOrderID.Load(),
+	}, nil
+}
+
+// restoreMarket loads the snapshot into its market, together with the orders
+// per user it implies. It must run before the engine of the market applies
+// any command.
+func (ex *Exchange) restoreMarket(snap *MarketSnapshot) error {
+	m, ok := ex.market(snap.Market)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMarketNotFound, snap.Market)
+	}
+	e := m.engine
+	if err := e.ob.Restore(snap.Book); err != nil {
+		return err
+	}
+	// Snapshots written before markets had a status keep the configured one.
+	if snap.Status != "" {
+		ex.restoreMarketStatus(snap.Market, snap.Status)
+	}
+
+	ex.mu.Lock()
+	positions := snap.Positions
+	if positions == nil {
+		positions = make(map[int64]decimal.Decimal)
+	}
+	ex.positions[snap.Market] = positions
+
+	delete(ex.Orders, snap.Market)
+	for _, order := range e.ob.Orders {
+		ex.addUserOrder(snap.Market, order)
+	}
+	for _, userOrders := range ex.Orders[snap.Market] {
+		sort.Slice(userOrders, func(i, j int) bool {
+			return userOrders[i].Timestamp < userOrders[j].Timestamp
+		})
+	}
+	ex.mu.Unlock()
+
+	ex.ledger.Restore(snap.Market, snap.Ledger)
+	for _, co := range snap.ClientOrders {
+		ex.addClientOrder(co)
+	}
+	m.history.restore(snap.History)
+	ex.observeOrderID(snap.LastOrderID)
+
+	e.reset(snap.Book.Seq)
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+type (
+	StopOrder struct {
+		UserID    int64
+		ID        int64
+		Type      OrderType
+		Bid       bool
+		Size      decimal.Decimal
+		StopPrice decimal.Decimal
+		Price     decimal.Decimal // only set for stop limit orders.
+		Trigger   orderbook.TriggerType
+		Timestamp int64
+	}
+
+	AmendStopOrderRequest struct {
+		StopPrice decimal.Decimal
+		Price     decimal.Decimal // only needed for stop limit orders.
+		Size      decimal.Decimal
+	}
+
+	SetMarkPriceRequest struct {
+		Price decimal.Decimal
+	}
+)
+
+func NewStopOrder(s *orderbook.StopOrder) *StopOrder {
+	stop := &StopOrder{
+		UserID:    s.Order.UserID,
+		ID:        s.Order.ID,
+		Type:      StopMarketOrder,
+		Bid:       s.Order.Bid,
+		Size:      s.Order.Size,
+		StopPrice: s.StopPrice,
+		Trigger:   s.Trigger,
+		Timestamp: s.Order.Timestamp,
+	}
+	if s.IsLimit {
+		stop.Type = StopLimitOrder
+		stop.Price = s.LimitPrice
+	}
+	return stop
+}
+
+// placeStopOrder adds the stop order to the book of its market. The stop may
+// already be in the money, in which case it is triggered right away.
+func (ex *Exchange) placeStopOrder(cmd Command, order *orderbook.Order) CommandResult {
+	req := cmd.Order
+
+	trigger := req.Trigger
+	if trigger == "" {
+		trigger = orderbook.TriggerLastTrade
+	}
+
+	stop := &orderbook.StopOrder{
+		Order:      order,
+		StopPrice:  req.StopPrice,
+		LimitPrice: req.Price,
+		IsLimit:    req.Type == StopLimitOrder,
+		Trigger:    trigger,
+	}
+	if err := ex.holdOrder(cmd.Market, req, order); err != nil {
+		return CommandResult{Order: order, Err: err}
+	}
+	if err := ex.orderbook(cmd.Market).PlaceStopOrder(stop); err != nil {
+		if releaseErr := ex.ledger.Release(order.ID, ex.ledger.HoldOf(order.ID)); releaseErr != nil {
+			err = errors.Join(err, fmt.Errorf("release order %d: %w", order.ID, releaseErr))
+		}
+		return CommandResult{Order: order, Err: err}
+	}
+
+	log.Printf("new %s order => %d | bid [%t] | stop [%s] | size [%s]", req.Type, order.ID, order.Bid, req.StopPrice, order.Size)
+
+	return CommandResult{Order: order, Matches: ex.triggerStops(cmd.Market)}
+}
+
+// triggerStops places the stop orders of the market whose trigger price was
+// reached and returns their matches.
+func (ex *Exchange) triggerStops(market Market) []orderbook.Match {
+	// Halted markets wait with their stops until they trade again.
+	if !ex.trading(market) {
+		return nil
+	}
+	ob := ex.orderbook(market)
+
+	var matches []orderbook.Match
+	for _, trigger := range ob.TriggerStops() {
+		order := trigger.Stop.Order
+
+		ex.mu.Lock()
+		if order.Limit != nil {
+			ex.addUserOrder(market, order)
+		}
+		ex.mu.Unlock()
+
+		log.Printf("triggered STOP order => %d | stop [%s] | matches [%d] | err [%v]", order.ID, trigger.Stop.StopPrice, len(trigger.Matches), trigger.Err)
+
+		ex.removeFilledOrders(market, trigger.Matches)
+		ex.updatePositions(market, trigger.Matches)
+		// The book triggered all of them already, a match the ledger
+		// refuses halts the market for the ones after.
+		ex.settleMatches(market, trigger.Matches)
+		ex.syncHold(market, order)
+		matches = append(matches, trigger.Matches...)
+	}
+
+	return matches
+}
+
+// hasStop reports whether the stop order is pending in the market.
+func (ex *Exchange) hasStop(market Market, id int64) bool {
+	for _, stop := range ex.engine(market).Snapshot().Stops {
+		if stop.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetStopOrders returns the stop orders the user has pending in the
+// market.
+func (ex *Exchange) handleGetStopOrders(c echo.Context) error {
+	symbol := Market(c.Param("market"))
+	e := ex.engine(symbol)
+	if e == nil {
+		return marketNotFound(symbol)
+	}
+	userID, err := intParam(c, "userID")
+	if err != nil {
+		return err
+	}
+
+	stops := []*StopOrder{}
+	for _, stop := range e.Snapshot().Stops {
+		if stop.UserID == userID {
+			stops = append(stops, stop)
+		}
+	}
+
+	return c.JSON(http.StatusOK, stops)
+}
+
+func (ex *Exchange) handleAmendStopOrder(c echo.Context) error {
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	var req AmendStopOrderRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	market := Market(c.Param("market"))
+	cfg, ok := ex.MarketConfig(market)
+	if !ok {
+		return marketNotFound(market)
+	}
+	if !ex.hasStop(market, id) {
+		return stopNotFound(id)
+	}
+	if err := cfg.checkStopAmendment(req); err != nil {
+		return err
+	}
+	ob := ex.orderbook(market)
+
+	stopPrice, err := req.StopPrice.Rescale(ob.PriceScale)
+	if err != nil {
+		return invalid(fmt.Errorf("invalid stop price: %w", err))
+	}
+	price, err := req.Price.Rescale(ob.PriceScale)
+	if err != nil {
+		return invalid(fmt.Errorf("invalid price: %w", err))
+	}
+	size, err := req.Size.Rescale(ob.SizeScale)
+	if err != nil {
+		return invalid(fmt.Errorf("invalid size: %w", err))
+	}
+
+	res := ex.submit(Command{
+		Type:      AmendStopCommand,
+		Market:    market,
+		OrderID:   id,
+		StopPrice: stopPrice,
+		Price:     price,
+		Size:      size,
+	})
+	if res.Err != nil {
+		return invalid(res.Err)
+	}
+
+	log.Println("stop order amended id => ", id)
+
+	if err := ex.handleMatches(market, res); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "Stop order amended"})
+}
+
+func (ex *Exchange) amendStopOrder(cmd Command) CommandResult {
+	ob := ex.orderbook(cmd.Market)
+
+	var stop *orderbook.StopOrder
+	for _, s := range ob.StopOrders() {
+		if s.Order.ID == cmd.OrderID {
+			stop = s
+		}
+	}
+	if stop == nil {
+		return CommandResult{Err: orderbook.ErrStopNotFound}
+	}
+
+	// Stop market bids hold their notional at the stop price, stop limit bids
+	// at the limit price.
+	price := cmd.StopPrice
+	if stop.IsLimit {
+		price = cmd.Price
+	}
+	asset, required, err := holdFor(ex.marketAssets(cmd.Market), stop.Order.Bid, price, cmd.Size)
+	if err != nil {
+		return CommandResult{Err: err}
+	}
+	held := ex.ledger.HoldOf(cmd.OrderID)
+	if extra := required.Sub(held); extra.IsPositive() {
+		if err := ex.ledger.Hold(cmd.Market, cmd.OrderID, stop.Order.UserID, asset, extra); err != nil {
+			return CommandResult{Err: err}
+		}
+	}
+
+	if err := ob.AmendStopOrder(cmd.OrderID, cmd.StopPrice, cmd.Price, cmd.Size); err != nil {
+		ex.releaseBeyond(cmd.OrderID, held)
+		return CommandResult{Err: err}
+	}
+	ex.releaseBeyond(cmd.OrderID, required)
+
+	return CommandResult{Matches: ex.triggerStops(cmd.Market)}
+}
+
+func (ex *Exchange) handleCancelStopOrder(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.market(market); !ok {
+		return marketNotFound(market)
+	}
+	id, err := intParam(c, "id")
+	if err != nil {
+		return err
+	}
+	if !ex.hasStop(market, id) {
+		return stopNotFound(id)
+	}
+
+	res := ex.submit(Command{Type: CancelStopCommand, Market: market, OrderID: id})
+	if res.Err != nil {
+		return invalid(res.Err)
+	}
+
+	log.Println("stop order canceled id => ", id)
+	return c.JSON(http.StatusOK, map[string]any{"msg": "Stop order deleted"})
+}
+
+func (ex *Exchange) cancelStopOrder(cmd Command) CommandResult {
+	stop, err := ex.orderbook(cmd.Market).CancelStopOrder(cmd.OrderID)
+	if err != nil {
+		return CommandResult{Err: err}
+	}
+	if err := ex.ledger.Release(stop.Order.ID, ex.ledger.HoldOf(stop.Order.ID)); err != nil {
+		return CommandResult{Order: stop.Order, Err: fmt.Errorf("release order %d: %w", stop.Order.ID, err)}
+	}
+
+	return CommandResult{Order: stop.Order}
+}
+
+func (ex *Exchange) handleSetMarkPrice(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob := ex.orderbook(market)
+	if ob == nil {
+		return marketNotFound(market)
+	}
+
+	var req SetMarkPriceRequest
+	if err := bind(c, &req); err != nil {
+		return err
+	}
+
+	price, err := req.Price.Rescale(ob.PriceScale)
+	if err != nil || !price.IsPositive() {
+		return newError(http.StatusBadRequest, CodeInvalidRequest, "invalid mark price: %s", req.Price)
+	}
+
+	res := ex.submit(Command{Type: SetMarkPriceCommand, Market: market, Price: price})
+
+	if err := ex.handleMatches(market, res); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, PriceResponse{Price: price})
+}
+
+func (ex *Exchange) setMarkPrice(cmd Command) CommandResult {
+	ex.orderbook(cmd.Market).SetMarkPrice(cmd.Price)
+
+	return CommandResult{Matches: ex.triggerStops(cmd.Market)}
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/jeffersonsong/crypto-exchange/decimal"
+	"github.com/jeffersonsong/crypto-exchange/orderbook"
+)
+
+const (
+	// The maker of a trade rested in the book, the taker took its liquidity.
+	MakerLiquidity Liquidity = "MAKER"
+	TakerLiquidity Liquidity = "TAKER"
+
+	// tradeRingSize is how many of the latest trades of a market are kept
+	// for the trade tape.
+	tradeRingSize = 1000
+)
+
+type Liquidity string
+
+// Trade is a match as the public sees it. TakerBid tells whether the taker
+// bought. Timestamp is the unix time in nanoseconds of the command that made
+// the match.
+type Trade struct {
+	ID           int64
+	Market       Market
+	Price        decimal.Decimal
+	Size         decimal.Decimal
+	MakerOrderID int64
+	TakerOrderID int64
+	TakerBid     bool
+	Timestamp    int64
+}
+
+// Fill is the part an order of a user had in a trade. Buyers pay their Fee
+// in the base asset, sellers in the quote asset.
+type Fill struct {
+	TradeID   int64
+	OrderID   int64
+	UserID    int64
+	Market    Market
+	Bid       bool
+	Price     decimal.Decimal
+	Size      decimal.Decimal
+	Liquidity Liquidity
+	Fee       decimal.Decimal
+	FeeAsset  Asset
+	Timestamp int64
+}
+
+// FillQuery picks the fills of a user. Zero fields do not filter. Fills
+// happened at or after From and before To. Pages go from the newest trade to
+// the oldest, Cursor is the NextCursor of the previous page.
+type FillQuery struct {
+	Market Market
+	From   int64
+	To     int64
+	Cursor int64
+	Limit  int
+}
+
+func (q *FillQuery) match(f *Fill) bool {
+	if q.Cursor != 0 && f.TradeID >= q.Cursor {
+		return false
+	}
+	if q.Market != "" && f.Market != q.Market {
+		return false
+	}
+	return (q.From == 0 || f.Timestamp >= q.From) && (q.To == 0 || f.Timestamp < q.To)
+}
+
+// FillsResponse is a page of the fills of a user, the newest first.
+// NextCursor is 0 on the last page.
+type FillsResponse struct {
+	Fills      []*Fill
+	NextCursor int64
+}
+
+// tradeRecord is how a trade is kept, with the fills of the maker and the
+// taker. Seq and Match are the journal sequence number of the command that
+// made the match and its position among the matches of the command, like
+// those of a settlement.
+type tradeRecord struct {
+	Trade
+	Seq   uint64
+	Match int
+	Fills []*Fill
+}
+
+// tradeKey identifies a journaled match, so it is never traded twice.
+type tradeKey struct {
+	seq   uint64
+	match int
+}
+
+// tradeRing keeps the latest trades of a market, the oldest one is
+// overwritten once it is full.
+type tradeRing struct {
+	trades []*Trade
+	n      int
+}
+
+func newTradeRing(size int) *tradeRing {
+	return &tradeRing{trades: make([]*Trade, size)}
+}
+
+func (r *tradeRing) add(t *Trade) {
+	r.trades[r.n%len(r.trades)] = t
+	r.n++
+}
+
+// latest returns copies of up to limit trades, the newest first.
+func (r *tradeRing) latest(limit int) []*Trade {
+	if r.n < limit {
+		limit = r.n
+	}
+	if len(r.trades) < limit {
+		limit = len(r.trades)
+	}
+
+	trades := make([]*Trade, limit)
+	for i := range trades {
+		t := *r.trades[(r.n-1-i)%len(r.trades)]
+		trades[i] = &t
+	}
+	return trades
+}
+
+// TradeStore keeps the trades of the exchange: the latest ones of every
+// market for the trade tape and the fills of every user. With a file, every
+// trade is written to it as one JSON line before it is kept, so the trades
+// survive a restart.
+type TradeStore struct {
+	mu     sync.RWMutex
+	f      *os.File
+	lastID int64
+	// keys map a journaled match to the ID of its trade.
+	keys   map[tradeKey]int64
+	recent map[Market]*tradeRing
+	// fills map a user to their fills, by trade ID.
+	fills map[int64][]*Fill
+}
+
+// NewTradeStore returns a trade store that only keeps its trades in memory.
+func NewTradeStore() *TradeStore {
+	return &TradeStore{
+		keys:   make(map[tradeKey]int64),
+		recent: make(map[Market]*tradeRing),
+		fills:  make(map[int64][]*Fill),
+	}
+}
+
+// OpenFile loads the trades of the file at path, creating it when it does
+// not exist, and writes every new trade to it from then on. It must be
+// called before trades are added.
+func (s *TradeStore) OpenFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+
+	return nil
+}
+
+func (s *TradeStore) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var rec tradeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("trades %s line %d: %w", path, line, err)
+		}
+		s.set(&rec)
+	}
+
+	return scanner.Err()
+}
+
+// Add gives the trades their IDs and keeps them. Trades of a journaled match
+// that is already kept are skipped and get the ID they were kept with.
+func (s *TradeStore) Add(records ...*tradeRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rec := range records {
+		if id, ok := s.keys[tradeKey{seq: rec.Seq, match: rec.Match}]; ok && rec.Seq != 0 {
+			rec.ID = id
+			continue
+		}
+
+		rec.ID = s.lastID + 1
+		for _, f := range rec.Fills {
+			f.TradeID = rec.ID
+		}
+		if s.f != nil {
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if _, err := s.f.Write(append(b, '\n')); err != nil {
+				return err
+			}
+			if err := s.f.Sync(); err != nil {
+				return err
+			}
+		}
+		s.set(rec)
+	}
+
+	return nil
+}
+
+func (s *TradeStore) set(rec *tradeRecord) {
+	s.keys[tradeKey{seq: rec.Seq, match: rec.Match}] = rec.ID
+	if rec.ID > s.lastID {
+		s.lastID = rec.ID
+	}
+
+	ring, ok := s.recent[rec.Market]
+	if !ok {
+		ring = newTradeRing(tradeRingSize)
+		s.recent[rec.Market] = ring
+	}
+	trade := rec.Trade
+	ring.add(&trade)
+
+	for _, f := range rec.Fills {
+		s.fills[f.UserID] = append(s.fills[f.UserID], f)
+	}
+}
+
+// Recent returns up to limit of the latest trades of the market, the newest
+// first.
+func (s *TradeStore) Recent(market Market, limit int) []*Trade {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ring, ok := s.recent[market]
+	if !ok {
+		return []*Trade{}
+	}
+	return ring.latest(limit)
+}
+
+// Fills returns copies of up to limit fills of the user that match the
+// query, the newest first.
+func (s *TradeStore) Fills(userID int64, q *FillQuery, limit int) []*Fill {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fills := []*Fill{}
+	userFills := s.fills[userID]
+	for i := len(userFills) - 1; i >= 0 && len(fills) < limit; i-- {
+		if q.match(userFills[i]) {
+			f := *userFills[i]
+			fills = append(fills, &f)
+		}
+	}
+	return fills
+}
+
+func (s *TradeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// fees returns what the buyer and the seller of the match pay: the buyer a
+// share of the size in the base asset, the seller a share of the notional in
+// the quote asset. Fees are rounded down. It fails when the notional of the
+// match overflows.
+func (m MarketConfig) fees(match orderbook.Match) (bidFee, askFee decimal.Decimal, err error) {
+	bidRate, askRate := m.MakerFee, m.TakerFee
+	if match.TakerBid {
+		bidRate, askRate = m.TakerFee, m.MakerFee
+	}
+
+	notional, err := match.Price.CheckedMul(match.SizeFilled)
+	if err != nil {
+		return decimal.Zero, decimal.Zero, err
+	}
+	if bidFee, err = match.SizeFilled.CheckedMulTruncate(bidRate, m.SizeScale()); err != nil {
+		return decimal.Zero, decimal.Zero, err
+	}
+	if askFee, err = notional.CheckedMulTruncate(askRate, m.NotionalScale()); err != nil {
+		return decimal.Zero, decimal.Zero, err
+	}
+	return bidFee, askFee, nil
+}
+
+// recordTrades turns the matches of the command into trades and returns
+// their IDs, none when they could not be kept. It is only called by the
+// engine of the market of the command.
+func (ex *Exchange) recordTrades(cmd Command, res CommandResult) []int64 {
+	if len(res.Matches) == 0 {
+		return nil
+	}
+	cfg, ok := ex.MarketConfig(cmd.Market)
+	if !ok {
+		return nil
+	}
+
+	records := make([]*tradeRecord, len(res.Matches))
+	for i, match := range res.Matches {
+		// The ledger did not settle a match its fees overflow for either.
+		bidFee, askFee, err := cfg.fees(match)
+		if err != nil {
+			log.Printf("trade fees => ask %d | bid %d | err [%v]", match.Ask.ID, match.Bid.ID, err)
+		}
+		fill := func(o *orderbook.Order, liquidity Liquidity) *Fill {
+			f := &Fill{
+				OrderID:   o.ID,
+				UserID:    o.UserID,
+				Market:    cmd.Market,
+				Bid:       o.Bid,
+				Price:     match.Price,
+				Size:      match.SizeFilled,
+				Liquidity: liquidity,
+				Fee:       askFee,
+				FeeAsset:  cfg.Quote,
+				Timestamp: cmd.Timestamp,
+			}
+			if o.Bid {
+				f.Fee, f.FeeAsset = bidFee, cfg.Base
+			}
+			return f
+		}
+
+		records[i] = &tradeRecord{
+			Trade: Trade{
+				Market:       cmd.Market,
+				Price:        match.Price,
+				Size:         match.SizeFilled,
+				MakerOrderID: match.Maker().ID,
+				TakerOrderID: match.Taker().ID,
+				TakerBid:     match.TakerBid,
+				Timestamp:    cmd.Timestamp,
+			},
+			Seq:   cmd.Seq,
+			Match: i,
+			Fills: []*Fill{fill(match.Maker(), MakerLiquidity), fill(match.Taker(), TakerLiquidity)},
+		}
+	}
+
+	if err := ex.trades.Add(records...); err != nil {
+		log.Printf("trades of %s failed: %v", cmd.Market, err)
+		return nil
+	}
+
+	ids := make([]int64, len(records))
+	for i, rec := range records {
+		ids[i] = rec.ID
+	}
+	return ids
+}
+
+// Trades returns up to limit of the latest trades of the market, the newest
+// first.
+func (ex *Exchange) Trades(market Market, limit int) ([]*Trade, error) {
+	if _, ok := ex.market(market); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMarketNotFound, market)
+	}
+	limit, err := pageLimit(limit, tradeRingSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return ex.trades.Recent(market, limit), nil
+}
+
+// Fills returns a page of the fills of the user.
+func (ex *Exchange) Fills(userID int64, q FillQuery) (*FillsResponse, error) {
+	limit, err := pageLimit(q.Limit, maxHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	if q.Market != "" {
+		if _, ok := ex.market(q.Market); !ok {
+			return nil, fmt.Errorf("%w: %s", ErrMarketNotFound, q.Market)
+		}
+	}
+
+	// One more than the page tells whether there is a next one.
+	fills := ex.trades.Fills(userID, &q, limit+1)
+
+	resp := &FillsResponse{Fills: fills}
+	if len(fills) > limit {
+		resp.Fills = fills[:limit]
+		resp.NextCursor = fills[limit-1].TradeID
+	}
+
+	return resp, nil
+}
+
+// handleGetTrades returns the latest trades of the market, as many as the
+// limit query parameter asks for.
+func (ex *Exchange) handleGetTrades(c echo.Context) error {
+	limit, err := intQuery(c, "limit")
+	if err != nil {
+		return err
+	}
+
+	trades, err := ex.Trades(Market(c.Param("market")), int(limit))
+	if err != nil {
+		return invalid(err)
+	}
+
+	return c.JSON(http.StatusOK, trades)
+}
+
+// handleGetFills returns the fills of the user, filtered by the market, from
+// and to query parameters and paged by cursor and limit.
+func (ex *Exchange) handleGetFills(c echo.Context) error {
+	userID, err := intParam(c, "userID")
+	if err != nil {
+		return err
+	}
+
+	q := FillQuery{Market: Market(c.QueryParam("market"))}
+	for name, v := range map[string]*int64{"from": &q.From, "to": &q.To, "cursor": &q.Cursor} {
+		if *v, err = intQuery(c, name); err != nil {
+			return err
+		}
+	}
+	limit, err := intQuery(c, "limit")
+	if err != nil {
+		return err
+	}
+	q.Limit = int(limit)
+
+	resp, err := ex.Fills(userID, q)
+	if err != nil {
+		return invalid(err)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}